@@ -0,0 +1,256 @@
+package memory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/unistack-org/micro/v3/register"
+)
+
+// codecVersion is the first byte of every encoded result
+const codecVersion = 1
+
+// maxValueDepth limits how deeply endpoint values may nest when decoding,
+// so crafted input cannot exhaust the stack
+const maxValueDepth = 32
+
+// ErrInvalidEncoding is returned when decoding malformed data
+var ErrInvalidEncoding = errors.New("invalid result encoding")
+
+type encoder struct {
+	buf bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (e *encoder) uvarint(v uint64) {
+	n := binary.PutUvarint(e.tmp[:], v)
+	e.buf.Write(e.tmp[:n])
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *encoder) string(v string) {
+	e.uvarint(uint64(len(v)))
+	e.buf.WriteString(v)
+}
+
+func (e *encoder) metadata(md map[string]string) {
+	e.uvarint(uint64(len(md)))
+	for k, v := range md {
+		e.string(k)
+		e.string(v)
+	}
+}
+
+func (e *encoder) value(v *register.Value) {
+	e.bool(v != nil)
+	if v == nil {
+		return
+	}
+	e.string(v.Name)
+	e.string(v.Type)
+	e.uvarint(uint64(len(v.Values)))
+	for _, sv := range v.Values {
+		e.value(sv)
+	}
+}
+
+func (e *encoder) service(s *register.Service) {
+	e.bool(s != nil)
+	if s == nil {
+		return
+	}
+	e.string(s.Name)
+	e.string(s.Version)
+	e.metadata(s.Metadata)
+	e.uvarint(uint64(len(s.Endpoints)))
+	for _, ep := range s.Endpoints {
+		e.bool(ep != nil)
+		if ep == nil {
+			continue
+		}
+		e.string(ep.Name)
+		e.value(ep.Request)
+		e.value(ep.Response)
+		e.metadata(ep.Metadata)
+	}
+	e.uvarint(uint64(len(s.Nodes)))
+	for _, n := range s.Nodes {
+		e.bool(n != nil)
+		if n == nil {
+			continue
+		}
+		e.string(n.Id)
+		e.string(n.Address)
+		e.metadata(n.Metadata)
+	}
+}
+
+// EncodeResult encodes the result in a compact binary format, strings are
+// length prefixed and the result can be decoded with DecodeResult
+func EncodeResult(r *register.Result) ([]byte, error) {
+	if r == nil {
+		return nil, errors.New("result is nil")
+	}
+	e := &encoder{}
+	e.buf.WriteByte(codecVersion)
+	e.string(r.Action)
+	e.service(r.Service)
+	return e.buf.Bytes(), nil
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrInvalidEncoding
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// count reads a collection length, each element takes at least one byte
+func (d *decoder) count() int {
+	v := d.uvarint()
+	if v > uint64(len(d.buf)) {
+		d.err = ErrInvalidEncoding
+		return 0
+	}
+	return int(v)
+}
+
+func (d *decoder) bool() bool {
+	if d.err != nil {
+		return false
+	}
+	if len(d.buf) == 0 || d.buf[0] > 1 {
+		d.err = ErrInvalidEncoding
+		return false
+	}
+	v := d.buf[0] == 1
+	d.buf = d.buf[1:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = ErrInvalidEncoding
+		return ""
+	}
+	v := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) metadata() map[string]string {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+	md := make(map[string]string, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.string()
+		md[k] = d.string()
+	}
+	return md
+}
+
+func (d *decoder) value(depth int) *register.Value {
+	if depth > maxValueDepth {
+		d.err = ErrInvalidEncoding
+		return nil
+	}
+	if !d.bool() {
+		return nil
+	}
+	v := &register.Value{
+		Name: d.string(),
+		Type: d.string(),
+	}
+	if n := d.count(); n > 0 {
+		v.Values = make([]*register.Value, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			v.Values = append(v.Values, d.value(depth+1))
+		}
+	}
+	return v
+}
+
+func (d *decoder) service() *register.Service {
+	if !d.bool() {
+		return nil
+	}
+	s := &register.Service{
+		Name:     d.string(),
+		Version:  d.string(),
+		Metadata: d.metadata(),
+	}
+	if n := d.count(); n > 0 {
+		s.Endpoints = make([]*register.Endpoint, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			if !d.bool() {
+				s.Endpoints = append(s.Endpoints, nil)
+				continue
+			}
+			s.Endpoints = append(s.Endpoints, &register.Endpoint{
+				Name:     d.string(),
+				Request:  d.value(0),
+				Response: d.value(0),
+				Metadata: d.metadata(),
+			})
+		}
+	}
+	if n := d.count(); n > 0 {
+		s.Nodes = make([]*register.Node, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			if !d.bool() {
+				s.Nodes = append(s.Nodes, nil)
+				continue
+			}
+			s.Nodes = append(s.Nodes, &register.Node{
+				Id:       d.string(),
+				Address:  d.string(),
+				Metadata: d.metadata(),
+			})
+		}
+	}
+	return s
+}
+
+// DecodeResult decodes a result encoded with EncodeResult
+func DecodeResult(b []byte) (*register.Result, error) {
+	if len(b) == 0 || b[0] != codecVersion {
+		return nil, ErrInvalidEncoding
+	}
+	d := &decoder{buf: b[1:]}
+	r := &register.Result{
+		Action:  d.string(),
+		Service: d.service(),
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.buf) > 0 {
+		return nil, ErrInvalidEncoding
+	}
+	return r, nil
+}
@@ -0,0 +1,120 @@
+package memory
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/unistack-org/micro/v3/register"
+)
+
+func TestEncodeResult(t *testing.T) {
+	testData := []*register.Result{
+		{},
+		{Action: "delete", Service: &register.Service{Name: "foo"}},
+		{
+			Action: "create",
+			Service: &register.Service{
+				Name:     "foo",
+				Version:  "1.0.0",
+				Metadata: map[string]string{"domain": "micro", "region": "eu"},
+				Endpoints: []*register.Endpoint{
+					{
+						Name: "Foo.Call",
+						Request: &register.Value{
+							Name: "Request",
+							Type: "Request",
+							Values: []*register.Value{
+								{Name: "name", Type: "string"},
+							},
+						},
+						Response: &register.Value{Name: "Response", Type: "Response"},
+						Metadata: map[string]string{"stream": "false"},
+					},
+				},
+				Nodes: []*register.Node{
+					{Id: "foo-1", Address: "localhost:9999", Metadata: map[string]string{"protocol": "grpc"}},
+					{Id: "foo-2", Address: "localhost:6666"},
+				},
+			},
+		},
+	}
+
+	for _, r := range testData {
+		b, err := EncodeResult(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := DecodeResult(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r, d) {
+			t.Fatalf("Expected %+v, got %+v", r, d)
+		}
+	}
+}
+
+func TestDecodeResultInvalid(t *testing.T) {
+	b, err := EncodeResult(&register.Result{Action: "create", Service: &register.Service{Name: "foo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := [][]byte{
+		nil,
+		{0},
+		b[:len(b)-1],
+		append(b, 0),
+	}
+
+	for _, data := range testData {
+		if _, err := DecodeResult(data); err != ErrInvalidEncoding {
+			t.Fatalf("Expected ErrInvalidEncoding for %v, got %v", data, err)
+		}
+	}
+}
+
+func TestDecodeResultDepth(t *testing.T) {
+	nested := func(depth int) *register.Value {
+		v := &register.Value{Name: "leaf", Type: "string"}
+		for i := 0; i < depth; i++ {
+			v = &register.Value{Name: "field", Type: "Message", Values: []*register.Value{v}}
+		}
+		return v
+	}
+
+	newResult := func(depth int) *register.Result {
+		return &register.Result{
+			Action: "create",
+			Service: &register.Service{
+				Name:      "foo",
+				Endpoints: []*register.Endpoint{{Name: "Foo.Call", Request: nested(depth)}},
+			},
+		}
+	}
+
+	b, err := EncodeResult(newResult(maxValueDepth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeResult(b); err != nil {
+		t.Fatalf("Expected depth %d to decode, got %v", maxValueDepth, err)
+	}
+
+	b, err = EncodeResult(newResult(maxValueDepth + 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeResult(b); err != ErrInvalidEncoding {
+		t.Fatalf("Expected ErrInvalidEncoding for depth %d, got %v", maxValueDepth+1, err)
+	}
+
+	// a crafted payload nesting far deeper than any real schema
+	buf := []byte{codecVersion, 0, 1, 3, 'f', 'o', 'o', 0, 0, 1, 1, 0}
+	for i := 0; i < 1<<20; i++ {
+		buf = append(buf, 1, 0, 0, 1)
+	}
+	if _, err := DecodeResult(buf); err != ErrInvalidEncoding {
+		t.Fatalf("Expected ErrInvalidEncoding for crafted payload, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package memory
+
+import (
+	"time"
+)
+
+// maxRemovedNodes bounds the removed nodes history per service
+const maxRemovedNodes = 100
+
+// RemovedNode is a node recently removed from a service
+type RemovedNode struct {
+	Id        string
+	Address   string
+	Version   string
+	RemovedAt time.Time
+	// Reason is deregister or expired
+	Reason string
+}
+
+// recordRemoved adds the node to the removed history of the service,
+// the caller must hold the lock
+func (m *memory) recordRemoved(domain string, r *record, n *node, reason string) {
+	if m.removedWindow == 0 {
+		return
+	}
+
+	if _, ok := m.removed[domain]; !ok {
+		m.removed[domain] = make(map[string][]RemovedNode)
+	}
+
+	history := append(m.removed[domain][r.Name], RemovedNode{
+		Id:        n.Id,
+		Address:   n.Address,
+		Version:   r.Version,
+		RemovedAt: m.now(),
+		Reason:    reason,
+	})
+	if len(history) > maxRemovedNodes {
+		history = history[len(history)-maxRemovedNodes:]
+	}
+
+	m.removed[domain][r.Name] = history
+}
+
+// pruneRemoved drops the history entries older than the window,
+// the caller must hold the lock
+func (m *memory) pruneRemoved() {
+	for domain, services := range m.removed {
+		for service, history := range services {
+			var i int
+			for i < len(history) && m.now().Sub(history[i].RemovedAt) > m.removedWindow {
+				i++
+			}
+			if i == len(history) {
+				delete(services, service)
+				continue
+			}
+			services[service] = history[i:]
+		}
+		if len(services) == 0 {
+			delete(m.removed, domain)
+		}
+	}
+}
+
+// RecentlyRemoved returns the nodes removed from the service within the
+// RemovedHistory window, oldest first
+func (m *memory) RecentlyRemoved(domain, service string) ([]RemovedNode, error) {
+	if m.isClosed() {
+		return nil, ErrClosed
+	}
+
+	domain = m.defaultDomain(domain)
+
+	m.RLock()
+	defer m.RUnlock()
+
+	history := m.removed[domain][service]
+	result := make([]RemovedNode, 0, len(history))
+	for _, rn := range history {
+		if m.now().Sub(rn.RemovedAt) <= m.removedWindow {
+			result = append(result, rn)
+		}
+	}
+
+	return result, nil
+}
+
+// copyRemoved returns a copy of the removed history of the domain
+func copyRemoved(services map[string][]RemovedNode) map[string][]RemovedNode {
+	if services == nil {
+		return nil
+	}
+	c := make(map[string][]RemovedNode, len(services))
+	for service, history := range services {
+		c[service] = append([]RemovedNode(nil), history...)
+	}
+	return c
+}
@@ -0,0 +1,86 @@
+package memory
+
+// index maps a metadata key and value to the records having it
+type index map[string]map[string]map[*record]struct{}
+
+// indexAdd adds the record to the indexes of the domain, the caller must hold the lock
+func (m *memory) indexAdd(domain string, r *record) {
+	if len(m.indexKeys) == 0 {
+		return
+	}
+
+	idx, ok := m.indexes[domain]
+	if !ok {
+		idx = make(index)
+		m.indexes[domain] = idx
+	}
+
+	for key := range m.indexKeys {
+		value, ok := r.Metadata[key]
+		if !ok {
+			continue
+		}
+		if _, ok := idx[key]; !ok {
+			idx[key] = make(map[string]map[*record]struct{})
+		}
+		if _, ok := idx[key][value]; !ok {
+			idx[key][value] = make(map[*record]struct{})
+		}
+		idx[key][value][r] = struct{}{}
+	}
+}
+
+// indexRemove removes the record from the indexes of the domain, the caller must hold the lock
+func (m *memory) indexRemove(domain string, r *record) {
+	idx, ok := m.indexes[domain]
+	if !ok {
+		return
+	}
+
+	for key := range m.indexKeys {
+		value, ok := r.Metadata[key]
+		if !ok {
+			continue
+		}
+		delete(idx[key][value], r)
+		if len(idx[key][value]) == 0 {
+			delete(idx[key], value)
+		}
+		if len(idx[key]) == 0 {
+			delete(idx, key)
+		}
+	}
+
+	if len(idx) == 0 {
+		delete(m.indexes, domain)
+	}
+}
+
+// indexRebuild recreates the indexes for all records, the caller must hold the lock
+func (m *memory) indexRebuild() {
+	m.indexes = make(map[string]index)
+
+	for domain, services := range m.records {
+		for _, versions := range services {
+			for _, r := range versions {
+				m.indexAdd(domain, r)
+			}
+		}
+	}
+}
+
+// indexLookup returns the records of the domain matching the metadata key and value,
+// ok is false if the key isn't indexed, the caller must hold the lock
+func (m *memory) indexLookup(domain, key, value string) ([]*record, bool) {
+	if !m.indexKeys[key] {
+		return nil, false
+	}
+
+	matches := m.indexes[domain][key][value]
+	records := make([]*record, 0, len(matches))
+	for r := range matches {
+		records = append(records, r)
+	}
+
+	return records, true
+}
@@ -0,0 +1,100 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/unistack-org/micro/v3/register"
+)
+
+func registerZones(b testing.TB, m register.Register, count int) {
+	ctx := context.TODO()
+	zones := []string{"eu-1a", "eu-1b", "us-1a", "us-1b"}
+
+	for i := 0; i < count; i++ {
+		srv := &register.Service{
+			Name:     fmt.Sprintf("svc-%d", i),
+			Version:  "1.0.0",
+			Metadata: map[string]string{"zone": zones[i%len(zones)]},
+		}
+		if err := m.Register(ctx, srv); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func serviceNames(svcs []*register.Service) []string {
+	names := make([]string, 0, len(svcs))
+	for _, s := range svcs {
+		names = append(names, s.Name+":"+s.Version)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestIndexMatchesScan(t *testing.T) {
+	ctx := context.TODO()
+	indexed := NewRegister(IndexMetadata("zone"))
+	scanned := NewRegister()
+
+	registerZones(t, indexed, 100)
+	registerZones(t, scanned, 100)
+
+	// remove some services so the index has to be maintained
+	for i := 0; i < 100; i += 3 {
+		srv := &register.Service{Name: fmt.Sprintf("svc-%d", i), Version: "1.0.0"}
+		if err := indexed.Deregister(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+		if err := scanned.Deregister(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, zone := range []string{"eu-1a", "us-1b", "unknown"} {
+		a, err := indexed.ListServices(ctx, ListMetadata("zone", zone))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := scanned.ListServices(ctx, ListMetadata("zone", zone))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(serviceNames(a)) != fmt.Sprint(serviceNames(b)) {
+			t.Fatalf("index mismatch for zone %s: %v != %v", zone, serviceNames(a), serviceNames(b))
+		}
+	}
+
+	// rebuilding the indexes on Init must keep them consistent
+	if err := scanned.Init(IndexMetadata("zone")); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := indexed.ListServices(ctx, ListMetadata("zone", "eu-1b"))
+	b, _ := scanned.ListServices(ctx, ListMetadata("zone", "eu-1b"))
+	if fmt.Sprint(serviceNames(a)) != fmt.Sprint(serviceNames(b)) {
+		t.Fatalf("index mismatch after rebuild: %v != %v", serviceNames(a), serviceNames(b))
+	}
+}
+
+func benchmarkListMetadata(b *testing.B, opts ...register.Option) {
+	ctx := context.TODO()
+	m := NewRegister(opts...)
+	registerZones(b, m, 10000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.ListServices(ctx, ListMetadata("zone", "eu-1a")); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkListMetadataIndexed(b *testing.B) {
+	benchmarkListMetadata(b, IndexMetadata("zone"))
+}
+
+func BenchmarkListMetadataUnindexed(b *testing.B) {
+	benchmarkListMetadata(b)
+}
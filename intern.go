@@ -0,0 +1,27 @@
+package memory
+
+// intern returns the shared copy of the string with InternMetadata, so equal
+// metadata across records share their storage, the caller must hold the lock
+func (m *memory) intern(s string) string {
+	if m.interned == nil {
+		return s
+	}
+	if v, ok := m.interned[s]; ok {
+		return v
+	}
+	m.interned[s] = s
+	return s
+}
+
+// internMetadata returns the metadata with the shared copies of its keys and
+// values, the caller must hold the lock
+func (m *memory) internMetadata(md map[string]string) map[string]string {
+	if m.interned == nil {
+		return md
+	}
+	interned := make(map[string]string, len(md))
+	for k, v := range md {
+		interned[m.intern(k)] = m.intern(v)
+	}
+	return interned
+}
@@ -0,0 +1,67 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/unistack-org/micro/v3/register"
+)
+
+// loadCall is a loader call in flight
+type loadCall struct {
+	done chan struct{}
+	err  error
+}
+
+// load registers the services returned by the loader into the domain,
+// concurrent calls for the same service wait for the first one or until
+// their context is done
+func (m *memory) load(ctx context.Context, domain, name string, loader func(context.Context, string) ([]*register.Service, error)) error {
+	key := domain + "/" + name
+
+	m.Lock()
+	if c, ok := m.loads[key]; ok {
+		m.Unlock()
+		select {
+		case <-c.done:
+			return c.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	c := &loadCall{done: make(chan struct{})}
+	m.loads[key] = c
+	m.Unlock()
+
+	c.err = m.populate(ctx, domain, name, loader)
+
+	m.Lock()
+	delete(m.loads, key)
+	m.Unlock()
+	close(c.done)
+
+	return c.err
+}
+
+// populate registers the services returned by the loader into the domain,
+// a replica populates its records as well
+func (m *memory) populate(ctx context.Context, domain, name string, loader func(context.Context, string) ([]*register.Service, error)) error {
+	srvs, err := loader(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(srvs) == 0 {
+		return register.ErrNotFound
+	}
+
+	for _, s := range srvs {
+		m.Lock()
+		events, err := m.register(s, register.NewRegisterOptions(register.RegisterDomain(domain)))
+		m.Unlock()
+		if err != nil {
+			return err
+		}
+		m.sendEvents(events)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/unistack-org/micro/v3/logger"
+	"github.com/unistack-org/micro/v3/register"
+)
+
+// logFields are the structured fields attached to a log line
+type logFields map[string]interface{}
+
+// serviceFields returns the fields describing an operation on a service,
+// empty values are left out
+func serviceFields(domain, service, version, node, action string) logFields {
+	fields := logFields{}
+	for k, v := range map[string]string{
+		"domain":  domain,
+		"service": service,
+		"version": version,
+		"node":    node,
+		"action":  action,
+	} {
+		if len(v) > 0 {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// resultFields returns the fields describing the event
+func resultFields(r *register.Result) logFields {
+	if r.Service == nil {
+		return logFields{"action": r.Action}
+	}
+	return serviceFields(r.Service.Metadata["domain"], r.Service.Name, r.Service.Version, "", r.Action)
+}
+
+// String formats the fields as sorted key=value pairs
+func (f logFields) String() string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", k, f[k]))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// logOptions are the logger and its context, stored on configure
+type logOptions struct {
+	logger logger.Logger
+	ctx    context.Context
+}
+
+// logf logs the message at the level with the fields appended to it, the
+// logger Fields api is not used as it changes the shared logger in place
+func (m *memory) logf(level logger.Level, fields logFields, msg string, args ...interface{}) {
+	o, _ := m.log.Load().(logOptions)
+	l := o.logger
+	if l == nil || !l.V(level) {
+		return
+	}
+
+	msg = fmt.Sprintf(msg, args...)
+	if len(fields) > 0 {
+		msg += " " + fields.String()
+	}
+
+	ctx := o.ctx
+	switch level {
+	case logger.TraceLevel:
+		l.Tracef(ctx, "%s", msg)
+	case logger.DebugLevel:
+		l.Debugf(ctx, "%s", msg)
+	case logger.WarnLevel:
+		l.Warnf(ctx, "%s", msg)
+	case logger.ErrorLevel:
+		l.Errorf(ctx, "%s", msg)
+	default:
+		l.Infof(ctx, "%s", msg)
+	}
+}
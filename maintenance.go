@@ -0,0 +1,57 @@
+package memory
+
+// SetMaintenance freezes the register for coordinated upgrades, while on
+// every change to the register returns ErrMaintenance and the pruner expires
+// nothing, reads and watches are unaffected. When turned off the nodes are
+// aged as if the freeze never happened so they don't expire all at once.
+func (m *memory) SetMaintenance(on bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	if on == m.maintenance {
+		return
+	}
+	m.maintenance = on
+
+	now := m.now()
+	if on {
+		m.maintenanceSince = now
+		return
+	}
+
+	// shift the last seen times by the freeze duration
+	frozen := elapsed(now, m.maintenanceSince)
+	for _, services := range m.records {
+		for _, versions := range services {
+			for _, r := range versions {
+				for _, n := range r.Nodes {
+					n.LastSeen = n.LastSeen.Add(frozen)
+				}
+			}
+		}
+	}
+}
+
+// mutable returns the error of a change to the register, the caller must
+// hold the lock
+func (m *memory) mutable() error {
+	if m.closed {
+		return ErrClosed
+	}
+	if m.maintenance {
+		return ErrMaintenance
+	}
+	return nil
+}
+
+// writable returns the error of a change like mutable, changes mirrored from
+// the upstream are applied during maintenance. The caller must hold the lock.
+func (m *memory) writable(mirrored bool) error {
+	if mirrored {
+		if m.closed {
+			return ErrClosed
+		}
+		return nil
+	}
+	return m.mutable()
+}
@@ -3,10 +3,17 @@ package memory
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/unistack-org/micro/v3/logger"
 	"github.com/unistack-org/micro/v3/register"
 )
@@ -14,12 +21,64 @@ import (
 var (
 	sendEventTime = 10 * time.Millisecond
 	ttlPruneTime  = time.Second
+	maxSchemaSize = 1 << 20
+)
+
+// DefaultIdentityKey is the node metadata key holding the SPIFFE identity
+var DefaultIdentityKey = "spiffe_id"
+
+var (
+	// ErrPinned is returned when deregistering a pinned service
+	ErrPinned = errors.New("service is pinned")
+	// ErrLimitExceeded is returned when a configured limit is reached
+	ErrLimitExceeded = errors.New("limit exceeded")
+	// ErrClosed is returned when using a disconnected register
+	ErrClosed = errors.New("register closed")
+	// ErrDuplicateAddress is returned when a node uses the address of another node
+	ErrDuplicateAddress = errors.New("duplicate node address")
+	// ErrMissingIdentity is returned when registering a node without the required identity
+	ErrMissingIdentity = errors.New("missing node identity")
+	// ErrInvalidProtocol is returned when registering a node with an unknown protocol
+	ErrInvalidProtocol = errors.New("invalid node protocol")
+	// ErrInvalidTier is returned when registering a service with an unknown tier
+	ErrInvalidTier = errors.New("invalid service tier")
+	// ErrDomainNotAllowed is returned when using a domain outside of the allowed domains
+	ErrDomainNotAllowed = errors.New("domain not allowed")
+	// ErrDomainExists is returned when renaming a domain to an existing one
+	ErrDomainExists = errors.New("domain already exists")
+	// ErrNodeConflict is returned when a node is registered under another version of the service
+	ErrNodeConflict = errors.New("node registered under another version")
+	// ErrInvalidEndpoint is returned when registering a malformed endpoint with ValidateEndpoints
+	ErrInvalidEndpoint = errors.New("invalid endpoint")
+	// ErrSingleton is returned when registering another node of a Singleton service
+	ErrSingleton = errors.New("singleton service already has a node")
+	// ErrMaintenance is returned when changing the register during the maintenance
+	ErrMaintenance = errors.New("register in maintenance")
+	// ErrNoNodes is returned when registering a service without nodes with RejectEmpty
+	ErrNoNodes = errors.New("service has no nodes")
+	// ErrReadOnly is returned when changing a replica register
+	ErrReadOnly = errors.New("register is read only")
 )
 
 type node struct {
 	*register.Node
 	TTL      time.Duration
 	LastSeen time.Time
+	// Drained nodes stay registered but shouldn't receive new requests
+	Drained bool
+	// StaleWarned is set once the stale warning was sent for the node
+	StaleWarned bool
+	// Static nodes never expire, they are only removed by Deregister
+	Static bool
+	// OnExpire is called with the node once it is pruned for its TTL
+	OnExpire func(*register.Node)
+	// Deadline is the absolute expiry of the node, it takes precedence over the TTL
+	Deadline time.Time
+	// Hash is the stable hash of the node id surfaced with NodeHash
+	Hash string
+	// LastError is the last error reported for the node and when
+	LastError   string
+	LastErrorAt time.Time
 }
 
 type record struct {
@@ -28,65 +87,560 @@ type record struct {
 	Metadata  map[string]string
 	Nodes     map[string]*node
 	Endpoints []*register.Endpoint
+	// Pinned records are never pruned and can't be deregistered
+	Pinned bool
+	// Revision is the register revision of the last change to the record
+	Revision uint64
+	// Schema is the schema document of the service, it isn't part of lookups
+	Schema []byte
+}
+
+// hasProtocol reports whether any node of the record uses the protocol
+func (r *record) hasProtocol(protocol string) bool {
+	for _, n := range r.Nodes {
+		if n.Metadata["protocol"] == protocol {
+			return true
+		}
+	}
+	return false
 }
 
 type memory struct {
-	opts register.Options
+	// droppedEvents and sequence are first to be 64-bit aligned for atomic access
+	droppedEvents uint64
+	// sequence is the number of the last event stamped with EventSequence
+	sequence uint64
+	opts     register.Options
+	// log holds the logOptions so logf reads them with or without the lock
+	log atomic.Value
 	// records is a KV map with domain name as the key and a services map as the value
 	records  map[string]services
 	watchers map[string]*Watcher
+	// reset signals the pruner to pick up a new prune interval
+	reset chan struct{}
+	// exit stops the pruner on disconnect
+	exit          chan struct{}
+	closed        bool
+	pruneInterval time.Duration
+	sendEventTime time.Duration
+	maxServices   int
+	maxMetadata   int
+	maxWatchers   int
+	maxSchema     int
+	// softMaxServices only warns when exceeded
+	softMaxServices int
+	// readyRefresh only refreshes the TTL of nodes registering as ready
+	readyRefresh bool
+	// uniqueNodes rejects node ids registered under several versions
+	uniqueNodes bool
+	// validateEndpoints rejects services with malformed endpoints
+	validateEndpoints bool
+	// rejectEmpty rejects services registered without nodes
+	rejectEmpty bool
+	// pruneEmpty removes the versions left without nodes by the pruner
+	pruneEmpty bool
+	// domainEvents sends events when a domain gets its first service or loses its last one
+	domainEvents bool
+	// eventSequence stamps the events with their sequence number
+	eventSequence bool
+	// nodeHash surfaces the hash of the node ids in the node metadata
+	nodeHash bool
+	// interned are the shared metadata strings with InternMetadata
+	interned map[string]string
+	// pausedEvents are buffered while paused until the delivery resumes
+	paused       bool
+	pausedEvents []*register.Result
+	// outbox holds the events published in order to the sink and the hooks
+	// without an event queue, draining is set while a goroutine empties it
+	outbox   []queuedEvent
+	draining bool
+	// loader populates the services missing on lookup
+	loader func(context.Context, string) ([]*register.Service, error)
+	// validator checks the registrations against the registered versions
+	validator func(*register.Service, []*register.Service) error
+	// loads are the loader calls in flight per domain and service
+	loads map[string]*loadCall
+	// addressCheck enables the duplicate address detection
+	addressCheck  bool
+	addressStrict bool
+	// identityKey is the node metadata key holding the identity
+	identityKey      string
+	identityRequired bool
+	// staleThreshold is the fraction of the TTL after which nodes are reported stale
+	staleThreshold float64
+	// clock returns the current time
+	clock func() time.Time
+	// newID generates the watcher ids
+	newID func() string
+	// hooks are invoked for every event
+	hooks []func(*register.Result)
+	// wildcardConsistent makes wildcard reads hold the lock across all domains
+	wildcardConsistent bool
+	// normalizeKey is applied to the registered metadata keys when set
+	normalizeKey func(string) string
+	// sink publishes every event to an external system
+	sink        func(context.Context, *register.Result) error
+	sinkRetries int
+	// wal is the write-ahead log of the changes, the entries of a running
+	// transaction are kept in walPending until it commits
+	wal         io.Writer
+	walPending  [][]byte
+	walBuffered bool
+	// watchdog detects watchers dropping events
+	watchdog watchdog
+	// domain replaces the parent default domain when set
+	domain string
+	// allowedDomains restricts the registration domains when set
+	allowedDomains map[string]bool
+	// enabledFlags are the feature flags of the services visible to lookups
+	enabledFlags map[string]bool
+	// pooling recycles the removed nodes
+	pooling bool
+	// upstream is the register mirrored by a replica
+	upstream register.Register
+	// removed is the removed nodes history per domain and service
+	removed       map[string]map[string][]RemovedNode
+	removedWindow time.Duration
+	// queue is the bounded event queue of the dispatch loop when set
+	queue        chan queuedEvent
+	queuePolicy  QueuePolicy
+	queueTimeout time.Duration
+	// shards are the queues of the dispatch workers sharing the watchers
+	shards []chan shardEvent
+	// diffs are the compact results of the pending update events
+	diffs map[*register.Result]*register.Result
+	// hidden are the pending events of the services behind a disabled
+	// feature flag, they are published but not delivered to the watchers
+	hidden map[*register.Result]bool
+	// peaks are the node counts per service version over time, the bucket
+	// size can't change once counts are recorded
+	peaks      map[peakKey][]peak
+	peakBucket time.Duration
+	// revision is incremented on every change to the records
+	revision uint64
+	// started is when the register was created
+	started time.Time
+	// domainTTLs are the default TTLs per domain
+	domainTTLs map[string]time.Duration
+	// maintenance freezes the register since maintenanceSince
+	maintenance      bool
+	maintenanceSince time.Time
+	// indexes are the secondary metadata indexes per domain
+	indexes   map[string]index
+	indexKeys map[string]bool
+	// latency records the event delivery latencies
+	latency latencies
 	sync.RWMutex
 }
 
 // services is a KV map with service name as the key and a map of records as the value
 type services map[string]map[string]*record
 
-// NewRegister returns an initialized in-memory register
+// NewRegister returns an initialized in-memory register, a SeedFile failing
+// to load is logged and the register starts without its services, use New
+// to handle the error
 func NewRegister(opts ...register.Option) register.Register {
-	r := &memory{
-		opts:     register.NewOptions(opts...),
-		records:  make(map[string]services),
-		watchers: make(map[string]*Watcher),
+	r, err := start(opts...)
+	if err != nil {
+		r.logf(logger.ErrorLevel, nil, "Register failed to load the seed: %v", err)
 	}
+	return r
+}
+
+// New returns an initialized in-memory register, construction fails when
+// the SeedFile can't be loaded
+func New(opts ...register.Option) (register.Register, error) {
+	r, err := start(opts...)
+	if err != nil {
+		r.Disconnect(r.opts.Context)
+		return nil, err
+	}
+	return r, nil
+}
+
+// start creates the register and starts its background routines, the
+// register is returned running even when the seed fails to load
+func start(opts ...register.Option) (*memory, error) {
+	r := newMemory(register.NewOptions(opts...))
 
 	go r.ttlPrune()
+	if r.queue != nil {
+		go r.dispatch()
+	}
+	var err error
+	if path := getString(r.opts.Context, seedFileKey{}); len(path) > 0 {
+		err = r.seed(path)
+	}
+	if r.upstream != nil {
+		r.startReplica()
+	}
 
-	return r
+	return r, err
+}
+
+func newMemory(opts register.Options) *memory {
+	m := &memory{
+		opts:       opts,
+		records:    make(map[string]services),
+		watchers:   make(map[string]*Watcher),
+		reset:      make(chan struct{}, 1),
+		exit:       make(chan struct{}),
+		indexes:    make(map[string]index),
+		removed:    make(map[string]map[string][]RemovedNode),
+		peaks:      make(map[peakKey][]peak),
+		peakBucket: peakBucketTime,
+		diffs:      make(map[*register.Result]*register.Result),
+		hidden:     make(map[*register.Result]bool),
+		loads:      make(map[string]*loadCall),
+		upstream:   getReplicaOf(opts.Context),
+	}
+	m.configure()
+	m.started = m.now()
+
+	// the event queue isn't hot-reloadable
+	if size, policy, ok := getQueue(opts.Context); ok && size > 0 {
+		m.queue = make(chan queuedEvent, size)
+		m.queuePolicy = policy
+		m.queueTimeout = m.sendEventTime
+		if workers := getInt(opts.Context, dispatchWorkersKey{}); workers > 1 {
+			m.shards = make([]chan shardEvent, workers)
+			for i := range m.shards {
+				m.shards[i] = make(chan shardEvent, size)
+			}
+		}
+	}
+
+	return m
+}
+
+// Clone returns an independent register with a copy of all the records,
+// the domain TTLs and the removed nodes history. Watchers, the WAL writer,
+// the event sink and hooks and the replica upstream aren't copied, so the
+// clone of a replica is a writable snapshot that no longer follows the
+// upstream
+func (m *memory) Clone() register.Register {
+	m.RLock()
+
+	// the clone doesn't share the WAL, the event outputs or the upstream
+	opts := m.opts
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+	for _, key := range []interface{}{walKey{}, sinkKey{}, hooksKey{}, replicaOfKey{}} {
+		opts.Context = context.WithValue(opts.Context, key, nil)
+	}
+
+	c := newMemory(opts)
+	for domain, srvs := range m.records {
+		c.records[domain] = copyServices(srvs)
+	}
+	if m.domainTTLs != nil {
+		c.domainTTLs = make(map[string]time.Duration, len(m.domainTTLs))
+		for domain, ttl := range m.domainTTLs {
+			c.domainTTLs[domain] = ttl
+		}
+	}
+	for domain, services := range m.removed {
+		c.removed[domain] = make(map[string][]RemovedNode, len(services))
+		for name, history := range services {
+			c.removed[domain][name] = append([]RemovedNode(nil), history...)
+		}
+	}
+	c.revision = m.revision
+	m.RUnlock()
+
+	c.indexRebuild()
+
+	go c.ttlPrune()
+	if c.queue != nil {
+		go c.dispatch()
+	}
+
+	return c
+}
+
+// configure applies the register specific options, it returns true
+// if the prune interval was changed
+func (m *memory) configure() bool {
+	interval := getDuration(m.opts.Context, pruneIntervalKey{}, ttlPruneTime)
+	changed := interval != m.pruneInterval
+
+	m.pruneInterval = interval
+	m.log.Store(logOptions{logger: m.opts.Logger, ctx: m.opts.Context})
+	m.sendEventTime = getDuration(m.opts.Context, eventTimeoutKey{}, sendEventTime)
+	m.maxServices = getInt(m.opts.Context, maxServicesKey{})
+	m.softMaxServices = getInt(m.opts.Context, softMaxServicesKey{})
+	m.maxMetadata = getInt(m.opts.Context, maxMetadataKey{})
+	m.maxSchema = getInt(m.opts.Context, maxSchemaKey{})
+	if m.maxSchema <= 0 {
+		m.maxSchema = maxSchemaSize
+	}
+	m.maxWatchers = getInt(m.opts.Context, maxWatchersKey{})
+	m.domain = getString(m.opts.Context, defaultDomainKey{})
+	m.pooling = getBool(m.opts.Context, nodePoolKey{})
+	m.enabledFlags = make(map[string]bool)
+	for flag, enabled := range getFlags(m.opts.Context) {
+		m.enabledFlags[flag] = enabled
+	}
+	m.allowedDomains = nil
+	if domains, ok := lookupStrings(m.opts.Context, allowedDomainsKey{}); ok {
+		m.allowedDomains = make(map[string]bool, len(domains))
+		for _, domain := range domains {
+			m.allowedDomains[domain] = true
+		}
+	}
+	m.hooks = getHooks(m.opts.Context)
+	m.clock = getClock(m.opts.Context)
+	m.newID = getIDGenerator(m.opts.Context)
+	m.sink = getSink(m.opts.Context)
+	m.wal = getWAL(m.opts.Context)
+	m.sinkRetries = getInt(m.opts.Context, sinkRetriesKey{})
+	m.watchdog = getWatchdog(m.opts.Context)
+	m.normalizeKey = getNormalizer(m.opts.Context)
+	m.wildcardConsistent = getBool(m.opts.Context, consistentWildcardKey{})
+	m.staleThreshold = getFloat(m.opts.Context, staleThresholdKey{})
+	m.removedWindow = getDuration(m.opts.Context, removedHistoryKey{}, 0)
+	m.uniqueNodes = getBool(m.opts.Context, uniqueNodesKey{})
+	m.validateEndpoints = getBool(m.opts.Context, validateEndpointsKey{})
+	m.rejectEmpty = getBool(m.opts.Context, rejectEmptyKey{})
+	m.eventSequence = getBool(m.opts.Context, eventSequenceKey{})
+	m.nodeHash = getBool(m.opts.Context, nodeHashKey{})
+	if !getBool(m.opts.Context, internMetadataKey{}) {
+		m.interned = nil
+	} else if m.interned == nil {
+		m.interned = make(map[string]string)
+	}
+	m.pruneEmpty = getBool(m.opts.Context, pruneEmptyKey{})
+	m.domainEvents = getBool(m.opts.Context, domainEventsKey{})
+	m.loader = getLoader(m.opts.Context)
+	m.validator = getValidator(m.opts.Context)
+	m.readyRefresh = getBool(m.opts.Context, readyRefreshKey{})
+	m.addressStrict, m.addressCheck = lookupBool(m.opts.Context, addressCheckKey{})
+	m.identityKey = getString(m.opts.Context, identityKeyKey{})
+	m.identityRequired = len(m.identityKey) > 0
+	if !m.identityRequired {
+		m.identityKey = DefaultIdentityKey
+	}
+
+	keys := getStrings(m.opts.Context, indexKeysKey{})
+	indexKeys := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		indexKeys[key] = true
+	}
+	if !equalKeys(indexKeys, m.indexKeys) {
+		m.indexKeys = indexKeys
+		m.indexRebuild()
+	}
+
+	return changed
 }
 
 func (m *memory) ttlPrune() {
-	prune := time.NewTicker(ttlPruneTime)
+	m.RLock()
+	prune := time.NewTicker(m.pruneInterval)
+	m.RUnlock()
 	defer prune.Stop()
 
 	for {
 		select {
+		case <-m.exit:
+			return
+		case <-m.reset:
+			m.RLock()
+			prune.Reset(m.pruneInterval)
+			m.RUnlock()
 		case <-prune.C:
 			m.Lock()
-			for domain, services := range m.records {
-				for service, versions := range services {
-					for version, record := range versions {
-						for id, n := range record.Nodes {
-							if n.TTL != 0 && time.Since(n.LastSeen) > n.TTL {
-								if m.opts.Logger.V(logger.DebugLevel) {
-									m.opts.Logger.Debugf(m.opts.Context, "Register TTL expired for node %s of service %s", n.Id, service)
-								}
-								delete(m.records[domain][service][version].Nodes, id)
+			events, expired := m.prune()
+			m.Unlock()
+			for _, fn := range expired {
+				fn()
+			}
+			m.sendEvents(events)
+		}
+	}
+}
+
+// prune removes the expired nodes, and with PruneEmpty the versions, services
+// and domains they leave empty, it returns the delete events, the stale node
+// warnings and the expiry callbacks to call once the lock is released, the
+// caller must hold the lock
+func (m *memory) prune() ([]*register.Result, []func()) {
+	var events []*register.Result
+	var expired []func()
+
+	// nothing expires during the maintenance
+	if m.maintenance {
+		return nil, nil
+	}
+
+	m.pruneRemoved()
+	m.prunePeaks()
+
+	for domain, services := range m.records {
+		var emptied bool
+		for service, versions := range services {
+			for version, record := range versions {
+				if record.Pinned {
+					continue
+				}
+
+				var stale []string
+				var pruned []string
+
+				for id, n := range record.Nodes {
+					if n.Static || (n.TTL == 0 && n.Deadline.IsZero()) {
+						continue
+					}
+
+					now := m.now()
+					age := elapsed(now, n.LastSeen)
+					if nodeExpired(n, now) {
+						m.logf(logger.DebugLevel, serviceFields(domain, service, version, n.Id, "expired"), "Register TTL expired")
+						m.recordRemoved(domain, record, n, "expired")
+						delete(m.records[domain][service][version].Nodes, id)
+						m.touch(record)
+						m.observePeak(domain, record)
+						pruned = append(pruned, id)
+						if fn := n.OnExpire; fn != nil {
+							rn := &register.Node{Id: n.Id, Address: n.Address, Metadata: make(map[string]string, len(n.Metadata))}
+							for k, v := range n.Metadata {
+								rn.Metadata[k] = v
 							}
+							expired = append(expired, func() { fn(rn) })
 						}
+						m.releaseNode(n)
+						continue
+					}
+
+					// warn once when the node gets close to expiry, nodes with a
+					// deadline know when they expire
+					if m.staleThreshold > 0 && n.Deadline.IsZero() && !n.StaleWarned && float64(age) > m.staleThreshold*float64(n.TTL) {
+						n.StaleWarned = true
+						stale = append(stale, id)
 					}
 				}
+
+				// remove the version left without nodes
+				if m.pruneEmpty && len(pruned) > 0 && len(record.Nodes) == 0 {
+					m.walRemove(domain, service, version, nil)
+					m.logf(logger.DebugLevel, serviceFields(domain, service, version, "", "delete"), "Register removed expired service version")
+					m.indexRemove(domain, record)
+					delete(versions, version)
+					events = append(events, &register.Result{Action: "delete", Service: recordToService(record, domain)})
+					continue
+				}
+				if len(pruned) > 0 {
+					m.walRemove(domain, service, version, pruned)
+				}
+
+				if len(stale) > 0 {
+					events = append(events, staleEvent(record, domain, stale))
+				}
+			}
+			if len(versions) == 0 {
+				delete(services, service)
+				emptied = true
+			}
+		}
+		// the empty domains are kept unless PruneEmpty is set
+		if m.pruneEmpty && len(services) == 0 {
+			delete(m.records, domain)
+			if emptied && m.domainEvents {
+				events = append(events, domainEvent("delete", domain))
+			}
+		}
+	}
+
+	return events, expired
+}
+
+// domainEvent returns the event of a domain getting its first service or
+// losing its last one, the service only carries the domain and event metadata
+func domainEvent(action, domain string) *register.Result {
+	return &register.Result{
+		Action:  action,
+		Service: &register.Service{Metadata: map[string]string{"domain": domain, "event": "domain"}},
+	}
+}
+
+// staleEvent returns an update event with the stale nodes marked in metadata
+func staleEvent(r *record, domain string, stale []string) *register.Result {
+	srv := recordToService(r, domain)
+	for _, n := range srv.Nodes {
+		for _, id := range stale {
+			if n.Id == id {
+				n.Metadata["stale"] = "true"
 			}
-			m.Unlock()
 		}
 	}
+	return &register.Result{Action: "update", Service: srv}
 }
 
 func (m *memory) sendEvent(r *register.Result) {
+	m.sendEventAt(r, time.Now())
+}
+
+// sendEventAt sends the event sent at the time to the watchers, the time is
+// used to measure the delivery latency
+func (m *memory) sendEventAt(r *register.Result, sent time.Time) {
+	r, diff := m.publish(r)
+	m.deliver(r, diff, sent, -1)
+}
+
+// publish takes the pending diff of the event, appends the event to the WAL,
+// stamps the sequence number and passes the event to the hooks and the sink,
+// it returns the event and the diff to deliver, none for a hidden event
+func (m *memory) publish(r *register.Result) (*register.Result, *register.Result) {
+	m.Lock()
+	diff := m.diffs[r]
+	delete(m.diffs, r)
+	hidden := m.hidden[r]
+	delete(m.hidden, r)
+	hooks := m.hooks
+	sink, retries := m.sink, m.sinkRetries
+	sequence := m.eventSequence
+	ctx := m.opts.Context
+	m.Unlock()
+
+	if sequence {
+		seq := atomic.AddUint64(&m.sequence, 1)
+		r = withSequence(r, seq)
+		if diff != nil {
+			diff = withSequence(diff, seq)
+		}
+	}
+
+	for _, fn := range hooks {
+		m.callHook(fn, r)
+	}
+
+	if sink != nil {
+		m.callSink(ctx, sink, retries, r)
+	}
+
+	if hidden {
+		return nil, nil
+	}
+	return r, diff
+}
+
+// deliver sends the event to the watchers of the dispatch shard, or to every
+// watcher for a negative shard, a nil event is hidden from the watchers
+func (m *memory) deliver(r, diff *register.Result, sent time.Time, shard int) {
+	if r == nil {
+		return
+	}
+
 	m.RLock()
 	watchers := make([]*Watcher, 0, len(m.watchers))
 	for _, w := range m.watchers {
-		watchers = append(watchers, w)
+		if shard < 0 || m.shardOf(w.id) == shard {
+			watchers = append(watchers, w)
+		}
 	}
+	timeout := m.sendEventTime
+	watchdog := m.watchdog
 	m.RUnlock()
 
 	for _, w := range watchers {
@@ -96,49 +650,264 @@ func (m *memory) sendEvent(r *register.Result) {
 			delete(m.watchers, w.id)
 			m.Unlock()
 		default:
+			// filter at dispatch so the watcher never receives events it would discard
+			if !w.matches(r) {
+				continue
+			}
+			wr := r
+			if w.diff && diff != nil {
+				wr = diff
+			}
+			wr = w.filter(wr)
+			if w.bufferSize > 0 {
+				w.buffer(wr)
+				continue
+			}
 			select {
-			case w.res <- r:
-			case <-time.After(sendEventTime):
+			case w.res <- wr:
+				w.delivered()
+				m.latency.observe(time.Since(sent))
+			case <-time.After(timeout):
+				if watchdog.threshold > 0 && w.dropped(watchdog) {
+					m.stuckWatcher(w, watchdog)
+				}
 			}
 		}
 	}
 }
 
+// stuckWatcher reports the watcher exceeding the watchdog threshold and
+// stops it when configured
+func (m *memory) stuckWatcher(w *Watcher, wd watchdog) {
+	m.logf(logger.WarnLevel, nil, "Register watcher %s dropped more than %d consecutive events within %v", w.id, wd.threshold, wd.window)
+	if !wd.stop {
+		return
+	}
+	w.Stop()
+	m.Lock()
+	delete(m.watchers, w.id)
+	m.Unlock()
+}
+
+// callHook invokes the event hook recovering from panics
+func (m *memory) callHook(fn func(*register.Result), r *register.Result) {
+	defer func() {
+		if err := recover(); err != nil {
+			m.logf(logger.ErrorLevel, nil, "Register event hook panic: %v", err)
+		}
+	}()
+
+	fn(r)
+}
+
+// callSink publishes the event to the sink, failed attempts are retried
+// up to retries times and logged
+func (m *memory) callSink(ctx context.Context, sink func(context.Context, *register.Result) error, retries int, r *register.Result) {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if err = sink(ctx, r); err == nil {
+			return
+		}
+	}
+	m.logf(logger.ErrorLevel, resultFields(r), "Register event sink failed after %d attempts: %v", retries+1, err)
+}
+
+// sendEvents dispatches the events to the watchers in the background,
+// through the event queue when configured
+func (m *memory) sendEvents(events []*register.Result) {
+	if len(events) == 0 {
+		return
+	}
+
+	// services behind a disabled feature flag are hidden from the watchers,
+	// checked before the caller gets the services back
+	m.Lock()
+	for _, r := range events {
+		if r.Service != nil && !m.flagEnabled(r.Service.Metadata) {
+			m.hidden[r] = true
+		}
+	}
+	m.Unlock()
+
+	if m.pause(events) {
+		return
+	}
+
+	if m.queue == nil {
+		m.Lock()
+		ordered := m.sink != nil || len(m.hooks) > 0
+		if ordered {
+			m.post(events)
+		}
+		m.Unlock()
+		if ordered {
+			return
+		}
+	}
+
+	for _, r := range events {
+		if m.queue != nil {
+			m.enqueue(r)
+			continue
+		}
+		go m.sendEvent(r)
+	}
+}
+
+// post appends the events to the outbox and starts draining it, the sink
+// and the hooks then see the events one at a time in order. The caller
+// must hold the lock.
+func (m *memory) post(events []*register.Result) {
+	now := time.Now()
+	for _, r := range events {
+		m.outbox = append(m.outbox, queuedEvent{result: r, sent: now})
+	}
+	if !m.draining {
+		m.draining = true
+		go m.drain()
+	}
+}
+
+// drain publishes the outbox events in order until it is empty, the
+// watchers still receive them in the background
+func (m *memory) drain() {
+	for {
+		m.Lock()
+		events := m.outbox
+		m.outbox = nil
+		if len(events) == 0 {
+			m.draining = false
+			m.Unlock()
+			return
+		}
+		m.Unlock()
+
+		for _, e := range events {
+			r, diff := m.publish(e.result)
+			go m.deliver(r, diff, e.sent, -1)
+		}
+	}
+}
+
 func (m *memory) Connect(ctx context.Context) error {
 	return nil
 }
 
+// Disconnect stops the pruner and all the watchers, the register
+// can't be used after it was disconnected
 func (m *memory) Disconnect(ctx context.Context) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	close(m.exit)
+
+	for id, w := range m.watchers {
+		w.Stop()
+		delete(m.watchers, id)
+	}
+
 	return nil
 }
 
+func (m *memory) isClosed() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.closed
+}
+
+// Init applies the options to the running register. Every register option
+// is reapplied and takes effect on the next operation: a new prune interval
+// resets the pruner ticker and changed index keys rebuild the indexes. The
+// EventQueue, DispatchWorkers, ReplicaOf and SeedFile options are only read
+// on creation, the queue keeps the event timeout it was created with.
 func (m *memory) Init(opts ...register.Option) error {
+	m.Lock()
 	for _, o := range opts {
 		o(&m.opts)
 	}
+	changed := m.configure()
+	m.Unlock()
 
-	// add services
-	m.Lock()
-	defer m.Unlock()
+	if changed {
+		select {
+		case m.reset <- struct{}{}:
+		default:
+		}
+	}
 
 	return nil
 }
 
 func (m *memory) Options() register.Options {
+	m.RLock()
+	defer m.RUnlock()
 	return m.opts
 }
 
 func (m *memory) Register(ctx context.Context, s *register.Service, opts ...register.RegisterOption) error {
+	if m.upstream != nil {
+		return ErrReadOnly
+	}
+
 	m.Lock()
-	defer m.Unlock()
+	events, err := m.register(s, register.NewRegisterOptions(opts...))
+	m.Unlock()
+	if err != nil {
+		return err
+	}
+
+	m.sendEvents(events)
+	return nil
+}
+
+// register adds the service and returns the events to send, the caller must hold the lock
+func (m *memory) register(s *register.Service, options register.RegisterOptions) ([]*register.Result, error) {
+	// events mirrored from the upstream already passed its write checks
+	mirrored := getBool(options.Context, mirrorKey{})
+
+	if err := m.writable(mirrored); err != nil {
+		return nil, err
+	}
 
-	options := register.NewRegisterOptions(opts...)
+	if options.Domain == register.DefaultDomain && len(m.domain) > 0 {
+		options.Domain = m.domain
+	}
+
+	if !mirrored && !m.domainAllowed(options.Domain) {
+		return nil, ErrDomainNotAllowed
+	}
+
+	// the nodes registered without a TTL get the default TTL of the domain
+	if options.TTL == 0 {
+		options.TTL = m.domainTTLs[options.Domain]
+	}
+
+	if !mirrored && m.rejectEmpty && len(s.Nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	// check the metadata size before the domain is added
+	if !mirrored && m.maxMetadata > 0 && metadataSize(s) > m.maxMetadata {
+		return nil, ErrLimitExceeded
+	}
 
 	// get the services for this domain from the register
 	srvs, ok := m.records[options.Domain]
 	if !ok {
 		srvs = make(services)
 	}
+	newDomain := len(srvs) == 0
+
+	if m.normalizeKey != nil {
+		s.Metadata = normalizeMetadata(s.Metadata, m.normalizeKey)
+		for _, n := range s.Nodes {
+			n.Metadata = normalizeMetadata(n.Metadata, m.normalizeKey)
+		}
+	}
 
 	// domain is set in metadata so it can be passed to watchers
 	if s.Metadata == nil {
@@ -147,22 +916,133 @@ func (m *memory) Register(ctx context.Context, s *register.Service, opts ...regi
 		s.Metadata["domain"] = options.Domain
 	}
 
+	// validate the tier and the node protocols before making any changes
+	tier, err := serviceTier(s.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	if len(tier) > 0 {
+		s.Metadata["tier"] = tier
+	}
+	if !mirrored && m.validateEndpoints {
+		if err := validateEndpoints(s); err != nil {
+			return nil, err
+		}
+	}
+	for _, n := range s.Nodes {
+		if _, err := nodeProtocol(n.Metadata); err != nil {
+			return nil, err
+		}
+		if !mirrored && m.identityRequired && len(n.Metadata[m.identityKey]) == 0 {
+			return nil, ErrMissingIdentity
+		}
+	}
+
+	// a registration changing nothing only refreshes the nodes and sends no event
+	if r, ok := srvs[s.Name][s.Version]; ok && recordEqual(r, s, options.Domain) {
+		flagged := !r.Pinned && getBool(options.Context, pinnedKey{})
+		if flagged {
+			r.Pinned = true
+		}
+		if m.refresh(r, s, options) || flagged {
+			m.walRegister(options.Domain, r, nodeIDs(r))
+		}
+		return nil, nil
+	}
+
+	// let the validator enforce the constraints across the registered versions
+	if !mirrored && m.validator != nil {
+		existing := make([]*register.Service, 0, len(srvs[s.Name]))
+		for _, r := range srvs[s.Name] {
+			existing = append(existing, recordToService(r, options.Domain))
+		}
+		if err := m.validator(s, existing); err != nil {
+			return nil, err
+		}
+	}
+
+	// reject nodes already registered under another version
+	if !mirrored && m.uniqueNodes {
+		for _, n := range s.Nodes {
+			for version, r := range srvs[s.Name] {
+				if _, ok := r.Nodes[n.Id]; ok && version != s.Version {
+					return nil, fmt.Errorf("%w: node %s of service %s is registered under version %s", ErrNodeConflict, n.Id, s.Name, version)
+				}
+			}
+		}
+	}
+
+	// detect nodes reusing the address of another node of the same version
+	if !mirrored && m.addressCheck {
+		if addr, ok := duplicateAddress(srvs[s.Name][s.Version], s.Nodes); ok {
+			if m.addressStrict {
+				return nil, ErrDuplicateAddress
+			}
+			m.logf(logger.WarnLevel, serviceFields(options.Domain, s.Name, s.Version, "", "register"), "Register duplicate address %s", addr)
+		}
+	}
+
+	// a singleton version holds at most one node
+	singleton := !mirrored && getBool(options.Context, singletonKey{})
+	replace := getBool(options.Context, singletonReplaceKey{})
+	if singleton {
+		if len(s.Nodes) > 1 {
+			return nil, ErrSingleton
+		}
+		if r, ok := srvs[s.Name][s.Version]; ok && len(s.Nodes) == 1 {
+			for id, n := range r.Nodes {
+				if id == s.Nodes[0].Id {
+					continue
+				}
+				// pinned versions and static nodes are never evicted
+				if replace && r.Pinned {
+					return nil, ErrPinned
+				}
+				if !replace || n.Static {
+					return nil, ErrSingleton
+				}
+			}
+		}
+	}
+
+	// check the services limit before adding a new version
+	if _, ok := srvs[s.Name][s.Version]; !ok && !mirrored && m.maxServices > 0 && m.countServices() >= m.maxServices {
+		return nil, ErrLimitExceeded
+	}
+
 	// ensure the service name exists
-	r := serviceToRecord(s, options.TTL)
 	if _, ok := srvs[s.Name]; !ok {
 		srvs[s.Name] = make(map[string]*record)
 	}
 
+	var events []*register.Result
+	var created bool
+
 	if _, ok := srvs[s.Name][s.Version]; !ok {
-		srvs[s.Name][s.Version] = r
-		if m.opts.Logger.V(logger.DebugLevel) {
-			m.opts.Logger.Debugf(m.opts.Context, "Register added new service: %s, version: %s", s.Name, s.Version)
-		}
+		srvs[s.Name][s.Version] = serviceToRecord(s)
+		srvs[s.Name][s.Version].Metadata = m.internMetadata(srvs[s.Name][s.Version].Metadata)
+		m.indexAdd(options.Domain, srvs[s.Name][s.Version])
+		m.touch(srvs[s.Name][s.Version])
+		m.logf(logger.DebugLevel, serviceFields(options.Domain, s.Name, s.Version, "", "create"), "Register added new service")
 		m.records[options.Domain] = srvs
-		go m.sendEvent(&register.Result{Action: "create", Service: s})
+		events = append(events, &register.Result{Action: "create", Service: s})
+		created = true
+
+		if m.softMaxServices > 0 && m.countServices() == m.softMaxServices+1 {
+			m.logf(logger.WarnLevel, serviceFields(options.Domain, s.Name, s.Version, "", "create"), "Register services exceed the soft limit of %d", m.softMaxServices)
+		}
+	}
+
+	// once pinned the record stays pinned
+	flagged := !srvs[s.Name][s.Version].Pinned && getBool(options.Context, pinnedKey{})
+	if flagged {
+		srvs[s.Name][s.Version].Pinned = true
 	}
 
 	var addedNodes bool
+	var added []string
+	static := getBool(options.Context, staticKey{})
+	onExpire := getOnExpire(options.Context)
 
 	for _, n := range s.Nodes {
 		// check if already exists
@@ -170,55 +1050,362 @@ func (m *memory) Register(ctx context.Context, s *register.Service, opts ...regi
 			continue
 		}
 
-		metadata := make(map[string]string)
+		// evict the node of the singleton version
+		if singleton && replace {
+			events = append(events, m.evict(options.Domain, srvs[s.Name][s.Version], s)...)
+		}
+
+		nn := m.newNode()
+		metadata := nn.Metadata
 
 		// make copy of metadata
 		for k, v := range n.Metadata {
-			metadata[k] = v
+			metadata[m.intern(k)] = m.intern(v)
 		}
 
 		// set the domain
-		metadata["domain"] = options.Domain
+		metadata["domain"] = m.intern(options.Domain)
+
+		// store the normalized protocol
+		if protocol, _ := nodeProtocol(n.Metadata); len(protocol) > 0 {
+			metadata["protocol"] = m.intern(protocol)
+		}
 
 		// add the node
-		srvs[s.Name][s.Version].Nodes[n.Id] = &node{
-			Node: &register.Node{
-				Id:       n.Id,
-				Address:  n.Address,
-				Metadata: metadata,
-			},
-			TTL:      options.TTL,
-			LastSeen: time.Now(),
+		nn.Id = n.Id
+		nn.Address = n.Address
+		nn.TTL = options.TTL
+		nn.Deadline = getExpireAt(options.Context)
+		nn.LastSeen = m.now()
+		nn.Static = static
+		nn.OnExpire = onExpire
+		if m.nodeHash {
+			nn.Hash = nodeHash(n.Id)
 		}
+		srvs[s.Name][s.Version].Nodes[n.Id] = nn
 
 		addedNodes = true
+		added = append(added, n.Id)
 	}
 
 	if addedNodes {
-		if m.opts.Logger.V(logger.DebugLevel) {
-			m.opts.Logger.Debugf(m.opts.Context, "Register added new node to service: %s, version: %s", s.Name, s.Version)
-		}
-		go m.sendEvent(&register.Result{Action: "update", Service: s})
-	} else {
-		// refresh TTL and timestamp
-		for _, n := range s.Nodes {
-			if m.opts.Logger.V(logger.DebugLevel) {
-				m.opts.Logger.Debugf(m.opts.Context, "Updated registration for service: %s, version: %s", s.Name, s.Version)
-			}
-			srvs[s.Name][s.Version].Nodes[n.Id].TTL = options.TTL
-			srvs[s.Name][s.Version].Nodes[n.Id].LastSeen = time.Now()
-		}
+		m.touch(srvs[s.Name][s.Version])
+		m.observePeak(options.Domain, srvs[s.Name][s.Version])
+	}
+
+	if addedNodes && !created {
+		m.logf(logger.DebugLevel, serviceFields(options.Domain, s.Name, s.Version, strings.Join(added, ","), "update"), "Register added new node to service")
+		r := &register.Result{Action: "update", Service: s}
+		m.diffs[r] = diffResult(s, options.Domain, added, nil)
+		events = append(events, r)
+	} else if !addedNodes && m.refresh(srvs[s.Name][s.Version], s, options) {
+		flagged = true
 	}
 
+	if created || addedNodes {
+		m.walRegister(options.Domain, srvs[s.Name][s.Version], added)
+	} else if flagged {
+		// the state of the version or of its registered nodes changed
+		m.walRegister(options.Domain, srvs[s.Name][s.Version], nodeIDs(srvs[s.Name][s.Version]))
+	}
+
+	if newDomain && m.domainEvents {
+		events = append([]*register.Result{domainEvent("create", options.Domain)}, events...)
+	}
 	m.records[options.Domain] = srvs
-	return nil
+	return events, nil
+}
+
+// refresh renews the TTL and timestamp of the registered nodes of the service,
+// it reports whether the logged state of a node changed. The caller must hold
+// the lock.
+func (m *memory) refresh(r *record, s *register.Service, options register.RegisterOptions) bool {
+	static := getBool(options.Context, staticKey{})
+	onExpire := getOnExpire(options.Context)
+	var changed bool
+
+	for _, n := range s.Nodes {
+		rn, ok := r.Nodes[n.Id]
+		if !ok {
+			continue
+		}
+		m.logf(logger.DebugLevel, serviceFields(options.Domain, s.Name, s.Version, n.Id, "refresh"), "Updated registration for service")
+		rn.TTL = options.TTL
+		rn.Deadline = getExpireAt(options.Context)
+		if static && !rn.Static {
+			rn.Static = true
+			changed = true
+		}
+		if onExpire != nil {
+			rn.OnExpire = onExpire
+		}
+		if m.nodeHash && len(rn.Hash) == 0 {
+			rn.Hash = nodeHash(rn.Id)
+		}
+		// nodes heartbeating as not ready are left to expire
+		if m.readyRefresh && !nodeReady(n.Metadata) {
+			continue
+		}
+		rn.LastSeen = m.now()
+		rn.StaleWarned = false
+		if nodeReady(n.Metadata) && len(rn.LastError) > 0 {
+			rn.LastError = ""
+			rn.LastErrorAt = time.Time{}
+			changed = true
+		}
+	}
+	return changed
+}
+
+// evict removes the nodes of the singleton version replaced by the
+// registration, it returns a delete event per evicted node. The caller must
+// hold the lock.
+func (m *memory) evict(domain string, r *record, s *register.Service) []*register.Result {
+	var events []*register.Result
+	for id, n := range r.Nodes {
+		m.logf(logger.DebugLevel, serviceFields(domain, s.Name, s.Version, id, "evict"), "Register evicted singleton node")
+		m.recordRemoved(domain, r, n, "evicted")
+		delete(r.Nodes, id)
+		events = append(events, &register.Result{
+			Action: "delete",
+			Service: &register.Service{
+				Name:     s.Name,
+				Version:  s.Version,
+				Metadata: flagMetadata(r, domain),
+				Nodes:    []*register.Node{{Id: n.Id, Address: n.Address}},
+			},
+		})
+		m.walRemove(domain, s.Name, s.Version, []string{id})
+		m.releaseNode(n)
+	}
+	return events
 }
 
 func (m *memory) Deregister(ctx context.Context, s *register.Service, opts ...register.DeregisterOption) error {
+	if m.upstream != nil {
+		return ErrReadOnly
+	}
+
 	m.Lock()
-	defer m.Unlock()
+	events, err := m.deregister(s, register.NewDeregisterOptions(opts...))
+	m.Unlock()
+	if err != nil {
+		return err
+	}
+
+	m.sendEvents(events)
+	return nil
+}
+
+// DeregisterBatch removes the services under a single lock, the events are
+// coalesced to one per service version. The services missing from the domain
+// are skipped, with DeregisterStrict they fail the batch with
+// register.ErrNotFound. Nothing is removed when the batch fails.
+func (m *memory) DeregisterBatch(ctx context.Context, services []*register.Service, opts ...register.DeregisterOption) error {
+	if m.upstream != nil {
+		return ErrReadOnly
+	}
 
 	options := register.NewDeregisterOptions(opts...)
+	strict := getBool(options.Context, deregisterStrictKey{})
+
+	m.Lock()
+	if err := m.mutable(); err != nil {
+		m.Unlock()
+		return err
+	}
+
+	domain := options.Domain
+	if domain == register.DefaultDomain && len(m.domain) > 0 {
+		domain = m.domain
+	}
+	if !m.domainAllowed(domain) {
+		m.Unlock()
+		return ErrDomainNotAllowed
+	}
+
+	// check the whole batch before making any changes
+	for _, s := range services {
+		r, ok := m.records[domain][s.Name][s.Version]
+		if !ok && strict {
+			m.Unlock()
+			return fmt.Errorf("%w: service %s version %s", register.ErrNotFound, s.Name, s.Version)
+		}
+		if ok && r.Pinned {
+			m.Unlock()
+			return ErrPinned
+		}
+	}
+
+	var events []*register.Result
+	for _, s := range services {
+		evts, err := m.deregister(s, options)
+		if err != nil {
+			m.Unlock()
+			return err
+		}
+		events = append(events, evts...)
+	}
+	events = m.coalesce(events)
+	m.Unlock()
+
+	m.sendEvents(events)
+	return nil
+}
+
+// DeregisterService removes all the versions of the service from the domain,
+// or from every domain for the wildcard domain, a single delete event without
+// a version is sent per domain
+func (m *memory) DeregisterService(ctx context.Context, domain, name string) error {
+	if m.upstream != nil {
+		return ErrReadOnly
+	}
+
+	m.Lock()
+	if err := m.mutable(); err != nil {
+		m.Unlock()
+		return err
+	}
+
+	if domain == register.DefaultDomain && len(m.domain) > 0 {
+		domain = m.domain
+	}
+
+	var domains []string
+	if domain == register.WildcardDomain {
+		for d, srvs := range m.records {
+			if _, ok := srvs[name]; ok {
+				domains = append(domains, d)
+			}
+		}
+	} else if !m.domainAllowed(domain) {
+		m.Unlock()
+		return ErrDomainNotAllowed
+	} else if _, ok := m.records[domain][name]; ok {
+		domains = append(domains, domain)
+	}
+
+	if len(domains) == 0 {
+		m.Unlock()
+		return register.ErrNotFound
+	}
+
+	// pinned versions can't be removed so nothing is removed
+	for _, d := range domains {
+		for _, r := range m.records[d][name] {
+			if r.Pinned {
+				m.Unlock()
+				return ErrPinned
+			}
+		}
+	}
+
+	events := make([]*register.Result, 0, len(domains))
+	for _, d := range domains {
+		for _, r := range m.records[d][name] {
+			for _, n := range r.Nodes {
+				m.recordRemoved(d, r, n, "deregister")
+				m.releaseNode(n)
+			}
+			m.indexRemove(d, r)
+			m.touch(r)
+		}
+		delete(m.records[d], name)
+		m.walRemove(d, name, "", nil)
+
+		m.logf(logger.DebugLevel, serviceFields(d, name, "", "", "delete"), "Register removed service")
+		events = append(events, &register.Result{
+			Action:  "delete",
+			Service: &register.Service{Name: name, Metadata: map[string]string{"domain": d}},
+		})
+		if len(m.records[d]) == 0 && m.domainEvents {
+			events = append(events, domainEvent("delete", d))
+		}
+	}
+	m.Unlock()
+
+	m.sendEvents(events)
+	return nil
+}
+
+// CompareAndDeregister removes the node only if its current address is the
+// expected one, it reports whether the node was removed
+func (m *memory) CompareAndDeregister(ctx context.Context, domain, service, version, nodeID, expectedAddress string) (bool, error) {
+	if m.upstream != nil {
+		return false, ErrReadOnly
+	}
+
+	m.Lock()
+	if err := m.mutable(); err != nil {
+		m.Unlock()
+		return false, err
+	}
+
+	if domain == register.DefaultDomain && len(m.domain) > 0 {
+		domain = m.domain
+	}
+
+	r, n, err := m.getNode(domain, service, version, nodeID)
+	if err != nil {
+		m.Unlock()
+		return false, err
+	}
+
+	// the node was replaced since it was read
+	if n.Address != expectedAddress {
+		m.Unlock()
+		return false, nil
+	}
+
+	srv := recordToService(r, domain)
+	for _, sn := range srv.Nodes {
+		if sn.Id == nodeID {
+			srv.Nodes = []*register.Node{sn}
+			break
+		}
+	}
+
+	events, err := m.deregister(srv, register.NewDeregisterOptions(register.DeregisterDomain(domain)))
+	m.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	m.sendEvents(events)
+	return true, nil
+}
+
+// flagEnabled reports whether the service with the metadata is visible to
+// lookups, services behind a feature flag are hidden unless the flag is
+// enabled, the caller must hold the lock
+func (m *memory) flagEnabled(md map[string]string) bool {
+	flag, ok := md["flag"]
+	return !ok || m.enabledFlags[flag]
+}
+
+// domainAllowed reports whether the domain can be registered into, the caller must hold the lock
+func (m *memory) domainAllowed(domain string) bool {
+	if m.allowedDomains == nil {
+		return true
+	}
+	return domain != register.WildcardDomain && m.allowedDomains[domain]
+}
+
+// deregister removes the service and returns the events to send, the caller must hold the lock
+func (m *memory) deregister(s *register.Service, options register.DeregisterOptions) ([]*register.Result, error) {
+	mirrored := getBool(options.Context, mirrorKey{})
+
+	if err := m.writable(mirrored); err != nil {
+		return nil, err
+	}
+
+	if options.Domain == register.DefaultDomain && len(m.domain) > 0 {
+		options.Domain = m.domain
+	}
+
+	if !mirrored && !m.domainAllowed(options.Domain) {
+		return nil, ErrDomainNotAllowed
+	}
 
 	// domain is set in metadata so it can be passed to watchers
 	if s.Metadata == nil {
@@ -230,177 +1417,1552 @@ func (m *memory) Deregister(ctx context.Context, s *register.Service, opts ...re
 	// if the domain doesn't exist, there is nothing to deregister
 	services, ok := m.records[options.Domain]
 	if !ok {
-		return nil
+		return nil, nil
 	}
 
 	// if no services with this name and version exist, there is nothing to deregister
 	versions, ok := services[s.Name]
 	if !ok {
-		return nil
+		return nil, nil
 	}
 
 	version, ok := versions[s.Version]
 	if !ok {
-		return nil
+		return nil, nil
+	}
+
+	if version.Pinned && !mirrored {
+		return nil, ErrPinned
+	}
+
+	// the events carry the flag so watchers see them like the service
+	if flag, ok := version.Metadata["flag"]; ok {
+		s.Metadata["flag"] = flag
 	}
 
+	var removed []string
+
 	// deregister all of the service nodes from this version
 	for _, n := range s.Nodes {
-		if _, ok := version.Nodes[n.Id]; ok {
-			if m.opts.Logger.V(logger.DebugLevel) {
-				m.opts.Logger.Debugf(m.opts.Context, "Register removed node from service: %s, version: %s", s.Name, s.Version)
-			}
+		if rn, ok := version.Nodes[n.Id]; ok {
+			removed = append(removed, n.Id)
+			m.logf(logger.DebugLevel, serviceFields(options.Domain, s.Name, s.Version, n.Id, "deregister"), "Register removed node from service")
+			m.recordRemoved(options.Domain, version, rn, "deregister")
 			delete(version.Nodes, n.Id)
+			m.releaseNode(rn)
+			m.touch(version)
+			m.observePeak(options.Domain, version)
 		}
 	}
 
 	// if the nodes not empty, we replace the version in the store and exist, the rest of the logic
 	// is cleanup
 	if len(version.Nodes) > 0 {
+		if len(removed) > 0 {
+			m.walRemove(options.Domain, s.Name, s.Version, removed)
+		}
 		m.records[options.Domain][s.Name][s.Version] = version
-		go m.sendEvent(&register.Result{Action: "update", Service: s})
-		return nil
+		r := &register.Result{Action: "update", Service: s}
+		m.diffs[r] = diffResult(s, options.Domain, nil, removed)
+		return []*register.Result{r}, nil
 	}
 
+	m.walRemove(options.Domain, s.Name, s.Version, nil)
+
 	// if this version was the only version of the service, we can remove the whole service from the
 	// register and exit
 	if len(versions) == 1 {
+		m.indexRemove(options.Domain, version)
 		delete(m.records[options.Domain], s.Name)
-		go m.sendEvent(&register.Result{Action: "delete", Service: s})
 
-		if m.opts.Logger.V(logger.DebugLevel) {
-			m.opts.Logger.Debugf(m.opts.Context, "Register removed service: %s", s.Name)
+		m.logf(logger.DebugLevel, serviceFields(options.Domain, s.Name, s.Version, "", "delete"), "Register removed service")
+		events := []*register.Result{{Action: "delete", Service: s}}
+		if len(m.records[options.Domain]) == 0 && m.domainEvents {
+			events = append(events, domainEvent("delete", options.Domain))
 		}
-		return nil
+		return events, nil
 	}
 
 	// there are other versions of the service running, so only remove this version of it
+	m.indexRemove(options.Domain, version)
 	delete(m.records[options.Domain][s.Name], s.Version)
-	go m.sendEvent(&register.Result{Action: "delete", Service: s})
-	if m.opts.Logger.V(logger.DebugLevel) {
-		m.opts.Logger.Debugf(m.opts.Context, "Register removed service: %s, version: %s", s.Name, s.Version)
-	}
+	m.logf(logger.DebugLevel, serviceFields(options.Domain, s.Name, s.Version, "", "delete"), "Register removed service version")
 
-	return nil
+	return []*register.Result{{Action: "delete", Service: s}}, nil
 }
 
 func (m *memory) LookupService(ctx context.Context, name string, opts ...register.LookupOption) ([]*register.Service, error) {
+	if m.isClosed() {
+		return nil, ErrClosed
+	}
+
 	options := register.NewLookupOptions(opts...)
+	options.Domain = m.defaultDomain(options.Domain)
 
 	// if it's a wildcard domain, return from all domains
 	if options.Domain == register.WildcardDomain {
-		m.RLock()
-		recs := m.records
-		m.RUnlock()
-
 		var services []*register.Service
 
-		for domain := range recs {
-			srvs, err := m.LookupService(ctx, name, append(opts, register.LookupDomain(domain))...)
-			if err == register.ErrNotFound {
-				continue
-			} else if err != nil {
-				return nil, err
+		if m.consistentWildcard() {
+			m.RLock()
+			for domain := range m.records {
+				services = append(services, m.lookup(name, domain, options)...)
+			}
+			m.RUnlock()
+		} else {
+			// the domains are read one at a time and never use the loader
+			for _, domain := range m.domains() {
+				m.RLock()
+				services = append(services, m.lookup(name, domain, options)...)
+				m.RUnlock()
 			}
-			services = append(services, srvs...)
 		}
 
 		if len(services) == 0 {
 			return nil, register.ErrNotFound
 		}
+		merge := getBool(options.Context, mergeDomainsKey{})
+		if getBool(options.Context, flattenKey{}) {
+			return flattenNames(services, merge), nil
+		}
+		if merge {
+			return mergeDomains(services), nil
+		}
 		return services, nil
 	}
 
+	pattern := getString(options.Context, namePatternKey{})
+
 	m.RLock()
-	defer m.RUnlock()
+	result := m.lookup(name, options.Domain, options)
+	loader := m.loader
+	// nothing is stored during the maintenance so the loader is skipped
+	missing := len(pattern) == 0 && len(m.records[options.Domain][name]) == 0 && !m.maintenance
+	m.RUnlock()
 
-	// check the domain exists
-	services, ok := m.records[options.Domain]
-	if !ok {
-		return nil, register.ErrNotFound
+	// populate the missing service from the loader and look it up again
+	if missing && loader != nil {
+		if err := m.load(ctx, options.Domain, name, loader); err != nil {
+			return nil, err
+		}
+		m.RLock()
+		result = m.lookupService(name, options.Domain, options)
+		m.RUnlock()
 	}
 
-	// check the service exists
-	versions, ok := services[name]
-	if !ok || len(versions) == 0 {
+	if len(result) == 0 {
 		return nil, register.ErrNotFound
 	}
 
-	// serialize the response
-	result := make([]*register.Service, len(versions))
+	if getBool(options.Context, flattenKey{}) {
+		return flattenNames(result, false), nil
+	}
+
+	return result, nil
+}
+
+// lookup returns the versions of the service in the domain, or of all the
+// services matching the NamePattern sorted by name, the caller must hold the lock
+func (m *memory) lookup(name, domain string, options register.LookupOptions) []*register.Service {
+	pattern := getString(options.Context, namePatternKey{})
+	if len(pattern) == 0 {
+		return m.lookupService(name, domain, options)
+	}
+
+	var names []string
+	for name := range m.records[domain] {
+		if globMatch(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
 
-	var i int
+	var result []*register.Service
+	for _, name := range names {
+		result = append(result, m.lookupService(name, domain, options)...)
+	}
+	return result
+}
+
+// lookupService returns the versions of the service in the domain, the caller must hold the lock
+func (m *memory) lookupService(name, domain string, options register.LookupOptions) []*register.Service {
+	versions := m.records[domain][name]
+	if len(versions) == 0 {
+		return nil
+	}
+
+	protocol := getString(options.Context, protocolKey{})
+	endpointMetadata := getEndpointMetadata(options.Context)
+	healthy := getBool(options.Context, onlyHealthyKey{})
+	zone := getString(options.Context, preferZoneKey{})
+	hashKey := getString(options.Context, consistentHashKey{})
+	activeOnly := getBool(options.Context, activeOnlyKey{})
+	minTier := getString(options.Context, minTierKey{})
+	now := m.now()
+
+	// serialize the response
+	result := make([]*register.Service, 0, len(versions))
 
 	for _, r := range versions {
-		result[i] = recordToService(r, options.Domain)
-		i++
+		if len(protocol) > 0 && !r.hasProtocol(protocol) {
+			continue
+		}
+		if len(minTier) > 0 && !atLeastTier(r.Metadata, minTier) {
+			continue
+		}
+		if !m.flagEnabled(r.Metadata) {
+			continue
+		}
+		srv := recordToService(r, domain)
+		if len(endpointMetadata) > 0 && !filterEndpoints(srv, endpointMetadata) {
+			continue
+		}
+		if healthy && !filterHealthy(srv) {
+			continue
+		}
+		if activeOnly && !filterAvailable(srv, now) {
+			continue
+		}
+		if len(hashKey) > 0 {
+			hashNodes(srv, hashKey)
+		}
+		if len(zone) > 0 {
+			preferZone(srv, zone)
+		}
+		result = append(result, srv)
 	}
 
-	return result, nil
+	if getBool(options.Context, primaryOnlyKey{}) {
+		result = primaryVersions(result)
+	}
+
+	return result
 }
 
-func (m *memory) ListServices(ctx context.Context, opts ...register.ListOption) ([]*register.Service, error) {
-	options := register.NewListOptions(opts...)
+// consistentWildcard reports whether wildcard reads hold the lock across all domains
+func (m *memory) consistentWildcard() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.wildcardConsistent
+}
 
-	// if it's a wildcard domain, list from all domains
-	if options.Domain == register.WildcardDomain {
-		m.RLock()
-		recs := m.records
-		m.RUnlock()
+// LookupByEndpoint returns all services exposing an endpoint with the given name
+func (m *memory) LookupByEndpoint(ctx context.Context, endpointName string, opts ...register.LookupOption) ([]*register.Service, error) {
+	if m.isClosed() {
+		return nil, ErrClosed
+	}
 
+	options := register.NewLookupOptions(opts...)
+	options.Domain = m.defaultDomain(options.Domain)
+
+	// if it's a wildcard domain, return from all domains
+	if options.Domain == register.WildcardDomain {
 		var services []*register.Service
 
-		for domain := range recs {
-			srvs, err := m.ListServices(ctx, append(opts, register.ListDomain(domain))...)
-			if err != nil {
+		for _, domain := range m.domains() {
+			srvs, err := m.LookupByEndpoint(ctx, endpointName, append(opts, register.LookupDomain(domain))...)
+			if err == register.ErrNotFound {
+				continue
+			} else if err != nil {
 				return nil, err
 			}
 			services = append(services, srvs...)
 		}
 
+		if len(services) == 0 {
+			return nil, register.ErrNotFound
+		}
 		return services, nil
 	}
 
 	m.RLock()
 	defer m.RUnlock()
 
-	// ensure the domain exists
+	// check the domain exists
 	services, ok := m.records[options.Domain]
 	if !ok {
-		return make([]*register.Service, 0), nil
+		return nil, register.ErrNotFound
 	}
 
-	// serialize the result, each version counts as an individual service
 	var result []*register.Service
 
-	for domain, service := range services {
-		for _, version := range service {
-			result = append(result, recordToService(version, domain))
+	for _, versions := range services {
+		for _, r := range versions {
+			if !m.flagEnabled(r.Metadata) {
+				continue
+			}
+			for _, e := range r.Endpoints {
+				if e.Name == endpointName {
+					result = append(result, recordToService(r, options.Domain))
+					break
+				}
+			}
 		}
 	}
 
+	if len(result) == 0 {
+		return nil, register.ErrNotFound
+	}
+
 	return result, nil
 }
 
-func (m *memory) Watch(ctx context.Context, opts ...register.WatchOption) (register.Watcher, error) {
-	wo := register.NewWatchOptions(opts...)
+// touch records a change to the record, the caller must hold the lock
+func (m *memory) touch(r *record) {
+	m.revision++
+	r.Revision = m.revision
+}
 
-	// construct the watcher
-	w := &Watcher{
-		exit: make(chan bool),
-		res:  make(chan *register.Result),
-		id:   uuid.New().String(),
-		wo:   wo,
+// Revision returns the current register revision, it can be passed to
+// ResumeFrom to only replay the services changed since
+func (m *memory) Revision() uint64 {
+	m.RLock()
+	defer m.RUnlock()
+	return m.revision
+}
+
+// SetDomainTTL sets the TTL of the nodes registered in the domain without a
+// TTL, a zero TTL removes the default, the registered nodes keep their TTL
+func (m *memory) SetDomainTTL(domain string, ttl time.Duration) error {
+	if m.upstream != nil {
+		return ErrReadOnly
 	}
 
 	m.Lock()
-	m.watchers[w.id] = w
-	m.Unlock()
+	defer m.Unlock()
 
-	return w, nil
+	if err := m.mutable(); err != nil {
+		return err
+	}
+
+	if domain == register.DefaultDomain && len(m.domain) > 0 {
+		domain = m.domain
+	}
+
+	m.setDomainTTL(domain, ttl)
+	m.walDomainTTL(domain, ttl)
+	return nil
 }
 
-func (m *memory) Name() string {
+// setDomainTTL sets or removes the TTL of the domain, the caller must hold
+// the lock
+func (m *memory) setDomainTTL(domain string, ttl time.Duration) {
+	if ttl <= 0 {
+		delete(m.domainTTLs, domain)
+		return
+	}
+	if m.domainTTLs == nil {
+		m.domainTTLs = make(map[string]time.Duration)
+	}
+	m.domainTTLs[domain] = ttl
+}
+
+// StartedAt returns when the register was created
+func (m *memory) StartedAt() time.Time {
+	m.RLock()
+	defer m.RUnlock()
+	return m.started
+}
+
+// Uptime returns how long the register has been running
+func (m *memory) Uptime() time.Duration {
+	m.RLock()
+	defer m.RUnlock()
+	return elapsed(m.now(), m.started)
+}
+
+// Fingerprint returns the content hash of the service version, equal
+// services have equal fingerprints in any register
+func (m *memory) Fingerprint(ctx context.Context, name, version string, opts ...register.LookupOption) (string, error) {
+	srvs, err := m.LookupService(ctx, name, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	for _, srv := range srvs {
+		if srv.Version == version {
+			return hashService(srv), nil
+		}
+	}
+
+	return "", register.ErrNotFound
+}
+
+// getNode returns the record and the node, the caller must hold the lock
+func (m *memory) getNode(domain, service, version, nodeID string) (*record, *node, error) {
+	r, ok := m.records[domain][service][version]
+	if !ok {
+		return nil, nil, register.ErrNotFound
+	}
+	n, ok := r.Nodes[nodeID]
+	if !ok {
+		return nil, nil, register.ErrNotFound
+	}
+	return r, n, nil
+}
+
+// SetNodeError stores the last error of the node, e.g. why it fails its health
+// checks, lookups report it in the last_error and last_error_at metadata until
+// the node re-registers as ready, an empty message clears it
+func (m *memory) SetNodeError(domain, service, version, nodeID, errMsg string) error {
+	if m.upstream != nil {
+		return ErrReadOnly
+	}
+
+	m.Lock()
+	if err := m.mutable(); err != nil {
+		m.Unlock()
+		return err
+	}
+
+	if domain == register.DefaultDomain && len(m.domain) > 0 {
+		domain = m.domain
+	}
+
+	r, n, err := m.getNode(domain, service, version, nodeID)
+	if err != nil {
+		m.Unlock()
+		return err
+	}
+
+	n.LastError = errMsg
+	n.LastErrorAt = time.Time{}
+	if len(errMsg) > 0 {
+		n.LastErrorAt = m.now()
+	}
+	m.touch(r)
+	m.walRegister(domain, r, []string{nodeID})
+	srv := recordToService(r, domain)
+	m.Unlock()
+
+	m.sendEvents([]*register.Result{{Action: "update", Service: srv}})
+	return nil
+}
+
+// SetNodeDrained marks the node as drained so clients stop sending it new
+// requests, drained nodes are still returned by lookups
+func (m *memory) SetNodeDrained(domain, service, version, nodeID string, drained bool) error {
+	if m.upstream != nil {
+		return ErrReadOnly
+	}
+
+	m.Lock()
+	if err := m.mutable(); err != nil {
+		m.Unlock()
+		return err
+	}
+
+	if domain == register.DefaultDomain && len(m.domain) > 0 {
+		domain = m.domain
+	}
+
+	r, n, err := m.getNode(domain, service, version, nodeID)
+	if err != nil {
+		m.Unlock()
+		return err
+	}
+
+	if n.Drained == drained {
+		m.Unlock()
+		return nil
+	}
+
+	n.Drained = drained
+	m.touch(r)
+	m.walRegister(domain, r, []string{nodeID})
+	srv := recordToService(r, domain)
+	m.Unlock()
+
+	m.sendEvents([]*register.Result{{Action: "update", Service: srv}})
+	return nil
+}
+
+// RenameDomain moves all the services of the old domain to the new one,
+// watchers of the old domain receive delete events and watchers of the new
+// domain receive create events, with DomainEvents the old domain is deleted
+// and the new one created. The TTL set for the old domain moves with it
+func (m *memory) RenameDomain(old, new string) error {
+	if m.upstream != nil {
+		return ErrReadOnly
+	}
+
+	m.Lock()
+	if err := m.mutable(); err != nil {
+		m.Unlock()
+		return err
+	}
+
+	// an empty name refers to the default domain as in the other calls
+	for _, domain := range []*string{&old, &new} {
+		if len(*domain) == 0 {
+			*domain = register.DefaultDomain
+		}
+		if *domain == register.DefaultDomain && len(m.domain) > 0 {
+			*domain = m.domain
+		}
+	}
+
+	if old == register.WildcardDomain || new == register.WildcardDomain || !m.domainAllowed(new) {
+		m.Unlock()
+		return ErrDomainNotAllowed
+	}
+
+	srvs, ok := m.records[old]
+	if !ok {
+		m.Unlock()
+		return register.ErrNotFound
+	}
+	if _, ok := m.records[new]; ok {
+		m.Unlock()
+		return ErrDomainExists
+	}
+
+	var events, created []*register.Result
+	for _, versions := range srvs {
+		for _, r := range versions {
+			events = append(events, &register.Result{Action: "delete", Service: recordToService(r, old)})
+
+			m.indexRemove(old, r)
+			r.Metadata["domain"] = new
+			for _, n := range r.Nodes {
+				n.Metadata["domain"] = new
+			}
+			m.indexAdd(new, r)
+			m.touch(r)
+
+			m.walRemove(old, r.Name, r.Version, nil)
+			m.walRegister(new, r, nodeIDs(r))
+			if len(r.Schema) > 0 {
+				m.walSchema(new, r)
+			}
+
+			created = append(created, &register.Result{Action: "create", Service: recordToService(r, new)})
+		}
+	}
+
+	// the old domain is removed once emptied and the new one added before it is filled
+	if m.domainEvents {
+		events = append(events, domainEvent("delete", old), domainEvent("create", new))
+	}
+	events = append(events, created...)
+
+	m.records[new] = srvs
+	delete(m.records, old)
+	if removed, ok := m.removed[old]; ok {
+		m.removed[new] = removed
+		delete(m.removed, old)
+	}
+	if ttl, ok := m.domainTTLs[old]; ok {
+		m.domainTTLs[new] = ttl
+		delete(m.domainTTLs, old)
+		m.walDomainTTL(old, 0)
+		m.walDomainTTL(new, ttl)
+	}
+	for key, peaks := range m.peaks {
+		if key.domain == old {
+			delete(m.peaks, key)
+			key.domain = new
+			m.peaks[key] = peaks
+		}
+	}
+	m.Unlock()
+
+	m.sendEvents(events)
+	return nil
+}
+
+// SetNodeReady marks the node as ready to serve, nodes registered with the
+// ready metadata set to false are excluded from OnlyHealthy and SelectNode
+// until they are marked ready
+func (m *memory) SetNodeReady(domain, service, version, nodeID string, ready bool) error {
+	if m.upstream != nil {
+		return ErrReadOnly
+	}
+
+	m.Lock()
+	if err := m.mutable(); err != nil {
+		m.Unlock()
+		return err
+	}
+
+	if domain == register.DefaultDomain && len(m.domain) > 0 {
+		domain = m.domain
+	}
+
+	r, n, err := m.getNode(domain, service, version, nodeID)
+	if err != nil {
+		m.Unlock()
+		return err
+	}
+
+	if nodeReady(n.Metadata) == ready {
+		m.Unlock()
+		return nil
+	}
+
+	n.Metadata["ready"] = strconv.FormatBool(ready)
+	m.touch(r)
+	m.walRegister(domain, r, []string{nodeID})
+	srv := recordToService(r, domain)
+	m.Unlock()
+
+	m.sendEvents([]*register.Result{{Action: "update", Service: srv}})
+	return nil
+}
+
+// PromoteVersion marks the service version as the primary one by setting
+// the primary metadata, the marker is removed from the other versions
+func (m *memory) PromoteVersion(domain, service, version string) error {
+	if m.upstream != nil {
+		return ErrReadOnly
+	}
+
+	m.Lock()
+	if err := m.mutable(); err != nil {
+		m.Unlock()
+		return err
+	}
+
+	if domain == register.DefaultDomain && len(m.domain) > 0 {
+		domain = m.domain
+	}
+
+	versions := m.records[domain][service]
+	if _, ok := versions[version]; !ok {
+		m.Unlock()
+		return register.ErrNotFound
+	}
+
+	var events []*register.Result
+	for v, r := range versions {
+		primary := v == version
+		if (r.Metadata["primary"] == "true") == primary {
+			continue
+		}
+
+		// keep the metadata indexes in sync
+		m.indexRemove(domain, r)
+		if primary {
+			r.Metadata["primary"] = "true"
+		} else {
+			delete(r.Metadata, "primary")
+		}
+		m.indexAdd(domain, r)
+		m.touch(r)
+		m.walRegister(domain, r, nodeIDs(r))
+
+		events = append(events, &register.Result{Action: "update", Service: recordToService(r, domain)})
+	}
+	m.Unlock()
+
+	m.sendEvents(events)
+	return nil
+}
+
+// TouchAll refreshes the last seen time of every node in the domain, or in
+// every domain for the wildcard domain, and returns the number of nodes
+func (m *memory) TouchAll(domain string) (int, error) {
+	if m.upstream != nil {
+		return 0, ErrReadOnly
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if err := m.mutable(); err != nil {
+		return 0, err
+	}
+
+	if domain == register.DefaultDomain && len(m.domain) > 0 {
+		domain = m.domain
+	}
+
+	domains := []string{domain}
+	if domain == register.WildcardDomain {
+		domains = domains[:0]
+		for d := range m.records {
+			domains = append(domains, d)
+		}
+	} else if _, ok := m.records[domain]; !ok {
+		return 0, register.ErrNotFound
+	}
+
+	now := m.now()
+	var count int
+	for _, d := range domains {
+		for _, versions := range m.records[d] {
+			for _, r := range versions {
+				for _, n := range r.Nodes {
+					n.LastSeen = now
+					n.StaleWarned = false
+					count++
+				}
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// NodeAges returns the time since the oldest and the newest nodes of the
+// service version were last seen
+func (m *memory) NodeAges(domain, service, version string) (oldest, newest time.Duration, err error) {
+	domain = m.defaultDomain(domain)
+
+	m.RLock()
+	defer m.RUnlock()
+
+	r, ok := m.records[domain][service][version]
+	if !ok || len(r.Nodes) == 0 {
+		return 0, 0, register.ErrNotFound
+	}
+
+	now := m.now()
+	first := true
+	for _, n := range r.Nodes {
+		age := elapsed(now, n.LastSeen)
+		if first || age > oldest {
+			oldest = age
+		}
+		if first || age < newest {
+			newest = age
+		}
+		first = false
+	}
+
+	return oldest, newest, nil
+}
+
+// NodeTTL returns the TTL the node was registered with, not the time left
+// before it expires, zero means the node has no TTL
+func (m *memory) NodeTTL(domain, service, version, nodeID string) (time.Duration, error) {
+	domain = m.defaultDomain(domain)
+
+	m.RLock()
+	defer m.RUnlock()
+
+	_, n, err := m.getNode(domain, service, version, nodeID)
+	if err != nil {
+		return 0, err
+	}
+	return n.TTL, nil
+}
+
+// SelectNode returns a random node of the service which is ready and not drained
+func (m *memory) SelectNode(ctx context.Context, name string, opts ...register.LookupOption) (*register.Node, error) {
+	srvs, err := m.LookupService(ctx, name, append(opts, OnlyHealthy())...)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []*register.Node
+	for _, srv := range srvs {
+		nodes = append(nodes, srv.Nodes...)
+	}
+	if len(nodes) == 0 {
+		return nil, register.ErrNotFound
+	}
+
+	return nodes[rand.Intn(len(nodes))], nil
+}
+
+// LookupNearest returns the nodes of all the service versions sorted by their
+// great-circle distance from the point, the node position is read from the
+// lat and lon metadata in degrees, nodes without a valid position sort last
+func (m *memory) LookupNearest(ctx context.Context, name string, lat, lon float64, opts ...register.LookupOption) ([]*register.Node, error) {
+	srvs, err := m.LookupService(ctx, name, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []*register.Node
+	for _, srv := range srvs {
+		nodes = append(nodes, srv.Nodes...)
+	}
+	if len(nodes) == 0 {
+		return nil, register.ErrNotFound
+	}
+
+	distances := make(map[*register.Node]float64, len(nodes))
+	for _, n := range nodes {
+		if nlat, nlon, ok := nodePosition(n.Metadata); ok {
+			distances[n] = distance(lat, lon, nlat, nlon)
+		}
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		di, iok := distances[nodes[i]]
+		dj, jok := distances[nodes[j]]
+		if iok != jok {
+			return iok
+		}
+		return di < dj
+	})
+
+	return nodes, nil
+}
+
+// defaultDomain replaces the parent default domain with the configured one
+func (m *memory) defaultDomain(domain string) string {
+	m.RLock()
+	defer m.RUnlock()
+
+	if domain == register.DefaultDomain && len(m.domain) > 0 {
+		return m.domain
+	}
+	return domain
+}
+
+// DuplicateAddresses returns the addresses used by more than one node of
+// the same service version mapped to the sorted node ids
+func (m *memory) DuplicateAddresses(domain string) (map[string][]string, error) {
+	if m.isClosed() {
+		return nil, ErrClosed
+	}
+
+	domain = m.defaultDomain(domain)
+	domains := []string{domain}
+	if domain == register.WildcardDomain {
+		domains = m.domains()
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	result := make(map[string][]string)
+
+	for _, d := range domains {
+		for _, versions := range m.records[d] {
+			for _, r := range versions {
+				ids := make(map[string][]string)
+				for id, n := range r.Nodes {
+					if len(n.Address) > 0 {
+						ids[n.Address] = append(ids[n.Address], id)
+					}
+				}
+				for addr, nodes := range ids {
+					if len(nodes) > 1 {
+						result[addr] = append(result[addr], nodes...)
+					}
+				}
+			}
+		}
+	}
+
+	for addr := range result {
+		sort.Strings(result[addr])
+	}
+
+	return result, nil
+}
+
+// now returns the current time of the configured clock, the caller must hold the lock
+func (m *memory) now() time.Time {
+	return m.clock()
+}
+
+// elapsed returns the time since t, the default clock readings carry the
+// monotonic clock so wall clock adjustments don't affect it, negative
+// durations from a clock moving backward count as no time elapsed
+func elapsed(now, t time.Time) time.Duration {
+	if d := now.Sub(t); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// nodeExpired reports whether the node passed its deadline, or outlived its
+// TTL when it has no deadline, static nodes never expire
+func nodeExpired(n *node, now time.Time) bool {
+	if n.Static {
+		return false
+	}
+	if !n.Deadline.IsZero() {
+		return now.After(n.Deadline)
+	}
+	return n.TTL > 0 && elapsed(now, n.LastSeen) > n.TTL
+}
+
+// countServices returns the number of service versions across all domains,
+// the caller must hold the lock
+func (m *memory) countServices() int {
+	var count int
+	for _, services := range m.records {
+		for _, versions := range services {
+			count += len(versions)
+		}
+	}
+	return count
+}
+
+// LookupByPrefix returns all services with a name starting with the prefix
+// sorted by name, version and domain
+func (m *memory) LookupByPrefix(ctx context.Context, prefix string, opts ...register.LookupOption) ([]*register.Service, error) {
+	if m.isClosed() {
+		return nil, ErrClosed
+	}
+
+	options := register.NewLookupOptions(opts...)
+	options.Domain = m.defaultDomain(options.Domain)
+
+	var result []*register.Service
+
+	domains := []string{options.Domain}
+	if options.Domain == register.WildcardDomain {
+		domains = m.domains()
+	}
+
+	m.RLock()
+	for _, domain := range domains {
+		for name, versions := range m.records[domain] {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			for _, r := range versions {
+				if m.flagEnabled(r.Metadata) {
+					result = append(result, recordToService(r, domain))
+				}
+			}
+		}
+	}
+	m.RUnlock()
+
+	if len(result) == 0 {
+		return nil, register.ErrNotFound
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		if result[i].Version != result[j].Version {
+			return result[i].Version < result[j].Version
+		}
+		return result[i].Metadata["domain"] < result[j].Metadata["domain"]
+	})
+
+	return result, nil
+}
+
+// LookupByIdentity returns the services having nodes with the identity,
+// only the matching nodes are returned
+func (m *memory) LookupByIdentity(ctx context.Context, spiffeID string, opts ...register.LookupOption) ([]*register.Service, error) {
+	if m.isClosed() {
+		return nil, ErrClosed
+	}
+
+	options := register.NewLookupOptions(opts...)
+	options.Domain = m.defaultDomain(options.Domain)
+
+	domains := []string{options.Domain}
+	if options.Domain == register.WildcardDomain {
+		domains = m.domains()
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	var result []*register.Service
+
+	for _, domain := range domains {
+		for _, versions := range m.records[domain] {
+			for _, r := range versions {
+				if !m.flagEnabled(r.Metadata) {
+					continue
+				}
+				srv := recordToService(r, domain)
+				nodes := srv.Nodes[:0]
+				for _, n := range srv.Nodes {
+					if n.Metadata[m.identityKey] == spiffeID {
+						nodes = append(nodes, n)
+					}
+				}
+				if len(nodes) > 0 {
+					srv.Nodes = nodes
+					result = append(result, srv)
+				}
+			}
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, register.ErrNotFound
+	}
+
+	return result, nil
+}
+
+// domains returns the names of all known domains
+func (m *memory) domains() []string {
+	m.RLock()
+	defer m.RUnlock()
+
+	domains := make([]string, 0, len(m.records))
+	for domain := range m.records {
+		domains = append(domains, domain)
+	}
+
+	return domains
+}
+
+func (m *memory) ListServices(ctx context.Context, opts ...register.ListOption) ([]*register.Service, error) {
+	if m.isClosed() {
+		return nil, ErrClosed
+	}
+
+	options := register.NewListOptions(opts...)
+	options.Domain = m.defaultDomain(options.Domain)
+	counts := getBool(options.Context, withCountsKey{})
+
+	// if it's a wildcard domain, list from all domains
+	if options.Domain == register.WildcardDomain {
+		var services []*register.Service
+
+		if m.consistentWildcard() {
+			m.RLock()
+			for domain := range m.records {
+				services = append(services, m.listServices(domain, options)...)
+			}
+			m.RUnlock()
+		} else {
+			for _, domain := range m.domains() {
+				// the versions are grouped once across all domains
+				srvs, err := m.ListServices(ctx, append(opts, register.ListDomain(domain), WithCounts(false))...)
+				if err != nil {
+					return nil, err
+				}
+				services = append(services, srvs...)
+			}
+		}
+
+		if counts {
+			return groupVersions(services), nil
+		}
+		return services, nil
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	// ensure the domain exists
+	if _, ok := m.records[options.Domain]; !ok {
+		return make([]*register.Service, 0), nil
+	}
+
+	if counts {
+		return groupVersions(m.listServices(options.Domain, options)), nil
+	}
+	return m.listServices(options.Domain, options), nil
+}
+
+// listServices returns the services of the domain, the caller must hold the lock
+func (m *memory) listServices(domain string, options register.ListOptions) []*register.Service {
+	// serialize the result, each version counts as an individual service
+	var result []*register.Service
+
+	key, value, filtered := getMetadataFilter(options.Context)
+	if filtered && m.normalizeKey != nil {
+		key = m.normalizeKey(key)
+	}
+	activeOnly := getBool(options.Context, listActiveOnlyKey{})
+	now := m.now()
+
+	add := func(r *record) {
+		if !m.flagEnabled(r.Metadata) {
+			return
+		}
+		srv := recordToService(r, domain)
+		if activeOnly && !filterAvailable(srv, now) {
+			return
+		}
+		result = append(result, srv)
+	}
+
+	// use the secondary index if the filtered key is indexed
+	if filtered {
+		if recs, ok := m.indexLookup(domain, key, value); ok {
+			for _, r := range recs {
+				add(r)
+			}
+			return result
+		}
+	}
+
+	for _, service := range m.records[domain] {
+		for _, version := range service {
+			if filtered {
+				if v, ok := version.Metadata[key]; !ok || v != value {
+					continue
+				}
+			}
+			add(version)
+		}
+	}
+
+	return result
+}
+
+// Dump returns a copy of every service keyed by domain, the services of a
+// domain are sorted by name and version
+func (m *memory) Dump(ctx context.Context) (map[string][]*register.Service, error) {
+	if m.isClosed() {
+		return nil, ErrClosed
+	}
+
+	m.RLock()
+	result := make(map[string][]*register.Service, len(m.records))
+	for domain, services := range m.records {
+		srvs := make([]*register.Service, 0, len(services))
+		for _, versions := range services {
+			for _, r := range versions {
+				if m.flagEnabled(r.Metadata) {
+					srvs = append(srvs, recordToService(r, domain))
+				}
+			}
+		}
+		result[domain] = srvs
+	}
+	m.RUnlock()
+
+	for _, srvs := range result {
+		sort.Slice(srvs, func(i, j int) bool {
+			if srvs[i].Name != srvs[j].Name {
+				return srvs[i].Name < srvs[j].Name
+			}
+			return srvs[i].Version < srvs[j].Version
+		})
+	}
+
+	return result, nil
+}
+
+// DanglingServices returns the services without any usable node, a node is
+// unusable when it expired but was not pruned yet, is not ready or is drained
+func (m *memory) DanglingServices(ctx context.Context, opts ...register.ListOption) ([]*register.Service, error) {
+	if m.isClosed() {
+		return nil, ErrClosed
+	}
+
+	options := register.NewListOptions(opts...)
+	options.Domain = m.defaultDomain(options.Domain)
+
+	m.RLock()
+	defer m.RUnlock()
+
+	domains := []string{options.Domain}
+	if options.Domain == register.WildcardDomain {
+		domains = domains[:0]
+		for domain := range m.records {
+			domains = append(domains, domain)
+		}
+	}
+
+	now := m.now()
+	var result []*register.Service
+
+	for _, domain := range domains {
+		for _, versions := range m.records[domain] {
+			for _, r := range versions {
+				if !m.flagEnabled(r.Metadata) || !m.dangling(r, now) {
+					continue
+				}
+				result = append(result, recordToService(r, domain))
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// ListNodeIDs returns the sorted and deduplicated ids of the nodes of the
+// domain, or of every domain for the wildcard domain
+func (m *memory) ListNodeIDs(ctx context.Context, opts ...register.ListOption) ([]string, error) {
+	if m.isClosed() {
+		return nil, ErrClosed
+	}
+
+	options := register.NewListOptions(opts...)
+	options.Domain = m.defaultDomain(options.Domain)
+	prefix := getBool(options.Context, withServicePrefixKey{})
+
+	m.RLock()
+	domains := []string{options.Domain}
+	if options.Domain == register.WildcardDomain {
+		domains = domains[:0]
+		for domain := range m.records {
+			domains = append(domains, domain)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		for name, versions := range m.records[domain] {
+			for _, r := range versions {
+				if !m.flagEnabled(r.Metadata) {
+					continue
+				}
+				for id := range r.Nodes {
+					if prefix {
+						id = name + "/" + id
+					}
+					seen[id] = true
+				}
+			}
+		}
+	}
+	m.RUnlock()
+
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// DependencyGraph returns the services of the domain, or of every domain
+// for the wildcard domain, mapped to the sorted names of the services they
+// depend on, the dependencies are the comma separated names in the depends
+// metadata of any version of the service
+func (m *memory) DependencyGraph(ctx context.Context, opts ...register.ListOption) (map[string][]string, error) {
+	if m.isClosed() {
+		return nil, ErrClosed
+	}
+
+	options := register.NewListOptions(opts...)
+	options.Domain = m.defaultDomain(options.Domain)
+
+	m.RLock()
+	domains := []string{options.Domain}
+	if options.Domain == register.WildcardDomain {
+		domains = domains[:0]
+		for domain := range m.records {
+			domains = append(domains, domain)
+		}
+	}
+
+	deps := make(map[string]map[string]bool)
+	for _, domain := range domains {
+		for name, versions := range m.records[domain] {
+			for _, r := range versions {
+				if !m.flagEnabled(r.Metadata) {
+					continue
+				}
+				if deps[name] == nil {
+					deps[name] = make(map[string]bool)
+				}
+				for _, dep := range strings.Split(r.Metadata["depends"], ",") {
+					if dep = strings.TrimSpace(dep); len(dep) > 0 {
+						deps[name][dep] = true
+					}
+				}
+			}
+		}
+	}
+	m.RUnlock()
+
+	graph := make(map[string][]string, len(deps))
+	for name, set := range deps {
+		edges := make([]string, 0, len(set))
+		for dep := range set {
+			edges = append(edges, dep)
+		}
+		sort.Strings(edges)
+		graph[name] = edges
+	}
+
+	return graph, nil
+}
+
+// dangling reports whether the record has no usable node, the caller must hold the lock
+func (m *memory) dangling(r *record, now time.Time) bool {
+	for _, n := range r.Nodes {
+		expired := nodeExpired(n, now)
+		if !expired && !n.Drained && nodeReady(n.Metadata) {
+			return false
+		}
+	}
+	return true
+}
+
+// Query returns the listed services for which the predicate returns true,
+// the predicate is called without the lock held with a copy of each service
+func (m *memory) Query(ctx context.Context, pred func(*register.Service) bool, opts ...register.ListOption) ([]*register.Service, error) {
+	srvs, err := m.ListServices(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*register.Service, 0, len(srvs))
+	for _, srv := range srvs {
+		if pred(srv) {
+			result = append(result, srv)
+		}
+	}
+
+	return result, nil
+}
+
+// ExportServices returns a copy of every service across all domains with the
+// domain set in metadata, sorted by domain, name and version so the result can
+// be registered as is into another register
+func (m *memory) ExportServices(ctx context.Context) ([]*register.Service, error) {
+	if m.isClosed() {
+		return nil, ErrClosed
+	}
+
+	m.RLock()
+	var result []*register.Service
+	for domain, services := range m.records {
+		for _, versions := range services {
+			for _, r := range versions {
+				if !m.flagEnabled(r.Metadata) {
+					continue
+				}
+				srv := recordToService(r, domain)
+				sort.Slice(srv.Nodes, func(i, j int) bool { return srv.Nodes[i].Id < srv.Nodes[j].Id })
+				result = append(result, srv)
+			}
+		}
+	}
+	m.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if a, b := result[i].Metadata["domain"], result[j].Metadata["domain"]; a != b {
+			return a < b
+		}
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].Version < result[j].Version
+	})
+
+	return result, nil
+}
+
+func (m *memory) Watch(ctx context.Context, opts ...register.WatchOption) (register.Watcher, error) {
+	if m.isClosed() {
+		return nil, ErrClosed
+	}
+
+	wo := register.NewWatchOptions(opts...)
+	wo.Domain = m.defaultDomain(wo.Domain)
+
+	m.RLock()
+	id := m.newID()
+	m.RUnlock()
+
+	// construct the watcher
+	w := &Watcher{
+		exit:        make(chan bool),
+		res:         make(chan *register.Result),
+		notify:      make(chan struct{}, 1),
+		id:          id,
+		wo:          wo,
+		bufferSize:  getInt(wo.Context, newestFirstKey{}),
+		diff:        getBool(wo.Context, diffKey{}),
+		skipAlive:   getBool(wo.Context, skipKeepaliveKey{}),
+		filterNodes: getBool(wo.Context, filterNodesKey{}),
+	}
+
+	if md := getNodeMetadata(wo.Context); len(md) > 0 {
+		w.nodeMetadata = make(map[string]string, len(md))
+		for k, v := range md {
+			w.nodeMetadata[k] = v
+		}
+	}
+
+	if actions := getStrings(wo.Context, actionsKey{}); len(actions) > 0 {
+		w.actions = make(map[string]bool, len(actions))
+		for _, action := range actions {
+			w.actions[action] = true
+		}
+	}
+
+	m.Lock()
+	// a Disconnect in between would never stop the watcher
+	if m.closed {
+		m.Unlock()
+		return nil, ErrClosed
+	}
+	if m.maxWatchers > 0 && m.countWatchers() >= m.maxWatchers {
+		m.Unlock()
+		return nil, ErrLimitExceeded
+	}
+	// queue the services changed since the resume revision before any live event
+	if rev, ok := getRevision(wo.Context); ok {
+		w.pending = m.changedSince(w, rev)
+	}
+	m.watchers[w.id] = w
+	m.Unlock()
+
+	if d := getDuration(wo.Context, resyncIntervalKey{}, 0); d > 0 {
+		go m.resync(w, d, false)
+	}
+	if d := getDuration(wo.Context, hashResyncIntervalKey{}, 0); d > 0 {
+		go m.resync(w, d, true)
+	}
+	if d := getDuration(wo.Context, keepaliveKey{}, 0); d > 0 {
+		go m.keepalive(w, d)
+	}
+
+	return w, nil
+}
+
+// WaitForService returns the service once it is registered, it returns right
+// away if the service already exists and ctx.Err() if ctx is done first
+func (m *memory) WaitForService(ctx context.Context, name string, opts ...register.WatchOption) (*register.Service, error) {
+	// watch before the lookup so a registration in between isn't missed
+	w, err := m.Watch(ctx, append(opts, register.WatchService(name))...)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+
+	wo := register.NewWatchOptions(opts...)
+	srvs, err := m.LookupService(ctx, name, register.LookupDomain(wo.Domain))
+	if err != nil && err != register.ErrNotFound {
+		return nil, err
+	}
+	if len(srvs) > 0 {
+		return srvs[0], nil
+	}
+
+	type next struct {
+		res *register.Result
+		err error
+	}
+	ch := make(chan next, 1)
+
+	// the deferred Stop ends the loop once ctx is done
+	go func() {
+		for {
+			res, err := w.Next()
+			if err != nil || res.Action == "create" || res.Action == "update" {
+				ch <- next{res, err}
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case n := <-ch:
+		if n.err != nil {
+			return nil, n.err
+		}
+		return n.res.Service, nil
+	}
+}
+
+// keepalive periodically delivers a keepalive result without service
+func (m *memory) keepalive(w *Watcher, d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-w.exit:
+			return
+		case <-t.C:
+			select {
+			case w.res <- &register.Result{Action: "keepalive"}:
+			case <-w.exit:
+				return
+			}
+		}
+	}
+}
+
+// countWatchers removes the stopped watchers and returns the number of
+// active ones, the caller must hold the lock
+func (m *memory) countWatchers() int {
+	for id, w := range m.watchers {
+		select {
+		case <-w.exit:
+			delete(m.watchers, id)
+		default:
+		}
+	}
+	return len(m.watchers)
+}
+
+// resync periodically delivers the current state matching the watcher filters,
+// only the service hashes are delivered when hashes is true
+func (m *memory) resync(w *Watcher, d time.Duration, hashes bool) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-w.exit:
+			return
+		case <-t.C:
+			for _, r := range m.snapshot(w) {
+				if hashes {
+					r = hashResult(r.Service)
+				}
+				select {
+				case w.res <- r:
+				case <-w.exit:
+					return
+				}
+			}
+		}
+	}
+}
+
+// changedSince returns create events for the services matching the watcher
+// filters changed after the revision, the caller must hold the lock
+func (m *memory) changedSince(w *Watcher, rev uint64) []*register.Result {
+	var results []*register.Result
+
+	for domain, services := range m.records {
+		for _, versions := range services {
+			for _, rec := range versions {
+				if rec.Revision <= rev || !m.flagEnabled(rec.Metadata) {
+					continue
+				}
+				r := &register.Result{Action: "create", Service: recordToService(rec, domain)}
+				if w.matches(r) {
+					results = append(results, w.filter(r))
+				}
+			}
+		}
+	}
+
+	return results
+}
+
+// snapshot returns create events for all services matching the watcher filters
+func (m *memory) snapshot(w *Watcher) []*register.Result {
+	m.RLock()
+	defer m.RUnlock()
+
+	var results []*register.Result
+
+	for domain, services := range m.records {
+		for _, versions := range services {
+			for _, rec := range versions {
+				if !m.flagEnabled(rec.Metadata) {
+					continue
+				}
+				r := &register.Result{Action: "create", Service: recordToService(rec, domain)}
+				if w.matches(r) {
+					results = append(results, w.filter(r))
+				}
+			}
+		}
+	}
+
+	return results
+}
+
+func (m *memory) Name() string {
+	m.RLock()
+	defer m.RUnlock()
 	return m.opts.Name
 }
 
@@ -1,12 +1,26 @@
 package memory
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 
+	"github.com/unistack-org/micro/v3/logger"
+	"github.com/unistack-org/micro/v3/metadata"
 	"github.com/unistack-org/micro/v3/register"
 )
 
@@ -285,3 +299,4508 @@ func TestMemoryWildcard(t *testing.T) {
 		t.Errorf("Expected 2 records, got %v", len(recs))
 	}
 }
+
+func TestMemoryPinned(t *testing.T) {
+	m := NewRegister()
+	ctx := context.TODO()
+
+	pinned := &register.Service{
+		Name:    "pinned",
+		Version: "1.0.0",
+		Nodes:   []*register.Node{{Id: "pinned-1", Address: "localhost:9999"}},
+	}
+	regular := &register.Service{
+		Name:    "regular",
+		Version: "1.0.0",
+		Nodes:   []*register.Node{{Id: "regular-1", Address: "localhost:9999"}},
+	}
+
+	if err := m.Register(ctx, pinned, register.RegisterTTL(time.Millisecond), Pinned(true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(ctx, regular, register.RegisterTTL(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(ttlPruneTime * 2)
+
+	svcs, err := m.LookupService(ctx, pinned.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs) != 1 || len(svcs[0].Nodes) != 1 {
+		t.Fatalf("pinned service expected to survive prune, got %v", svcs)
+	}
+
+	svcs, err = m.LookupService(ctx, regular.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs) != 1 || len(svcs[0].Nodes) != 0 {
+		t.Fatalf("regular service expected to be pruned, got %v", svcs)
+	}
+
+	if err := m.Deregister(ctx, pinned); err != ErrPinned {
+		t.Fatalf("Expected error: %v, got: %v", ErrPinned, err)
+	}
+
+	if _, err := m.LookupService(ctx, pinned.Name); err != nil {
+		t.Fatalf("pinned service expected to survive deregister, got %v", err)
+	}
+}
+
+func TestMemoryLookupByEndpoint(t *testing.T) {
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	foo := &register.Service{
+		Name:      "foo",
+		Version:   "1.0.0",
+		Endpoints: []*register.Endpoint{{Name: "Foo.Call"}, {Name: "Foo.Stream"}},
+	}
+	bar := &register.Service{
+		Name:      "bar",
+		Version:   "1.0.0",
+		Endpoints: []*register.Endpoint{{Name: "Bar.Call"}},
+	}
+
+	if err := m.Register(ctx, foo, register.RegisterDomain("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(ctx, foo, register.RegisterDomain("two")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(ctx, bar, register.RegisterDomain("one")); err != nil {
+		t.Fatal(err)
+	}
+
+	svcs, err := m.LookupByEndpoint(ctx, "Foo.Stream", register.LookupDomain("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs) != 1 || svcs[0].Name != "foo" {
+		t.Fatalf("Expected foo service, got %v", svcs)
+	}
+
+	if svcs, err = m.LookupByEndpoint(ctx, "Foo.Call", register.LookupDomain(register.WildcardDomain)); err != nil {
+		t.Fatal(err)
+	} else if len(svcs) != 2 {
+		t.Fatalf("Expected 2 services, got %v", len(svcs))
+	}
+
+	if _, err = m.LookupByEndpoint(ctx, "Bar.Call", register.LookupDomain("two")); err != register.ErrNotFound {
+		t.Fatalf("Expected error: %v, got: %v", register.ErrNotFound, err)
+	}
+
+	if _, err = m.LookupByEndpoint(ctx, "Baz.Call", register.LookupDomain(register.WildcardDomain)); err != register.ErrNotFound {
+		t.Fatalf("Expected error: %v, got: %v", register.ErrNotFound, err)
+	}
+}
+
+func TestMemoryInitPruneInterval(t *testing.T) {
+	m := NewRegister(PruneInterval(time.Hour))
+	ctx := context.TODO()
+
+	srv := &register.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes:   []*register.Node{{Id: "foo-1", Address: "localhost:9999"}},
+	}
+	if err := m.Register(ctx, srv, register.RegisterTTL(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	svcs, err := m.LookupService(ctx, srv.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs[0].Nodes) != 1 {
+		t.Fatal("node pruned before the prune interval elapsed")
+	}
+
+	if err := m.Init(PruneInterval(10 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	svcs, err = m.LookupService(ctx, srv.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs[0].Nodes) != 0 {
+		t.Fatal("node expected to be pruned after the prune interval changed")
+	}
+}
+
+func TestMemoryInitMaxServices(t *testing.T) {
+	m := NewRegister(MaxServices(1))
+	ctx := context.TODO()
+
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0"}); err != ErrLimitExceeded {
+		t.Fatalf("Expected error: %v, got: %v", ErrLimitExceeded, err)
+	}
+
+	if err := m.Init(MaxServices(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryInitConcurrent(t *testing.T) {
+	m := NewRegister(EventSink(func(ctx context.Context, r *register.Result) error {
+		return errors.New("bus unavailable")
+	}))
+	ctx := context.TODO()
+
+	// the options are read by the sink, the logger and Options while Init writes them
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			m.Init(register.Name(fmt.Sprintf("memory-%d", i)))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			m.Register(ctx, &register.Service{Name: fmt.Sprintf("foo-%d", i), Version: "1.0.0"})
+			_ = m.Options().Name
+			_ = m.Name()
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMemoryProtocol(t *testing.T) {
+	m := NewRegister()
+	ctx := context.TODO()
+
+	grpcSrv := &register.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes: []*register.Node{
+			{Id: "foo-1", Address: "localhost:9999", Metadata: map[string]string{"protocol": "GRPC"}},
+		},
+	}
+	httpSrv := &register.Service{
+		Name:    "foo",
+		Version: "1.0.1",
+		Nodes: []*register.Node{
+			{Id: "foo-2", Address: "localhost:8888", Metadata: map[string]string{"protocol": "http"}},
+		},
+	}
+
+	for _, srv := range []*register.Service{grpcSrv, httpSrv} {
+		if err := m.Register(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	svcs, err := m.LookupService(ctx, "foo", ByProtocol("grpc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs) != 1 || svcs[0].Version != "1.0.0" {
+		t.Fatalf("Expected grpc version 1.0.0, got %v", svcs)
+	}
+	if p := svcs[0].Nodes[0].Metadata["protocol"]; p != "grpc" {
+		t.Fatalf("Expected normalized protocol grpc, got %s", p)
+	}
+
+	if svcs, err = m.LookupService(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	} else if len(svcs) != 2 {
+		t.Fatalf("Expected 2 services, got %d", len(svcs))
+	}
+
+	if _, err = m.LookupService(ctx, "foo", ByProtocol("https")); err != register.ErrNotFound {
+		t.Fatalf("Expected error: %v, got: %v", register.ErrNotFound, err)
+	}
+
+	invalid := &register.Service{
+		Name:    "bar",
+		Version: "1.0.0",
+		Nodes: []*register.Node{
+			{Id: "bar-1", Address: "localhost:7777", Metadata: map[string]string{"protocol": "smtp"}},
+		},
+	}
+	if err = m.Register(ctx, invalid); err != ErrInvalidProtocol {
+		t.Fatalf("Expected error: %v, got: %v", ErrInvalidProtocol, err)
+	}
+	if _, err = m.LookupService(ctx, "bar"); err != register.ErrNotFound {
+		t.Fatalf("Expected error: %v, got: %v", register.ErrNotFound, err)
+	}
+}
+
+func TestMemoryDisconnect(t *testing.T) {
+	m := NewRegister()
+	ctx := context.TODO()
+
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Disconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Next(); err == nil {
+		t.Fatal("expected error on Next() after Disconnect")
+	}
+
+	if err := m.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0"}); err != ErrClosed {
+		t.Fatalf("Expected error: %v, got: %v", ErrClosed, err)
+	}
+	if _, err := m.LookupService(ctx, "foo"); err != ErrClosed {
+		t.Fatalf("Expected error: %v, got: %v", ErrClosed, err)
+	}
+	if _, err := m.ListServices(ctx); err != ErrClosed {
+		t.Fatalf("Expected error: %v, got: %v", ErrClosed, err)
+	}
+	if _, err := m.Watch(ctx); err != ErrClosed {
+		t.Fatalf("Expected error: %v, got: %v", ErrClosed, err)
+	}
+
+	// disconnect is idempotent
+	if err := m.Disconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryExportServices(t *testing.T) {
+	ctx := context.TODO()
+	src := NewRegister().(*memory)
+
+	for _, domain := range []string{"one", "two"} {
+		for _, v := range testData {
+			for _, service := range v {
+				if err := src.Register(ctx, service, register.RegisterDomain(domain)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	if err := src.Register(ctx, &register.Service{
+		Name:    "baz",
+		Version: "1.0.0",
+		Endpoints: []*register.Endpoint{{
+			Name:    "Baz.Call",
+			Request: &register.Value{Name: "req", Type: "Request", Values: []*register.Value{{Name: "id", Type: "string"}}},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err := src.ExportServices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := NewRegister().(*memory)
+	for _, srv := range exported {
+		if err := dst.Register(ctx, srv, register.RegisterDomain(srv.Metadata["domain"])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	imported, err := dst.ExportServices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(exported, imported) {
+		t.Fatal("exported services differ after the round trip")
+	}
+
+	// the export must not share state with the source register
+	for _, srv := range exported {
+		if srv.Name == "baz" {
+			srv.Endpoints[0].Request.Values[0].Name = "changed"
+		}
+	}
+	again, err := src.ExportServices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, srv := range again {
+		if srv.Name == "baz" && srv.Endpoints[0].Request.Values[0].Name != "id" {
+			t.Fatal("exported services share state with the register")
+		}
+	}
+}
+
+func TestMemoryMaxMetadataBytes(t *testing.T) {
+	m := NewRegister(MaxMetadataBytes(16))
+	ctx := context.TODO()
+
+	testCases := []struct {
+		name     string
+		service  *register.Service
+		expected error
+	}{
+		{
+			name: "under",
+			service: &register.Service{
+				Name:     "under",
+				Metadata: map[string]string{"key": "value"},
+			},
+		},
+		{
+			name: "at",
+			service: &register.Service{
+				Name:     "at",
+				Metadata: map[string]string{"key": "value"},
+				Nodes:    []*register.Node{{Id: "at-1", Metadata: map[string]string{"zone": "eu-1"}}},
+			},
+		},
+		{
+			name: "over",
+			service: &register.Service{
+				Name:     "over",
+				Metadata: map[string]string{"key": "value"},
+				Nodes:    []*register.Node{{Id: "over-1", Metadata: map[string]string{"zone": "eu-1a"}}},
+			},
+			expected: ErrLimitExceeded,
+		},
+	}
+
+	for _, tc := range testCases {
+		if err := m.Register(ctx, tc.service); err != tc.expected {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.expected, err)
+		}
+	}
+
+	if _, err := m.LookupService(ctx, "over"); err != register.ErrNotFound {
+		t.Fatalf("Expected error: %v, got: %v", register.ErrNotFound, err)
+	}
+}
+
+func TestMemoryNodeDrained(t *testing.T) {
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}, {Id: "foo-2"}}}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	// let the registration events settle before watching
+	time.Sleep(50 * time.Millisecond)
+
+	w, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	drained := func() map[string]string {
+		svcs, err := m.LookupService(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := make(map[string]string)
+		for _, n := range svcs[0].Nodes {
+			res[n.Id] = n.Metadata["drained"]
+		}
+		return res
+	}
+
+	if err := m.SetNodeDrained(register.DefaultDomain, "foo", "1.0.0", "foo-1", true); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Action != "update" || r.Service.Name != "foo" {
+		t.Fatalf("Expected update event for foo, got %s for %s", r.Action, r.Service.Name)
+	}
+
+	if md := drained(); len(md) != 2 || md["foo-1"] != "true" || md["foo-2"] != "" {
+		t.Fatalf("unexpected drained state %v", md)
+	}
+
+	if err := m.SetNodeDrained(register.DefaultDomain, "foo", "1.0.0", "foo-1", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if md := drained(); md["foo-1"] != "" {
+		t.Fatalf("unexpected drained state %v", md)
+	}
+
+	if err := m.SetNodeDrained(register.DefaultDomain, "foo", "1.0.0", "foo-3", true); err != register.ErrNotFound {
+		t.Fatalf("Expected error: %v, got: %v", register.ErrNotFound, err)
+	}
+}
+
+func TestMemoryDefaultDomain(t *testing.T) {
+	m := NewRegister(DefaultDomain("custom"))
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	svcs, err := m.LookupService(ctx, "foo", register.LookupDomain("custom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs) != 1 || svcs[0].Metadata["domain"] != "custom" {
+		t.Fatalf("Expected foo in the custom domain, got %v", svcs)
+	}
+
+	if _, err := m.LookupService(ctx, "foo"); err != nil {
+		t.Fatalf("Expected lookup without domain to use the custom domain, got %v", err)
+	}
+	if svcs, err := m.ListServices(ctx); err != nil || len(svcs) != 1 {
+		t.Fatalf("Expected list without domain to use the custom domain, got %v %v", svcs, err)
+	}
+
+	if err := m.(*memory).SetNodeDrained(register.DefaultDomain, "foo", "1.0.0", "foo-1", true); err != nil {
+		t.Fatalf("Expected drain without domain to use the custom domain, got %v", err)
+	}
+	if err := m.(*memory).SetNodeReady(register.DefaultDomain, "foo", "1.0.0", "foo-1", false); err != nil {
+		t.Fatalf("Expected readiness without domain to use the custom domain, got %v", err)
+	}
+
+	if err := m.Deregister(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.LookupService(ctx, "foo", register.LookupDomain("custom")); err != register.ErrNotFound {
+		t.Fatalf("Expected error: %v, got: %v", register.ErrNotFound, err)
+	}
+}
+
+func TestMemoryOnEvent(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+
+	actions := make(chan string, 10)
+	m := NewRegister(
+		OnEvent(func(r *register.Result) {
+			mu.Lock()
+			calls = append(calls, "first")
+			mu.Unlock()
+		}),
+		OnEvent(func(r *register.Result) {
+			panic("hook failure")
+		}),
+		OnEvent(func(r *register.Result) {
+			mu.Lock()
+			calls = append(calls, "last")
+			mu.Unlock()
+			actions <- r.Action
+		}),
+	)
+	ctx := context.TODO()
+
+	expect := func(action string) {
+		if got := <-actions; got != action {
+			t.Fatalf("Expected %s event, got %s", action, got)
+		}
+	}
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+	expect("create")
+
+	srv.Nodes = append(srv.Nodes, &register.Node{Id: "foo-2"})
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+	expect("update")
+
+	if err := m.Deregister(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+	expect("delete")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != 6 {
+		t.Fatalf("Expected 6 hook calls, got %v", calls)
+	}
+	for i := 0; i < len(calls); i += 2 {
+		if calls[i] != "first" || calls[i+1] != "last" {
+			t.Fatalf("hooks called out of order: %v", calls)
+		}
+	}
+}
+
+func TestMemoryLookupByPrefix(t *testing.T) {
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	for _, srv := range []*register.Service{
+		{Name: "team.payments.api", Version: "1.0.1"},
+		{Name: "team.payments.api", Version: "1.0.0"},
+		{Name: "team.payments", Version: "1.0.0"},
+		{Name: "team.orders.api", Version: "1.0.0"},
+	} {
+		if err := m.Register(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Register(ctx, &register.Service{Name: "team.payments.worker", Version: "1.0.0"}, register.RegisterDomain("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	svcs, err := m.LookupByPrefix(ctx, "team.payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"team.payments:1.0.0", "team.payments.api:1.0.0", "team.payments.api:1.0.1"}
+	if len(svcs) != len(expected) {
+		t.Fatalf("Expected %d services, got %d", len(expected), len(svcs))
+	}
+	for i := range expected {
+		if got := svcs[i].Name + ":" + svcs[i].Version; got != expected[i] {
+			t.Fatalf("Expected ordered results %v, got %v at %d", expected, got, i)
+		}
+	}
+
+	if svcs, err = m.LookupByPrefix(ctx, "team.payments.", register.LookupDomain(register.WildcardDomain)); err != nil {
+		t.Fatal(err)
+	} else if len(svcs) != 3 {
+		t.Fatalf("Expected 3 services, got %d", len(svcs))
+	}
+
+	if _, err = m.LookupByPrefix(ctx, "team.billing"); err != register.ErrNotFound {
+		t.Fatalf("Expected error: %v, got: %v", register.ErrNotFound, err)
+	}
+}
+
+func TestMemoryStaleThreshold(t *testing.T) {
+	m := NewRegister(PruneInterval(10*time.Millisecond), StaleThreshold(0.3))
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, srv, register.RegisterTTL(300*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	// let the registration events settle before watching
+	time.Sleep(30 * time.Millisecond)
+
+	w, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	res := make(chan *register.Result, 10)
+	go func() {
+		for {
+			r, err := w.Next()
+			if err != nil {
+				return
+			}
+			res <- r
+		}
+	}()
+
+	select {
+	case r := <-res:
+		if r.Action != "update" || len(r.Service.Nodes) != 1 || r.Service.Nodes[0].Metadata["stale"] != "true" {
+			t.Fatalf("Expected stale warning, got %s for %v", r.Action, r.Service.Nodes)
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatal("stale warning not received")
+	}
+
+	// the warning fires once, the expiry itself doesn't produce another warning
+	select {
+	case r := <-res:
+		t.Fatalf("unexpected event %s for %s", r.Action, r.Service.Name)
+	case <-time.After(350 * time.Millisecond):
+	}
+}
+
+func TestMemoryClone(t *testing.T) {
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	srv := &register.Service{
+		Name:     "foo",
+		Version:  "1.0.0",
+		Metadata: map[string]string{"key": "value"},
+		Nodes:    []*register.Node{{Id: "foo-1", Metadata: map[string]string{"zone": "eu"}}},
+	}
+	if err := m.Register(ctx, srv, register.RegisterTTL(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	c := m.Clone().(*memory)
+
+	expected, err := c.ExportServices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mutate the original in every possible way
+	m.records[register.DefaultDomain]["foo"]["1.0.0"].Metadata["key"] = "changed"
+	m.records[register.DefaultDomain]["foo"]["1.0.0"].Nodes["foo-1"].Metadata["zone"] = "us"
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-2"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cloned, err := c.ExportServices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, cloned) {
+		t.Fatal("clone changed after mutating the original")
+	}
+
+	n := c.records[register.DefaultDomain]["foo"]["1.0.0"].Nodes["foo-1"]
+	if n.TTL != time.Minute || n.LastSeen.IsZero() {
+		t.Fatalf("clone didn't preserve the TTL state, got %v %v", n.TTL, n.LastSeen)
+	}
+}
+
+func TestMemoryCloneDomainTTLs(t *testing.T) {
+	m := newMemory(register.NewOptions(RemovedHistory(time.Minute)))
+	ctx := context.TODO()
+
+	if err := m.SetDomainTTL("eu", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}, {Id: "foo-2"}}}
+	if err := m.Register(ctx, srv, register.RegisterDomain("eu")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Deregister(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}, register.DeregisterDomain("eu")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := m.Clone().(*memory)
+	defer c.Disconnect(ctx)
+
+	// the clone registers nodes with the domain TTL of its source
+	if err := c.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}}, register.RegisterDomain("eu")); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := c.NodeTTL("eu", "bar", "1.0.0", "bar-1"); err != nil || ttl != time.Minute {
+		t.Fatalf("Expected the clone to apply the domain TTL, got %v, %v", ttl, err)
+	}
+	if err := m.SetDomainTTL("eu", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if c.domainTTLs["eu"] != time.Minute {
+		t.Fatalf("Expected the clone domain TTLs to be independent, got %v", c.domainTTLs["eu"])
+	}
+
+	removed, err := c.RecentlyRemoved("eu", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Id != "foo-1" {
+		t.Fatalf("Expected the clone to keep the removed history, got %+v", removed)
+	}
+}
+
+func TestMemoryCloneIndependentOutputs(t *testing.T) {
+	ctx := context.TODO()
+	wal := &bytes.Buffer{}
+	var hooked, sunk int32
+	m := newMemory(register.NewOptions(
+		WALWriter(wal),
+		OnEvent(func(*register.Result) { atomic.AddInt32(&hooked, 1) }),
+		EventSink(func(context.Context, *register.Result) error {
+			atomic.AddInt32(&sunk, 1)
+			return nil
+		}),
+	))
+
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}); err != nil {
+		t.Fatal(err)
+	}
+	// let the event of the original settle
+	time.Sleep(50 * time.Millisecond)
+	size, hooks, sinks := wal.Len(), atomic.LoadInt32(&hooked), atomic.LoadInt32(&sunk)
+
+	c := m.Clone().(*memory)
+	defer c.Disconnect(ctx)
+	// Init reapplies the options, the shared ones must not come back
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if wal.Len() != size {
+		t.Fatalf("Expected the clone to leave the original WAL unchanged, got %d more bytes", wal.Len()-size)
+	}
+	if atomic.LoadInt32(&hooked) != hooks || atomic.LoadInt32(&sunk) != sinks {
+		t.Fatal("Expected the clone events to skip the original hooks and sink")
+	}
+
+	replayed := newMemory(register.NewOptions())
+	if err := replayed.ReplayWAL(bytes.NewReader(wal.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replayed.LookupService(ctx, "bar"); err != register.ErrNotFound {
+		t.Fatalf("Expected the clone service to be missing from the original WAL, got %v", err)
+	}
+}
+
+func TestMemoryDuplicateAddresses(t *testing.T) {
+	ctx := context.TODO()
+
+	srv := &register.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes:   []*register.Node{{Id: "foo-1", Address: "10.0.0.1:8080"}},
+	}
+	dup := &register.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes:   []*register.Node{{Id: "foo-2", Address: "10.0.0.1:8080"}},
+	}
+
+	strict := NewRegister(DuplicateAddressCheck(true)).(*memory)
+	if err := strict.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+	if err := strict.Register(ctx, dup); err != ErrDuplicateAddress {
+		t.Fatalf("Expected error: %v, got: %v", ErrDuplicateAddress, err)
+	}
+	// refreshing the same node is not a duplicate
+	if err := strict.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewRegister(DuplicateAddressCheck(false)).(*memory)
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(ctx, dup); err != nil {
+		t.Fatal(err)
+	}
+	// the same address in another service is allowed
+	if err := m.Register(ctx, &register.Service{
+		Name:    "bar",
+		Version: "1.0.0",
+		Nodes:   []*register.Node{{Id: "bar-1", Address: "10.0.0.1:8080"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	dups, err := m.DuplicateAddresses(register.DefaultDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{"10.0.0.1:8080": {"foo-1", "foo-2"}}
+	if !reflect.DeepEqual(dups, expected) {
+		t.Fatalf("Expected %v, got %v", expected, dups)
+	}
+
+	if dups, err = strict.DuplicateAddresses(register.WildcardDomain); err != nil {
+		t.Fatal(err)
+	} else if len(dups) != 0 {
+		t.Fatalf("Expected no duplicates, got %v", dups)
+	}
+}
+
+func TestMemoryIdentity(t *testing.T) {
+	m := NewRegister(RequireIdentityKey("spiffe")).(*memory)
+	ctx := context.TODO()
+
+	if err := m.Register(ctx, &register.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes:   []*register.Node{{Id: "foo-1"}},
+	}); err != ErrMissingIdentity {
+		t.Fatalf("Expected error: %v, got: %v", ErrMissingIdentity, err)
+	}
+
+	for _, domain := range []string{"one", "two"} {
+		if err := m.Register(ctx, &register.Service{
+			Name:    "foo",
+			Version: "1.0.0",
+			Nodes: []*register.Node{
+				{Id: "foo-1", Metadata: map[string]string{"spiffe": "spiffe://example.org/foo"}},
+				{Id: "foo-2", Metadata: map[string]string{"spiffe": "spiffe://example.org/other"}},
+			},
+		}, register.RegisterDomain(domain)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	svcs, err := m.LookupByIdentity(ctx, "spiffe://example.org/foo", register.LookupDomain("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs) != 1 || len(svcs[0].Nodes) != 1 || svcs[0].Nodes[0].Id != "foo-1" {
+		t.Fatalf("Expected node foo-1, got %v", svcs)
+	}
+
+	if svcs, err = m.LookupByIdentity(ctx, "spiffe://example.org/foo", register.LookupDomain(register.WildcardDomain)); err != nil {
+		t.Fatal(err)
+	} else if len(svcs) != 2 {
+		t.Fatalf("Expected 2 services, got %d", len(svcs))
+	}
+
+	if _, err = m.LookupByIdentity(ctx, "spiffe://example.org/bar", register.LookupDomain(register.WildcardDomain)); err != register.ErrNotFound {
+		t.Fatalf("Expected error: %v, got: %v", register.ErrNotFound, err)
+	}
+}
+
+func TestMemoryRecentlyRemoved(t *testing.T) {
+	m := NewRegister(PruneInterval(10*time.Millisecond), RemovedHistory(200*time.Millisecond)).(*memory)
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1", Address: "localhost:9999"}}}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+	expiring := &register.Service{Name: "foo", Version: "1.0.1", Nodes: []*register.Node{{Id: "foo-2"}}}
+	if err := m.Register(ctx, expiring, register.RegisterTTL(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Deregister(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	removed, err := m.RecentlyRemoved(register.DefaultDomain, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Fatalf("Expected 2 removed nodes, got %v", removed)
+	}
+	reasons := map[string]string{removed[0].Id: removed[0].Reason, removed[1].Id: removed[1].Reason}
+	if reasons["foo-1"] != "deregister" || reasons["foo-2"] != "expired" {
+		t.Fatalf("unexpected removal reasons %v", reasons)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	if removed, err = m.RecentlyRemoved(register.DefaultDomain, "foo"); err != nil {
+		t.Fatal(err)
+	} else if len(removed) != 0 {
+		t.Fatalf("Expected removed nodes to age out, got %v", removed)
+	}
+}
+
+func TestMemoryAllowedDomains(t *testing.T) {
+	ctx := context.TODO()
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+
+	m := NewRegister(AllowedDomains([]string{"prod"}))
+	if err := m.Register(ctx, srv, register.RegisterDomain("prod")); err != nil {
+		t.Fatalf("Unexpected error registering into allowed domain: %v", err)
+	}
+	if err := m.Register(ctx, srv, register.RegisterDomain("dev")); err != ErrDomainNotAllowed {
+		t.Fatalf("Expected ErrDomainNotAllowed, got %v", err)
+	}
+	if err := m.Register(ctx, srv, register.RegisterDomain(register.WildcardDomain)); err != ErrDomainNotAllowed {
+		t.Fatalf("Expected ErrDomainNotAllowed for the wildcard domain, got %v", err)
+	}
+	if err := m.Deregister(ctx, srv, register.DeregisterDomain("dev")); err != ErrDomainNotAllowed {
+		t.Fatalf("Expected ErrDomainNotAllowed, got %v", err)
+	}
+	if err := m.Deregister(ctx, srv, register.DeregisterDomain("prod")); err != nil {
+		t.Fatalf("Unexpected error deregistering from allowed domain: %v", err)
+	}
+
+	m = NewRegister()
+	if err := m.Register(ctx, srv, register.RegisterDomain("dev")); err != nil {
+		t.Fatalf("Unexpected error registering without restrictions: %v", err)
+	}
+}
+
+func TestMemorySoftMaxServices(t *testing.T) {
+	m := NewRegister(SoftMaxServices(2), MaxServices(3)).(*memory)
+	ctx := context.TODO()
+
+	for i := 0; i < 2; i++ {
+		if err := m.Register(ctx, &register.Service{Name: fmt.Sprintf("foo-%d", i), Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := m.Stats(); stats.QuotaWarning {
+		t.Fatalf("Unexpected quota warning at the soft limit: %+v", stats)
+	}
+
+	srv := &register.Service{Name: "foo-2", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatalf("Expected registration above the soft limit to succeed, got %v", err)
+	}
+	if stats := m.Stats(); !stats.QuotaWarning || stats.Services != 3 || stats.Nodes != 3 {
+		t.Fatalf("Expected quota warning above the soft limit: %+v", stats)
+	}
+
+	if err := m.Register(ctx, &register.Service{Name: "foo-3", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}); err != ErrLimitExceeded {
+		t.Fatalf("Expected ErrLimitExceeded at the hard limit, got %v", err)
+	}
+
+	if err := m.Deregister(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+	if stats := m.Stats(); stats.QuotaWarning {
+		t.Fatalf("Expected quota warning to clear below the soft limit: %+v", stats)
+	}
+}
+
+func TestMemoryRenameDomain(t *testing.T) {
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1", Address: "localhost:9999"}}}
+	if err := m.Register(ctx, srv, register.RegisterDomain("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0"}, register.RegisterDomain("taken")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RenameDomain("old", "taken"); err != ErrDomainExists {
+		t.Fatalf("Expected ErrDomainExists, got %v", err)
+	}
+	if err := m.RenameDomain("missing", "new"); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+
+	// let the register events be dispatched before watching
+	time.Sleep(20 * time.Millisecond)
+
+	oldWatcher, err := m.Watch(ctx, register.WatchDomain("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldWatcher.Stop()
+	newWatcher, err := m.Watch(ctx, register.WatchDomain("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newWatcher.Stop()
+
+	if err := m.RenameDomain("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.LookupService(ctx, "foo", register.LookupDomain("old")); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound in the old domain, got %v", err)
+	}
+	srvs, err := m.LookupService(ctx, "foo", register.LookupDomain("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srvs) != 1 || srvs[0].Metadata["domain"] != "new" || srvs[0].Nodes[0].Metadata["domain"] != "new" {
+		t.Fatalf("Expected the service in the new domain, got %+v", srvs)
+	}
+
+	if r, err := oldWatcher.Next(); err != nil {
+		t.Fatal(err)
+	} else if r.Action != "delete" || r.Service.Name != "foo" {
+		t.Fatalf("Expected delete event for the old domain, got %+v", r)
+	}
+	if r, err := newWatcher.Next(); err != nil {
+		t.Fatal(err)
+	} else if r.Action != "create" || r.Service.Name != "foo" {
+		t.Fatalf("Expected create event for the new domain, got %+v", r)
+	}
+}
+
+func TestMemoryRenameDomainDefaults(t *testing.T) {
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetDomainTTL(register.DefaultDomain, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// the empty name is the default domain
+	if err := m.RenameDomain("", "eu"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.LookupService(ctx, "foo", register.LookupDomain("eu")); err != nil {
+		t.Fatalf("Expected foo in the new domain, got %v", err)
+	}
+
+	m.RLock()
+	ttl, moved := m.domainTTLs["eu"], m.domainTTLs[register.DefaultDomain] == 0
+	m.RUnlock()
+	if ttl != time.Minute || !moved {
+		t.Fatalf("Expected the domain TTL to move to the new domain, got %v", ttl)
+	}
+
+	if err := m.RenameDomain("eu", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.LookupService(ctx, "foo"); err != nil {
+		t.Fatalf("Expected foo back in the default domain, got %v", err)
+	}
+}
+
+func TestMemoryLookupByEndpointMetadata(t *testing.T) {
+	m := NewRegister()
+	ctx := context.TODO()
+
+	testData := []*register.Service{
+		{
+			Name:    "foo",
+			Version: "1.0.0",
+			Endpoints: []*register.Endpoint{
+				{Name: "Foo.Public", Metadata: map[string]string{"auth": "none"}},
+				{Name: "Foo.Private", Metadata: map[string]string{"auth": "required"}},
+			},
+			Nodes: []*register.Node{{Id: "foo-1"}},
+		},
+		{
+			Name:    "foo",
+			Version: "1.0.1",
+			Endpoints: []*register.Endpoint{
+				{Name: "Foo.Public", Metadata: map[string]string{"auth": "none"}},
+			},
+			Nodes: []*register.Node{{Id: "foo-2"}},
+		},
+	}
+	for _, srv := range testData {
+		if err := m.Register(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srvs, err := m.LookupService(ctx, "foo", ByEndpointMetadata(map[string]string{"auth": "required"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srvs) != 1 || srvs[0].Version != "1.0.0" {
+		t.Fatalf("Expected only version 1.0.0, got %+v", srvs)
+	}
+	if len(srvs[0].Endpoints) != 1 || srvs[0].Endpoints[0].Name != "Foo.Private" {
+		t.Fatalf("Expected only the Foo.Private endpoint, got %+v", srvs[0].Endpoints)
+	}
+
+	if srvs, err = m.LookupService(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	} else if len(srvs) != 2 {
+		t.Fatalf("Expected unfiltered lookup to return 2 services, got %d", len(srvs))
+	}
+
+	if _, err := m.LookupService(ctx, "foo", ByEndpointMetadata(map[string]string{"auth": "mtls"})); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMemoryFingerprint(t *testing.T) {
+	ctx := context.TODO()
+	newService := func() *register.Service {
+		return &register.Service{
+			Name:      "foo",
+			Version:   "1.0.0",
+			Metadata:  map[string]string{"a": "1", "b": "2", "c": "3"},
+			Endpoints: []*register.Endpoint{{Name: "Foo.Call"}, {Name: "Foo.Stream"}},
+			Nodes: []*register.Node{
+				{Id: "foo-1", Address: "localhost:9999", Metadata: map[string]string{"x": "1", "y": "2"}},
+				{Id: "foo-2", Address: "localhost:6666"},
+			},
+		}
+	}
+
+	m1 := NewRegister().(*memory)
+	m2 := NewRegister().(*memory)
+	if err := m1.Register(ctx, newService()); err != nil {
+		t.Fatal(err)
+	}
+	// register the nodes in another order into the second register
+	srv := newService()
+	srv.Nodes[0], srv.Nodes[1] = srv.Nodes[1], srv.Nodes[0]
+	srv.Endpoints[0], srv.Endpoints[1] = srv.Endpoints[1], srv.Endpoints[0]
+	if err := m2.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	fp1, err := m1.Fingerprint(ctx, "foo", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		fp, err := m1.Fingerprint(ctx, "foo", "1.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fp != fp1 {
+			t.Fatalf("Expected a stable fingerprint, got %s and %s", fp1, fp)
+		}
+	}
+	fp2, err := m2.Fingerprint(ctx, "foo", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp1 != fp2 {
+		t.Fatalf("Expected equal fingerprints across registers, got %s and %s", fp1, fp2)
+	}
+
+	if err := m2.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-3"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if fp2, err = m2.Fingerprint(ctx, "foo", "1.0.0"); err != nil {
+		t.Fatal(err)
+	} else if fp1 == fp2 {
+		t.Fatal("Expected the fingerprint to change with the nodes")
+	}
+
+	if _, err := m1.Fingerprint(ctx, "foo", "2.0.0"); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMemoryNormalizeMetadataKeys(t *testing.T) {
+	m := NewRegister(NormalizeMetadataKeys(true))
+	ctx := context.TODO()
+
+	testData := []*register.Service{
+		{Name: "foo", Version: "1.0.0", Metadata: map[string]string{"Region": "eu"}, Nodes: []*register.Node{{Id: "foo-1", Metadata: map[string]string{"ZONE": "a"}}}},
+		{Name: "bar", Version: "1.0.0", Metadata: map[string]string{"REGION": "eu"}},
+		{Name: "baz", Version: "1.0.0", Metadata: map[string]string{"region": "us"}},
+	}
+	for _, srv := range testData {
+		if err := m.Register(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, key := range []string{"region", "Region", "REGION"} {
+		srvs, err := m.ListServices(ctx, ListMetadata(key, "eu"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(srvs) != 2 {
+			t.Fatalf("Expected 2 services for key %s, got %d", key, len(srvs))
+		}
+	}
+
+	srvs, err := m.LookupService(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := srvs[0].Nodes[0].Metadata["zone"]; v != "a" {
+		t.Fatalf("Expected normalized node metadata key, got %v", srvs[0].Nodes[0].Metadata)
+	}
+
+	m = NewRegister()
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Metadata: map[string]string{"Region": "eu"}}); err != nil {
+		t.Fatal(err)
+	}
+	if srvs, err := m.ListServices(ctx, ListMetadata("region", "eu")); err != nil {
+		t.Fatal(err)
+	} else if len(srvs) != 0 {
+		t.Fatalf("Expected keys to keep their casing by default, got %d services", len(srvs))
+	}
+}
+
+func TestMemoryConsistentWildcardReads(t *testing.T) {
+	m := NewRegister(ConsistentWildcardReads(true)).(*memory)
+	ctx := context.TODO()
+
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}, register.RegisterDomain("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		from, to := "a", "b"
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := m.RenameDomain(from, to); err != nil {
+				t.Error(err)
+				return
+			}
+			from, to = to, from
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		srvs, err := m.ListServices(ctx, register.ListDomain(register.WildcardDomain))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(srvs) != 1 {
+			t.Fatalf("Expected exactly one service, got %d", len(srvs))
+		}
+		if srvs, err = m.LookupService(ctx, "foo", register.LookupDomain(register.WildcardDomain)); err != nil {
+			t.Fatal(err)
+		} else if len(srvs) != 1 {
+			t.Fatalf("Expected exactly one service, got %d", len(srvs))
+		}
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+func TestMemorySetNodeReady(t *testing.T) {
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	srv := &register.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes: []*register.Node{
+			{Id: "foo-1", Address: "localhost:9999", Metadata: map[string]string{"ready": "false"}},
+		},
+	}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.LookupService(ctx, "foo", OnlyHealthy()); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound while the node isn't ready, got %v", err)
+	}
+	if _, err := m.SelectNode(ctx, "foo"); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound while the node isn't ready, got %v", err)
+	}
+	if srvs, err := m.LookupService(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	} else if len(srvs[0].Nodes) != 1 {
+		t.Fatalf("Expected the node to be present, got %+v", srvs[0].Nodes)
+	}
+
+	// let the register events be dispatched before watching
+	time.Sleep(20 * time.Millisecond)
+
+	w, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	if err := m.SetNodeReady(register.DefaultDomain, "foo", "1.0.0", "foo-1", true); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Action != "update" || r.Service.Nodes[0].Metadata["ready"] != "true" {
+		t.Fatalf("Expected update event with the ready node, got %+v", r)
+	}
+
+	n, err := m.SelectNode(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Id != "foo-1" {
+		t.Fatalf("Expected node foo-1, got %s", n.Id)
+	}
+
+	if err := m.SetNodeDrained(register.DefaultDomain, "foo", "1.0.0", "foo-1", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.SelectNode(ctx, "foo"); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for a drained node, got %v", err)
+	}
+
+	if err := m.SetNodeReady(register.DefaultDomain, "foo", "1.0.0", "foo-2", true); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for an unknown node, got %v", err)
+	}
+}
+
+func TestMemoryNodeAges(t *testing.T) {
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	oldest, newest, err := m.NodeAges(register.DefaultDomain, "foo", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldest != newest {
+		t.Fatalf("Expected equal ages for a single node, got %v and %v", oldest, newest)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-2"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if oldest, newest, err = m.NodeAges(register.DefaultDomain, "foo", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if oldest < 50*time.Millisecond {
+		t.Fatalf("Expected the oldest node to be at least 50ms old, got %v", oldest)
+	}
+	if newest >= 50*time.Millisecond {
+		t.Fatalf("Expected the newest node to be under 50ms old, got %v", newest)
+	}
+
+	if _, _, err := m.NodeAges(register.DefaultDomain, "bar", "1.0.0"); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMemoryUniqueNodeVersions(t *testing.T) {
+	m := NewRegister(UniqueNodeVersions(true))
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+	// refreshing the same version is allowed
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatalf("Unexpected error refreshing the node: %v", err)
+	}
+
+	err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.1", Nodes: []*register.Node{{Id: "foo-1"}}})
+	if !errors.Is(err, ErrNodeConflict) {
+		t.Fatalf("Expected ErrNodeConflict, got %v", err)
+	}
+	if srvs, err := m.LookupService(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	} else if len(srvs) != 1 {
+		t.Fatalf("Expected the conflicting version not to be registered, got %d versions", len(srvs))
+	}
+
+	// other services and domains may reuse the node id
+	if err := m.Register(ctx, &register.Service{Name: "bar", Version: "1.0.1", Nodes: []*register.Node{{Id: "foo-1"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.1", Nodes: []*register.Node{{Id: "foo-1"}}}, register.RegisterDomain("other")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryPeakNodes(t *testing.T) {
+	bucket := peakBucketTime
+	peakBucketTime = 50 * time.Millisecond
+	defer func() { peakBucketTime = bucket }()
+
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	nodes := []*register.Node{{Id: "foo-1"}, {Id: "foo-2"}, {Id: "foo-3"}}
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: nodes}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Deregister(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: nodes[1:]}); err != nil {
+		t.Fatal(err)
+	}
+
+	peak, err := m.PeakNodes(register.DefaultDomain, "foo", "1.0.0", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peak != 3 {
+		t.Fatalf("Expected a peak of 3 nodes, got %d", peak)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	// the peak is outside of the window, the current count carries in
+	if peak, err = m.PeakNodes(register.DefaultDomain, "foo", "1.0.0", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	} else if peak != 1 {
+		t.Fatalf("Expected a peak of 1 node, got %d", peak)
+	}
+	if peak, err = m.PeakNodes(register.DefaultDomain, "foo", "1.0.0", time.Second); err != nil {
+		t.Fatal(err)
+	} else if peak != 3 {
+		t.Fatalf("Expected a peak of 3 nodes, got %d", peak)
+	}
+
+	if _, err := m.PeakNodes(register.DefaultDomain, "bar", "1.0.0", time.Second); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMemoryDeregisterService(t *testing.T) {
+	m := NewRegister()
+	ctx := context.TODO()
+
+	for _, domain := range []string{"a", "b"} {
+		for _, version := range []string{"1.0.0", "1.0.1", "2.0.0"} {
+			srv := &register.Service{Name: "foo", Version: version, Nodes: []*register.Node{{Id: "foo-" + version}}}
+			if err := m.Register(ctx, srv, register.RegisterDomain(domain)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := m.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0"}, register.RegisterDomain(domain)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := m.(*memory).DeregisterService(ctx, "a", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.LookupService(ctx, "foo", register.LookupDomain("a")); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound in domain a, got %v", err)
+	}
+	if srvs, err := m.LookupService(ctx, "foo", register.LookupDomain("b")); err != nil {
+		t.Fatal(err)
+	} else if len(srvs) != 3 {
+		t.Fatalf("Expected 3 versions in domain b, got %d", len(srvs))
+	}
+	if err := m.(*memory).DeregisterService(ctx, "a", "foo"); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+
+	if err := m.(*memory).DeregisterService(ctx, register.WildcardDomain, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.LookupService(ctx, "foo", register.LookupDomain(register.WildcardDomain)); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound everywhere, got %v", err)
+	}
+	if srvs, err := m.ListServices(ctx, register.ListDomain(register.WildcardDomain)); err != nil {
+		t.Fatal(err)
+	} else if len(srvs) != 2 {
+		t.Fatalf("Expected the bar services to remain, got %d services", len(srvs))
+	}
+}
+
+func TestMemoryEventSink(t *testing.T) {
+	events := make(chan *register.Result, 10)
+	m := NewRegister(EventSink(func(ctx context.Context, r *register.Result) error {
+		events <- r
+		return nil
+	}))
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-events:
+		if r.Action != "create" || r.Service.Name != "foo" {
+			t.Fatalf("Expected create event for foo, got %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the sink to receive the event")
+	}
+}
+
+func TestMemoryEventSinkRetries(t *testing.T) {
+	attempts := make(chan struct{}, 10)
+	m := NewRegister(
+		EventSink(func(ctx context.Context, r *register.Result) error {
+			attempts <- struct{}{}
+			return errors.New("bus unavailable")
+		}),
+		EventSinkRetries(2),
+	).(*memory)
+
+	m.sendEvent(&register.Result{Action: "create", Service: &register.Service{Name: "foo"}})
+
+	if n := len(attempts); n != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", n)
+	}
+}
+
+func TestMemoryEventSinkOrdered(t *testing.T) {
+	var inflight, overlaps int32
+	events := make(chan string, 20)
+	m := NewRegister(EventSink(func(ctx context.Context, r *register.Result) error {
+		if atomic.AddInt32(&inflight, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&inflight, -1)
+		events <- r.Service.Name
+		return nil
+	}))
+	ctx := context.TODO()
+
+	var names []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("foo-%d", i)
+		names = append(names, name)
+		if err := m.Register(ctx, &register.Service{Name: name, Version: "1.0.0"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range names {
+		select {
+		case got := <-events:
+			if got != name {
+				t.Fatalf("Expected the sink to receive %s, got %s", name, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the sink to receive %s", name)
+		}
+	}
+	if n := atomic.LoadInt32(&overlaps); n != 0 {
+		t.Fatalf("Expected the sink calls not to overlap, got %d", n)
+	}
+}
+
+func TestMemoryPreferZone(t *testing.T) {
+	m := NewRegister()
+	ctx := context.TODO()
+
+	srv := &register.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes: []*register.Node{
+			{Id: "foo-1", Metadata: map[string]string{"zone": "a"}},
+			{Id: "foo-2", Metadata: map[string]string{"zone": "b"}},
+			{Id: "foo-3", Metadata: map[string]string{"zone": "a"}},
+			{Id: "foo-4", Metadata: map[string]string{"zone": "c"}},
+			{Id: "foo-5"},
+		},
+	}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		srvs, err := m.LookupService(ctx, "foo", PreferZone("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes := srvs[0].Nodes
+		if len(nodes) != 5 {
+			t.Fatalf("Expected all 5 nodes, got %d", len(nodes))
+		}
+		for j, n := range nodes {
+			if sameZone := n.Metadata["zone"] == "a"; sameZone != (j < 2) {
+				t.Fatalf("Expected the zone a nodes first, got %s at %d", n.Id, j)
+			}
+		}
+	}
+}
+
+func TestMemoryFlattenVersions(t *testing.T) {
+	m := NewRegister()
+	ctx := context.TODO()
+
+	testData := []*register.Service{
+		{
+			Name:      "foo",
+			Version:   "1.0.1",
+			Endpoints: []*register.Endpoint{{Name: "Foo.Call"}, {Name: "Foo.Stream"}},
+			Nodes:     []*register.Node{{Id: "foo-2"}, {Id: "foo-3"}},
+		},
+		{
+			Name:      "foo",
+			Version:   "1.0.0",
+			Endpoints: []*register.Endpoint{{Name: "Foo.Call"}},
+			Nodes:     []*register.Node{{Id: "foo-1"}, {Id: "foo-2"}},
+		},
+	}
+	for _, srv := range testData {
+		if err := m.Register(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srvs, err := m.LookupService(ctx, "foo", FlattenVersions(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srvs) != 1 {
+		t.Fatalf("Expected a single service, got %d", len(srvs))
+	}
+	srv := srvs[0]
+	if srv.Version != "1.0.0,1.0.1" {
+		t.Fatalf("Expected the composite version, got %s", srv.Version)
+	}
+
+	ids := make(map[string]bool)
+	for _, n := range srv.Nodes {
+		ids[n.Id] = true
+	}
+	if len(srv.Nodes) != 3 || !ids["foo-1"] || !ids["foo-2"] || !ids["foo-3"] {
+		t.Fatalf("Expected the deduplicated nodes foo-1, foo-2 and foo-3, got %+v", srv.Nodes)
+	}
+	if len(srv.Endpoints) != 2 {
+		t.Fatalf("Expected 2 merged endpoints, got %d", len(srv.Endpoints))
+	}
+
+	if srvs, err = m.LookupService(ctx, "foo", FlattenVersions(false)); err != nil {
+		t.Fatal(err)
+	} else if len(srvs) != 2 {
+		t.Fatalf("Expected 2 versions without flattening, got %d", len(srvs))
+	}
+}
+
+func TestMemoryFlattenNamePattern(t *testing.T) {
+	m := NewRegister()
+	ctx := context.TODO()
+
+	testData := []struct {
+		srv    *register.Service
+		domain string
+	}{
+		{&register.Service{Name: "payments.a", Version: "1.0.0", Nodes: []*register.Node{{Id: "a-1"}}}, "eu"},
+		{&register.Service{Name: "payments.a", Version: "2.0.0", Nodes: []*register.Node{{Id: "a-2"}}}, "eu"},
+		{&register.Service{Name: "payments.b", Version: "1.0.0", Nodes: []*register.Node{{Id: "b-1"}}}, "eu"},
+		{&register.Service{Name: "payments.a", Version: "1.0.0", Nodes: []*register.Node{{Id: "a-3"}}}, "us"},
+	}
+	for _, tt := range testData {
+		if err := m.Register(ctx, tt.srv, register.RegisterDomain(tt.domain)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flattened := func(srvs []*register.Service) []string {
+		var result []string
+		for _, s := range srvs {
+			var ids []string
+			for _, n := range s.Nodes {
+				ids = append(ids, n.Id)
+			}
+			sort.Strings(ids)
+			result = append(result, s.Metadata["domain"]+"/"+s.Name+"@"+s.Version+":"+strings.Join(ids, ","))
+		}
+		return result
+	}
+
+	srvs, err := m.LookupService(ctx, "", register.LookupDomain("eu"), NamePattern("payments.*"), FlattenVersions(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"eu/payments.a@1.0.0,2.0.0:a-1,a-2", "eu/payments.b@1.0.0:b-1"}; !reflect.DeepEqual(flattened(srvs), expect) {
+		t.Fatalf("Expected %v, got %v", expect, flattened(srvs))
+	}
+
+	srvs, err = m.LookupService(ctx, "", register.LookupDomain(register.WildcardDomain), NamePattern("payments.*"), FlattenVersions(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"eu/payments.a@1.0.0,2.0.0:a-1,a-2", "us/payments.a@1.0.0:a-3", "eu/payments.b@1.0.0:b-1"}; !reflect.DeepEqual(flattened(srvs), expect) {
+		t.Fatalf("Expected %v, got %v", expect, flattened(srvs))
+	}
+
+	srvs, err = m.LookupService(ctx, "", register.LookupDomain(register.WildcardDomain), NamePattern("payments.*"), MergeDomains(true), FlattenVersions(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"eu/payments.a@1.0.0,2.0.0:a-1,a-2,a-3", "eu/payments.b@1.0.0:b-1"}; !reflect.DeepEqual(flattened(srvs), expect) {
+		t.Fatalf("Expected %v, got %v", expect, flattened(srvs))
+	}
+	if srvs[0].Metadata["domains"] != "eu,us" {
+		t.Fatalf("Expected the merged domains eu,us, got %q", srvs[0].Metadata["domains"])
+	}
+}
+
+func TestMemoryMergeDomains(t *testing.T) {
+	m := NewRegister()
+	ctx := context.TODO()
+
+	for i, domain := range []string{"gamma", "alpha", "beta"} {
+		srv := &register.Service{
+			Name:    "foo",
+			Version: "1.0.0",
+			Nodes:   []*register.Node{{Id: fmt.Sprintf("foo-%d", i)}},
+		}
+		if err := m.Register(ctx, srv, register.RegisterDomain(domain)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srvs, err := m.LookupService(ctx, "foo", register.LookupDomain(register.WildcardDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srvs) != 3 {
+		t.Fatalf("Expected a service per domain without merging, got %d", len(srvs))
+	}
+
+	srvs, err = m.LookupService(ctx, "foo", register.LookupDomain(register.WildcardDomain), MergeDomains(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srvs) != 1 {
+		t.Fatalf("Expected a single merged service, got %d", len(srvs))
+	}
+	srv := srvs[0]
+	if srv.Metadata["domains"] != "alpha,beta,gamma" {
+		t.Fatalf("Expected the domains alpha,beta,gamma, got %q", srv.Metadata["domains"])
+	}
+	if srv.Metadata["domain"] != "alpha" {
+		t.Fatalf("Expected the first domain alpha, got %q", srv.Metadata["domain"])
+	}
+	if srv.Version != "1.0.0" || len(srv.Nodes) != 3 {
+		t.Fatalf("Expected version 1.0.0 with 3 nodes, got %s with %d", srv.Version, len(srv.Nodes))
+	}
+
+	srvs, err = m.LookupService(ctx, "foo", register.LookupDomain(register.WildcardDomain), MergeDomains(true), FlattenVersions(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srvs) != 1 || srvs[0].Metadata["domains"] != "alpha,beta,gamma" {
+		t.Fatalf("Expected the flattened service to carry the domains, got %+v", srvs)
+	}
+}
+
+func TestMemoryRefreshOnlyReady(t *testing.T) {
+	m := NewRegister(RefreshOnlyReady(true), PruneInterval(10*time.Millisecond), RemovedHistory(time.Minute)).(*memory)
+	ctx := context.TODO()
+
+	ready := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1", Metadata: map[string]string{"ready": "true"}}}}
+	stuck := &register.Service{Name: "foo", Version: "1.0.1", Nodes: []*register.Node{{Id: "foo-2", Metadata: map[string]string{"ready": "false"}}}}
+
+	// heartbeat both nodes past their TTL
+	for i := 0; i < 10; i++ {
+		for _, srv := range []*register.Service{ready, stuck} {
+			if err := m.Register(ctx, srv, register.RegisterTTL(50*time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	removed, err := m.RecentlyRemoved(register.DefaultDomain, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) == 0 {
+		t.Fatal("Expected the not ready node to expire")
+	}
+	for _, n := range removed {
+		if n.Id != "foo-2" || n.Reason != "expired" {
+			t.Fatalf("Expected only the not ready node to expire, got %+v", n)
+		}
+	}
+}
+
+func TestMemoryDump(t *testing.T) {
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	testData := map[string][]*register.Service{
+		"a": {
+			{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}},
+			{Name: "foo", Version: "1.0.1", Nodes: []*register.Node{{Id: "foo-2"}}},
+		},
+		"b": {
+			{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}},
+		},
+	}
+	for domain, srvs := range testData {
+		for _, srv := range srvs {
+			if err := m.Register(ctx, srv, register.RegisterDomain(domain)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	dump, err := m.Dump(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dump) != 2 {
+		t.Fatalf("Expected 2 domains, got %d", len(dump))
+	}
+	for domain, srvs := range testData {
+		if len(dump[domain]) != len(srvs) {
+			t.Fatalf("Expected %d services in domain %s, got %d", len(srvs), domain, len(dump[domain]))
+		}
+		for i, srv := range dump[domain] {
+			if srv.Name != srvs[i].Name || srv.Version != srvs[i].Version || srv.Metadata["domain"] != domain {
+				t.Fatalf("Expected %s %s in domain %s, got %+v", srvs[i].Name, srvs[i].Version, domain, srv)
+			}
+		}
+	}
+
+	// the dump is a copy
+	dump["a"][0].Nodes[0].Metadata["changed"] = "true"
+	srvs, err := m.LookupService(ctx, "foo", register.LookupDomain("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, srv := range srvs {
+		if _, ok := srv.Nodes[0].Metadata["changed"]; ok {
+			t.Fatal("Expected the dump not to share the register state")
+		}
+	}
+}
+
+func TestMemoryConsistentHash(t *testing.T) {
+	m := NewRegister()
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0"}
+	for i := 0; i < 10; i++ {
+		srv.Nodes = append(srv.Nodes, &register.Node{Id: fmt.Sprintf("foo-%d", i)})
+	}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	order := func(key string) []string {
+		srvs, err := m.LookupService(ctx, "foo", ConsistentHash(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, 0, len(srvs[0].Nodes))
+		for _, n := range srvs[0].Nodes {
+			ids = append(ids, n.Id)
+		}
+		return ids
+	}
+
+	first := order("client-a")
+	for i := 0; i < 10; i++ {
+		if ids := order("client-a"); !reflect.DeepEqual(ids, first) {
+			t.Fatalf("Expected a stable order %v, got %v", first, ids)
+		}
+	}
+
+	// other keys spread the first node over the ring
+	firsts := map[string]bool{first[0]: true}
+	for i := 0; i < 20; i++ {
+		firsts[order(fmt.Sprintf("client-%d", i))[0]] = true
+	}
+	if len(firsts) < 2 {
+		t.Fatalf("Expected different keys to redistribute the nodes, got %v", firsts)
+	}
+}
+
+func TestMemoryStatic(t *testing.T) {
+	m := NewRegister(PruneInterval(10 * time.Millisecond))
+	ctx := context.TODO()
+
+	static := &register.Service{Name: "db", Version: "1.0.0", Nodes: []*register.Node{{Id: "db-1", Address: "10.0.0.1:5432"}}}
+	if err := m.Register(ctx, static, register.RegisterTTL(10*time.Millisecond), Static(true)); err != nil {
+		t.Fatal(err)
+	}
+	expiring := &register.Service{Name: "db", Version: "1.0.0", Nodes: []*register.Node{{Id: "db-2", Address: "10.0.0.2:5432"}}}
+	if err := m.Register(ctx, expiring, register.RegisterTTL(10*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	srvs, err := m.LookupService(ctx, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srvs[0].Nodes) != 1 || srvs[0].Nodes[0].Id != "db-1" {
+		t.Fatalf("Expected only the static node to survive the prune, got %+v", srvs[0].Nodes)
+	}
+
+	if err := m.Deregister(ctx, static); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.LookupService(ctx, "db"); err != register.ErrNotFound {
+		t.Fatalf("Expected the static node to be deregistered, got %v", err)
+	}
+}
+
+func TestMemoryPromoteVersion(t *testing.T) {
+	m := NewRegister(IndexMetadata("primary")).(*memory)
+	ctx := context.TODO()
+
+	for _, version := range []string{"1.0.0", "2.0.0", "3.0.0"} {
+		if err := m.Register(ctx, &register.Service{Name: "foo", Version: version, Nodes: []*register.Node{{Id: "foo-" + version}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	primaries := func() []string {
+		srvs, err := m.LookupService(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var versions []string
+		for _, srv := range srvs {
+			if srv.Metadata["primary"] == "true" {
+				versions = append(versions, srv.Version)
+			}
+		}
+		return versions
+	}
+
+	for _, version := range []string{"1.0.0", "2.0.0", "2.0.0", "3.0.0"} {
+		if err := m.PromoteVersion(register.DefaultDomain, "foo", version); err != nil {
+			t.Fatal(err)
+		}
+		if versions := primaries(); len(versions) != 1 || versions[0] != version {
+			t.Fatalf("Expected %s as the only primary version, got %v", version, versions)
+		}
+
+		// the index follows the promotion
+		srvs, err := m.ListServices(ctx, ListMetadata("primary", "true"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(srvs) != 1 || srvs[0].Version != version {
+			t.Fatalf("Expected the indexed primary %s, got %+v", version, srvs)
+		}
+	}
+
+	if err := m.PromoteVersion(register.DefaultDomain, "foo", "4.0.0"); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	if versions := primaries(); len(versions) != 1 || versions[0] != "3.0.0" {
+		t.Fatalf("Expected the primary to be unchanged, got %v", versions)
+	}
+}
+
+func TestMemoryPrimaryOnly(t *testing.T) {
+	m := newMemory(register.NewOptions())
+	ctx := context.TODO()
+
+	for _, version := range []string{"1.0.0", "2.0.0", "3.0.0"} {
+		if err := m.Register(ctx, &register.Service{Name: "foo", Version: version, Nodes: []*register.Node{{Id: "foo-" + version}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// without a primary version all the versions are returned
+	srvs, err := m.LookupService(ctx, "foo", PrimaryOnly(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srvs) != 3 {
+		t.Fatalf("Expected all 3 versions without a primary, got %d", len(srvs))
+	}
+
+	if err := m.PromoteVersion(register.DefaultDomain, "foo", "2.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if srvs, err = m.LookupService(ctx, "foo", PrimaryOnly(true)); err != nil {
+		t.Fatal(err)
+	}
+	if len(srvs) != 1 || srvs[0].Version != "2.0.0" {
+		t.Fatalf("Expected only the primary version 2.0.0, got %+v", srvs)
+	}
+
+	if srvs, err = m.LookupService(ctx, "foo", PrimaryOnly(false)); err != nil {
+		t.Fatal(err)
+	} else if len(srvs) != 3 {
+		t.Fatalf("Expected all 3 versions without the option, got %d", len(srvs))
+	}
+}
+
+func TestMemoryActiveOnly(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := NewRegister(Clock(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}))
+	ctx := context.TODO()
+
+	testData := []*register.Service{
+		{Name: "day", Version: "1.0.0", Metadata: map[string]string{"availability": "09:00-17:00"}, Nodes: []*register.Node{{Id: "day-1"}}},
+		{Name: "night", Version: "1.0.0", Metadata: map[string]string{"availability": "22:00-06:00"}, Nodes: []*register.Node{{Id: "night-1"}}},
+		{Name: "always", Version: "1.0.0", Nodes: []*register.Node{
+			{Id: "always-1"},
+			{Id: "always-2", Metadata: map[string]string{"availability": "13:00-14:00"}},
+		}},
+	}
+	for _, srv := range testData {
+		if err := m.Register(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := m.LookupService(ctx, "day", ActiveOnly(true)); err != nil {
+		t.Fatalf("Expected the day service inside its window, got %v", err)
+	}
+	if _, err := m.LookupService(ctx, "night", ActiveOnly(true)); err != register.ErrNotFound {
+		t.Fatalf("Expected the night service outside its window, got %v", err)
+	}
+	if _, err := m.LookupService(ctx, "night"); err != nil {
+		t.Fatalf("Expected the night service without ActiveOnly, got %v", err)
+	}
+	srvs, err := m.LookupService(ctx, "always", ActiveOnly(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srvs[0].Nodes) != 1 || srvs[0].Nodes[0].Id != "always-1" {
+		t.Fatalf("Expected only the node inside its window, got %+v", srvs[0].Nodes)
+	}
+
+	if srvs, err = m.ListServices(ctx, ListActiveOnly(true)); err != nil {
+		t.Fatal(err)
+	} else if len(srvs) != 2 {
+		t.Fatalf("Expected 2 active services, got %d", len(srvs))
+	}
+
+	// the window wraps around midnight
+	mu.Lock()
+	now = time.Date(2021, 1, 1, 23, 0, 0, 0, time.UTC)
+	mu.Unlock()
+	if _, err := m.LookupService(ctx, "night", ActiveOnly(true)); err != nil {
+		t.Fatalf("Expected the night service inside its window, got %v", err)
+	}
+	if _, err := m.LookupService(ctx, "day", ActiveOnly(true)); err != register.ErrNotFound {
+		t.Fatalf("Expected the day service outside its window, got %v", err)
+	}
+}
+
+func TestMemoryTouchAll(t *testing.T) {
+	m := NewRegister(PruneInterval(10 * time.Millisecond)).(*memory)
+	ctx := context.TODO()
+
+	for _, domain := range []string{"a", "b"} {
+		srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}, {Id: "foo-2"}}}
+		if err := m.Register(ctx, srv, register.RegisterDomain(domain), register.RegisterTTL(100*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// keep the nodes alive past their TTL without heartbeats
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		count, err := m.TouchAll(register.WildcardDomain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 4 {
+			t.Fatalf("Expected 4 touched nodes, got %d", count)
+		}
+	}
+
+	for _, domain := range []string{"a", "b"} {
+		srvs, err := m.LookupService(ctx, "foo", register.LookupDomain(domain))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(srvs[0].Nodes) != 2 {
+			t.Fatalf("Expected the touched nodes to survive in domain %s, got %d", domain, len(srvs[0].Nodes))
+		}
+	}
+
+	if count, err := m.TouchAll("a"); err != nil || count != 2 {
+		t.Fatalf("Expected 2 touched nodes in domain a, got %d, %v", count, err)
+	}
+	if _, err := m.TouchAll("missing"); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+type captureLogger struct {
+	logger.Logger
+	level logger.Level
+	sync.Mutex
+	lines  []string
+	fields bool
+}
+
+func (l *captureLogger) V(level logger.Level) bool { return level >= l.level }
+
+func (l *captureLogger) Fields(map[string]interface{}) logger.Logger {
+	l.Lock()
+	l.fields = true
+	l.Unlock()
+	return l
+}
+
+func (l *captureLogger) Logf(ctx context.Context, level logger.Level, msg string, args ...interface{}) {
+	l.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(msg, args...))
+	l.Unlock()
+}
+
+func (l *captureLogger) Tracef(ctx context.Context, msg string, args ...interface{}) {
+	l.Logf(ctx, logger.TraceLevel, msg, args...)
+}
+
+func (l *captureLogger) Debugf(ctx context.Context, msg string, args ...interface{}) {
+	l.Logf(ctx, logger.DebugLevel, msg, args...)
+}
+
+func (l *captureLogger) Infof(ctx context.Context, msg string, args ...interface{}) {
+	l.Logf(ctx, logger.InfoLevel, msg, args...)
+}
+
+func (l *captureLogger) Warnf(ctx context.Context, msg string, args ...interface{}) {
+	l.Logf(ctx, logger.WarnLevel, msg, args...)
+}
+
+func (l *captureLogger) Errorf(ctx context.Context, msg string, args ...interface{}) {
+	l.Logf(ctx, logger.ErrorLevel, msg, args...)
+}
+
+func TestMemoryLogFields(t *testing.T) {
+	m := newMemory(register.NewOptions())
+	l := &captureLogger{level: logger.DebugLevel}
+	m.Init(register.Logger(l))
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, srv, register.RegisterDomain("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Deregister(ctx, srv, register.DeregisterDomain("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		"Register added new service action=create domain=a service=foo version=1.0.0",
+		"Register removed node from service action=deregister domain=a node=foo-1 service=foo version=1.0.0",
+		"Register removed service action=delete domain=a service=foo version=1.0.0",
+	}
+	if !reflect.DeepEqual(l.lines, expect) {
+		t.Fatalf("Expected log lines %v, got %v", expect, l.lines)
+	}
+	if l.fields {
+		t.Fatal("Expected the shared logger fields to be left untouched")
+	}
+
+	// lines below the logger level are not formatted
+	l.level = logger.InfoLevel
+	l.lines = nil
+	if err := m.Register(ctx, srv, register.RegisterDomain("a")); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.lines) != 0 {
+		t.Fatalf("Expected no log lines, got %v", l.lines)
+	}
+}
+
+func TestMemoryDanglingServices(t *testing.T) {
+	m := newMemory(register.NewOptions())
+	ctx := context.TODO()
+
+	services := []struct {
+		srv    *register.Service
+		domain string
+		opts   []register.RegisterOption
+	}{
+		{&register.Service{Name: "expired", Version: "1.0.0", Nodes: []*register.Node{{Id: "expired-1"}}}, "a", []register.RegisterOption{register.RegisterTTL(10 * time.Millisecond)}},
+		{&register.Service{Name: "unready", Version: "1.0.0", Nodes: []*register.Node{{Id: "unready-1", Metadata: map[string]string{"ready": "false"}}}}, "a", nil},
+		{&register.Service{Name: "drained", Version: "1.0.0", Nodes: []*register.Node{{Id: "drained-1"}}}, "b", nil},
+		{&register.Service{Name: "healthy", Version: "1.0.0", Nodes: []*register.Node{{Id: "healthy-1"}, {Id: "healthy-2", Metadata: map[string]string{"ready": "false"}}}}, "b", nil},
+	}
+	for _, s := range services {
+		if err := m.Register(ctx, s.srv, append(s.opts, register.RegisterDomain(s.domain))...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.SetNodeDrained("b", "drained", "1.0.0", "drained-1", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pruner isn't running so the expired node stays registered
+	time.Sleep(20 * time.Millisecond)
+
+	names := func(srvs []*register.Service) []string {
+		var result []string
+		for _, s := range srvs {
+			result = append(result, s.Metadata["domain"]+"/"+s.Name)
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	srvs, err := m.DanglingServices(ctx, register.ListDomain(register.WildcardDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"a/expired", "a/unready", "b/drained"}; !reflect.DeepEqual(names(srvs), expect) {
+		t.Fatalf("Expected dangling services %v, got %v", expect, names(srvs))
+	}
+
+	srvs, err = m.DanglingServices(ctx, register.ListDomain("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"b/drained"}; !reflect.DeepEqual(names(srvs), expect) {
+		t.Fatalf("Expected dangling services %v, got %v", expect, names(srvs))
+	}
+}
+
+func TestMemoryMinTier(t *testing.T) {
+	m := newMemory(register.NewOptions())
+	ctx := context.TODO()
+
+	for version, tier := range map[string]string{"1": "critical", "2": " Standard", "3": "best-effort", "4": ""} {
+		srv := &register.Service{
+			Name:     "foo",
+			Version:  version,
+			Metadata: map[string]string{"tier": tier},
+			Nodes:    []*register.Node{{Id: "foo-" + version}},
+		}
+		if err := m.Register(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions := func(opts ...register.LookupOption) []string {
+		srvs, err := m.LookupService(ctx, "foo", opts...)
+		if err != nil && err != register.ErrNotFound {
+			t.Fatal(err)
+		}
+		var result []string
+		for _, s := range srvs {
+			result = append(result, s.Version)
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	testCases := []struct {
+		tier   string
+		expect []string
+	}{
+		{"", []string{"1", "2", "3", "4"}},
+		{"best-effort", []string{"1", "2", "3", "4"}},
+		{"standard", []string{"1", "2", "4"}},
+		{"Critical", []string{"1"}},
+		{"unknown", nil},
+	}
+	for _, tc := range testCases {
+		var opts []register.LookupOption
+		if len(tc.tier) > 0 {
+			opts = append(opts, MinTier(tc.tier))
+		}
+		if got := versions(opts...); !reflect.DeepEqual(got, tc.expect) {
+			t.Fatalf("Expected versions %v for tier %q, got %v", tc.expect, tc.tier, got)
+		}
+	}
+
+	srv := &register.Service{Name: "bar", Metadata: map[string]string{"tier": "gold"}, Nodes: []*register.Node{{Id: "bar-1"}}}
+	if err := m.Register(ctx, srv); err != ErrInvalidTier {
+		t.Fatalf("Expected ErrInvalidTier, got %v", err)
+	}
+	if _, err := m.LookupService(ctx, "bar"); err != register.ErrNotFound {
+		t.Fatalf("Expected the invalid service not to be registered, got %v", err)
+	}
+}
+
+func TestMemoryCompareAndDeregister(t *testing.T) {
+	m := newMemory(register.NewOptions())
+	ctx := context.TODO()
+
+	srv := &register.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes:   []*register.Node{{Id: "foo-1", Address: "10.0.0.1:8080"}, {Id: "foo-2", Address: "10.0.0.2:8080"}},
+	}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	// the node restarted at another address
+	removed, err := m.CompareAndDeregister(ctx, register.DefaultDomain, "foo", "1.0.0", "foo-1", "10.0.0.9:8080")
+	if err != nil || removed {
+		t.Fatalf("Expected the mismatched node not to be removed, got %v, %v", removed, err)
+	}
+
+	removed, err = m.CompareAndDeregister(ctx, register.DefaultDomain, "foo", "1.0.0", "foo-1", "10.0.0.1:8080")
+	if err != nil || !removed {
+		t.Fatalf("Expected the matching node to be removed, got %v, %v", removed, err)
+	}
+
+	srvs, err := m.LookupService(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srvs[0].Nodes) != 1 || srvs[0].Nodes[0].Id != "foo-2" {
+		t.Fatalf("Expected only foo-2 to remain, got %+v", srvs[0].Nodes)
+	}
+
+	removed, err = m.CompareAndDeregister(ctx, register.DefaultDomain, "foo", "1.0.0", "foo-1", "10.0.0.1:8080")
+	if err != register.ErrNotFound || removed {
+		t.Fatalf("Expected ErrNotFound for the missing node, got %v, %v", removed, err)
+	}
+}
+
+func TestMemoryOnExpire(t *testing.T) {
+	m := NewRegister(PruneInterval(10 * time.Millisecond)).(*memory)
+	defer m.Disconnect(context.TODO())
+	ctx := context.TODO()
+
+	expired := make(chan string, 2)
+	onExpire := OnExpire(func(n *register.Node) {
+		expired <- n.Id
+	})
+
+	foo := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, foo, register.RegisterTTL(20*time.Millisecond), onExpire); err != nil {
+		t.Fatal(err)
+	}
+	// deregistered services never expire
+	bar := &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}}
+	if err := m.Register(ctx, bar, register.RegisterTTL(20*time.Millisecond), onExpire); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Deregister(ctx, bar); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case id := <-expired:
+		if id != "foo-1" {
+			t.Fatalf("Expected foo-1 to expire, got %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the expiry callback to be called")
+	}
+
+	select {
+	case id := <-expired:
+		t.Fatalf("Expected a single expiry, got %s", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemorySchema(t *testing.T) {
+	m := newMemory(register.NewOptions(MaxSchemaBytes(16)))
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.GetSchema(register.DefaultDomain, "foo", "1.0.0"); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound without schema, got %v", err)
+	}
+
+	schema := []byte(`{"openapi":"3"}`)
+	if err := m.SetSchema(register.DefaultDomain, "foo", "1.0.0", schema); err != nil {
+		t.Fatal(err)
+	}
+	// the stored schema is a copy
+	schema[0] = '['
+	got, err := m.GetSchema(register.DefaultDomain, "foo", "1.0.0")
+	if err != nil || string(got) != `{"openapi":"3"}` {
+		t.Fatalf("Expected the stored schema, got %s, %v", got, err)
+	}
+
+	if err := m.SetSchema(register.DefaultDomain, "foo", "1.0.0", []byte("syntax proto3")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := m.GetSchema(register.DefaultDomain, "foo", "1.0.0"); string(got) != "syntax proto3" {
+		t.Fatalf("Expected the overwritten schema, got %s", got)
+	}
+
+	if err := m.SetSchema(register.DefaultDomain, "foo", "1.0.0", make([]byte, 17)); err != ErrLimitExceeded {
+		t.Fatalf("Expected ErrLimitExceeded, got %v", err)
+	}
+	if err := m.SetSchema(register.DefaultDomain, "foo", "2.0.0", schema); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for a missing version, got %v", err)
+	}
+}
+
+func TestMemoryPruneEmpty(t *testing.T) {
+	m := NewRegister(PruneInterval(10*time.Millisecond), PruneEmpty(true), EventTimeout(time.Second)).(*memory)
+	defer m.Disconnect(context.TODO())
+	ctx := context.TODO()
+
+	w, err := m.Watch(ctx, register.WatchDomain(register.WildcardDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	registrations := []struct {
+		srv    *register.Service
+		domain string
+		ttl    time.Duration
+	}{
+		{&register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}, "a", 20 * time.Millisecond},
+		{&register.Service{Name: "foo", Version: "2.0.0", Nodes: []*register.Node{{Id: "foo-2"}}}, "a", 0},
+		{&register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}}, "b", 20 * time.Millisecond},
+	}
+	for _, r := range registrations {
+		if err := m.Register(ctx, r.srv, register.RegisterDomain(r.domain), register.RegisterTTL(r.ttl)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var deleted []string
+	for len(deleted) < 2 {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Action == "delete" {
+			deleted = append(deleted, res.Service.Metadata["domain"]+"/"+res.Service.Name+"/"+res.Service.Version)
+		}
+	}
+	sort.Strings(deleted)
+	if expect := []string{"a/foo/1.0.0", "b/bar/1.0.0"}; !reflect.DeepEqual(deleted, expect) {
+		t.Fatalf("Expected delete events for %v, got %v", expect, deleted)
+	}
+
+	srvs, err := m.LookupService(ctx, "foo", register.LookupDomain("a"))
+	if err != nil || len(srvs) != 1 || srvs[0].Version != "2.0.0" {
+		t.Fatalf("Expected only foo 2.0.0 to remain, got %+v, %v", srvs, err)
+	}
+	if _, err := m.LookupService(ctx, "bar", register.LookupDomain("b")); err != register.ErrNotFound {
+		t.Fatalf("Expected bar to be removed, got %v", err)
+	}
+
+	m.RLock()
+	_, ok := m.records["b"]
+	m.RUnlock()
+	if ok {
+		t.Fatal("Expected the empty domain to be removed")
+	}
+}
+
+func TestMemoryPruneKeepsEmptyDomains(t *testing.T) {
+	m := newMemory(register.NewOptions())
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, srv, register.RegisterDomain("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Deregister(ctx, srv, register.DeregisterDomain("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// without PruneEmpty the emptied domain is kept
+	m.Lock()
+	m.prune()
+	_, ok := m.records["a"]
+	m.Unlock()
+	if !ok {
+		t.Fatal("Expected the empty domain to be kept without PruneEmpty")
+	}
+}
+
+func TestMemoryLoader(t *testing.T) {
+	errUnavailable := errors.New("source unavailable")
+	var mu sync.Mutex
+	calls := make(map[string]int)
+
+	m := newMemory(register.NewOptions(Loader(func(ctx context.Context, name string) ([]*register.Service, error) {
+		mu.Lock()
+		calls[name]++
+		mu.Unlock()
+
+		// slow source so the concurrent misses overlap
+		time.Sleep(20 * time.Millisecond)
+		if name == "bad" {
+			return nil, errUnavailable
+		}
+		return []*register.Service{{Name: name, Version: "1.0.0", Nodes: []*register.Node{{Id: name + "-1"}}}}, nil
+	})))
+	ctx := context.TODO()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srvs, err := m.LookupService(ctx, "foo")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(srvs) != 1 || srvs[0].Nodes[0].Id != "foo-1" {
+				t.Errorf("Expected the loaded foo service, got %+v", srvs)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the loaded service is cached
+	if _, err := m.LookupService(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.LookupService(ctx, "bad"); err != errUnavailable {
+		t.Fatalf("Expected the loader error, got %v", err)
+	}
+	if _, err := m.LookupService(ctx, "bad"); err != errUnavailable {
+		t.Fatalf("Expected the loader error, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["foo"] != 1 || calls["bad"] != 2 {
+		t.Fatalf("Expected 1 foo and 2 bad loader calls, got %v", calls)
+	}
+}
+
+func TestMemoryLoaderReplica(t *testing.T) {
+	upstream := newMemory(register.NewOptions())
+	release := make(chan struct{})
+	m := NewRegister(ReplicaOf(upstream), Loader(func(ctx context.Context, name string) ([]*register.Service, error) {
+		<-release
+		return []*register.Service{{Name: name, Version: "1.0.0", Nodes: []*register.Node{{Id: name + "-1"}}}}, nil
+	}))
+	defer m.Disconnect(context.TODO())
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := m.LookupService(context.TODO(), "foo")
+		errs <- err
+	}()
+
+	// the waiters of the load in flight give up with their context
+	for loading := false; !loading; time.Sleep(time.Millisecond) {
+		rm := m.(*memory)
+		rm.Lock()
+		_, loading = rm.loads[register.DefaultDomain+"/foo"]
+		rm.Unlock()
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := m.LookupService(ctx, "foo"); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the waiter to give up with its context, got %v", err)
+	}
+
+	// the replica populates its records from the loader
+	close(release)
+	if err := <-errs; err != nil {
+		t.Fatalf("Expected the replica to load foo, got %v", err)
+	}
+	if srvs, err := m.LookupService(context.TODO(), "foo"); err != nil || srvs[0].Nodes[0].Id != "foo-1" {
+		t.Fatalf("Expected the loaded foo service, got %+v, %v", srvs, err)
+	}
+}
+
+func TestMemoryLoaderMaintenance(t *testing.T) {
+	var calls int32
+	m := newMemory(register.NewOptions(Loader(func(ctx context.Context, name string) ([]*register.Service, error) {
+		atomic.AddInt32(&calls, 1)
+		return []*register.Service{{Name: name, Version: "1.0.0", Nodes: []*register.Node{{Id: name + "-1"}}}}, nil
+	})))
+	ctx := context.TODO()
+
+	m.SetMaintenance(true)
+	if _, err := m.LookupService(ctx, "foo"); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound during the maintenance, got %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Fatalf("Expected no loader call during the maintenance, got %d", n)
+	}
+
+	m.SetMaintenance(false)
+	if srvs, err := m.LookupService(ctx, "foo"); err != nil || srvs[0].Nodes[0].Id != "foo-1" {
+		t.Fatalf("Expected the loaded foo service, got %+v, %v", srvs, err)
+	}
+}
+
+func TestMemoryLoaderWildcard(t *testing.T) {
+	for _, consistent := range []bool{false, true} {
+		var calls int32
+		m := newMemory(register.NewOptions(ConsistentWildcardReads(consistent), Loader(func(ctx context.Context, name string) ([]*register.Service, error) {
+			atomic.AddInt32(&calls, 1)
+			return []*register.Service{{Name: name, Version: "1.0.0", Nodes: []*register.Node{{Id: name + "-1"}}}}, nil
+		})))
+		ctx := context.TODO()
+
+		for _, domain := range []string{"a", "b", "c"} {
+			if err := m.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-" + domain}}}, register.RegisterDomain(domain)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := m.LookupService(ctx, "foo", register.LookupDomain(register.WildcardDomain)); err != register.ErrNotFound {
+			t.Fatalf("Expected ErrNotFound for the wildcard miss, got %v", err)
+		}
+		if n := atomic.LoadInt32(&calls); n != 0 {
+			t.Fatalf("Expected no loader call for the wildcard lookup with consistent=%v, got %d", consistent, n)
+		}
+		if ids, err := m.ListNodeIDs(ctx, register.ListDomain(register.WildcardDomain)); err != nil || len(ids) != 3 {
+			t.Fatalf("Expected no loaded records, got %v, %v", ids, err)
+		}
+	}
+}
+
+func TestMemorySetNodeError(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	m := newMemory(register.NewOptions(Clock(func() time.Time { return now })))
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetNodeError(register.DefaultDomain, "foo", "1.0.0", "foo-1", "health check timeout"); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func() map[string]string {
+		srvs, err := m.LookupService(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return srvs[0].Nodes[0].Metadata
+	}
+
+	md := lookup()
+	if md["last_error"] != "health check timeout" || md["last_error_at"] != "2021-03-01T12:00:00Z" {
+		t.Fatalf("Expected the node error in metadata, got %v", md)
+	}
+
+	// heartbeats of an unready node keep the error
+	unready := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1", Metadata: map[string]string{"ready": "false"}}}}
+	if err := m.Register(ctx, unready); err != nil {
+		t.Fatal(err)
+	}
+	if md := lookup(); md["last_error"] != "health check timeout" {
+		t.Fatalf("Expected the node error to be kept, got %v", md)
+	}
+
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+	if md := lookup(); len(md["last_error"]) > 0 || len(md["last_error_at"]) > 0 {
+		t.Fatalf("Expected the node error to be cleared, got %v", md)
+	}
+
+	if err := m.SetNodeError(register.DefaultDomain, "foo", "1.0.0", "foo-2", "down"); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMemoryListWithCounts(t *testing.T) {
+	m := newMemory(register.NewOptions())
+	ctx := context.TODO()
+
+	registrations := []struct {
+		srv    *register.Service
+		domain string
+	}{
+		{&register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}, {Id: "foo-2"}}}, "a"},
+		{&register.Service{Name: "foo", Version: "2.0.0", Nodes: []*register.Node{{Id: "foo-3"}, {Id: "foo-4"}, {Id: "foo-5"}}}, "a"},
+		{&register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}}, "a"},
+		{&register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-6"}}}, "b"},
+	}
+	for _, r := range registrations {
+		if err := m.Register(ctx, r.srv, register.RegisterDomain(r.domain)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts := func(srvs []*register.Service) []string {
+		var result []string
+		for _, s := range srvs {
+			result = append(result, fmt.Sprintf("%s/%s:%s:%s", s.Metadata["domain"], s.Name, s.Metadata["versionCount"], s.Metadata["nodeCount"]))
+		}
+		return result
+	}
+
+	srvs, err := m.ListServices(ctx, register.ListDomain("a"), WithCounts(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"a/bar:1:1", "a/foo:2:5"}; !reflect.DeepEqual(counts(srvs), expect) {
+		t.Fatalf("Expected %v, got %v", expect, counts(srvs))
+	}
+
+	srvs, err = m.ListServices(ctx, register.ListDomain(register.WildcardDomain), WithCounts(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"a/bar:1:1", "a/foo:2:5", "b/foo:1:1"}; !reflect.DeepEqual(counts(srvs), expect) {
+		t.Fatalf("Expected %v, got %v", expect, counts(srvs))
+	}
+
+	// one entry per version without the option
+	if srvs, err := m.ListServices(ctx, register.ListDomain("a")); err != nil || len(srvs) != 3 {
+		t.Fatalf("Expected 3 versions, got %d, %v", len(srvs), err)
+	}
+}
+
+func TestMemoryWriteMetrics(t *testing.T) {
+	m := newMemory(register.NewOptions())
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}, {Id: "foo-2"}}}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := m.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if lines[len(lines)-1] != "# EOF" {
+		t.Fatalf("Expected the exposition to end with # EOF, got %q", lines[len(lines)-1])
+	}
+
+	sample := regexp.MustCompile(`^[a-z_][a-z0-9_]* [0-9.e+-]+$`)
+	samples := make(map[string]string)
+	for _, line := range lines[:len(lines)-1] {
+		if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+			continue
+		}
+		if !sample.MatchString(line) {
+			t.Fatalf("Malformed metric line %q", line)
+		}
+		parts := strings.Split(line, " ")
+		samples[parts[0]] = parts[1]
+	}
+
+	for name, value := range map[string]string{
+		"register_memory_services":               "1",
+		"register_memory_nodes":                  "2",
+		"register_memory_dropped_events_total":   "0",
+		"register_memory_delivered_events_total": "0",
+	} {
+		if samples[name] != value {
+			t.Fatalf("Expected %s %s, got %q", name, value, samples[name])
+		}
+	}
+	for _, line := range []string{
+		"# TYPE register_memory_dropped_events counter\n",
+		"# TYPE register_memory_delivery_latency_p50_seconds gauge\n",
+		"# TYPE register_memory_delivery_latency_p99_seconds gauge\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatalf("Expected the TYPE line %q, got\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestMemoryClockSkew(t *testing.T) {
+	start := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	m := newMemory(register.NewOptions(Clock(func() time.Time { return now }), StaleThreshold(0.5)))
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, srv, register.RegisterTTL(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	prune := func() []*register.Result {
+		m.Lock()
+		defer m.Unlock()
+		events, _ := m.prune()
+		return events
+	}
+	nodes := func() int {
+		srvs, err := m.LookupService(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(srvs[0].Nodes)
+	}
+
+	// the clock jumps backward
+	now = start.Add(-time.Hour)
+	if events := prune(); len(events) != 0 || nodes() != 1 {
+		t.Fatalf("Expected no expiry or stale warning after the clock moved backward, got %d events and %d nodes", len(events), nodes())
+	}
+	if oldest, newest, err := m.NodeAges(register.DefaultDomain, "foo", "1.0.0"); err != nil || oldest != 0 || newest != 0 {
+		t.Fatalf("Expected zero node ages, got %v, %v, %v", oldest, newest, err)
+	}
+
+	now = start.Add(30 * time.Second)
+	if prune(); nodes() != 1 {
+		t.Fatal("Expected the node to be alive within its TTL")
+	}
+
+	now = start.Add(2 * time.Minute)
+	if prune(); nodes() != 0 {
+		t.Fatal("Expected the node to expire after its TTL")
+	}
+}
+
+func TestMemoryLookupNearest(t *testing.T) {
+	m := newMemory(register.NewOptions())
+	ctx := context.TODO()
+
+	position := func(lat, lon string) map[string]string {
+		return map[string]string{"lat": lat, "lon": lon}
+	}
+	testData := []*register.Service{
+		{Name: "edge", Version: "1.0.0", Nodes: []*register.Node{
+			{Id: "tokyo", Metadata: position("35.68", "139.69")},
+			{Id: "unknown"},
+			{Id: "london", Metadata: position("51.51", "-0.13")},
+		}},
+		{Name: "edge", Version: "2.0.0", Nodes: []*register.Node{
+			{Id: "invalid", Metadata: position("91", "0")},
+			{Id: "new-york", Metadata: position("40.71", "-74.01")},
+			{Id: "paris", Metadata: position("48.86", "2.35")},
+		}},
+	}
+	for _, srv := range testData {
+		if err := m.Register(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// from berlin
+	nodes, err := m.LookupNearest(ctx, "edge", 52.52, 13.40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, n := range nodes {
+		ids = append(ids, n.Id)
+	}
+	if expect := []string{"paris", "london", "new-york", "tokyo"}; !reflect.DeepEqual(ids[:4], expect) {
+		t.Fatalf("Expected the nodes ordered by distance %v, got %v", expect, ids)
+	}
+	if last := ids[4:]; len(last) != 2 || (last[0] != "unknown" && last[0] != "invalid") {
+		t.Fatalf("Expected the nodes without position last, got %v", ids)
+	}
+
+	if _, err := m.LookupNearest(ctx, "missing", 0, 0); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMemoryEnabledFlags(t *testing.T) {
+	m := newMemory(register.NewOptions(EnabledFlags(map[string]bool{"beta": false})))
+	ctx := context.TODO()
+
+	testData := []*register.Service{
+		{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}},
+		{Name: "foo", Version: "2.0.0", Metadata: map[string]string{"flag": "beta"}, Endpoints: []*register.Endpoint{{Name: "Foo.Beta"}}, Nodes: []*register.Node{{Id: "foo-2"}}},
+		{Name: "bar", Version: "1.0.0", Metadata: map[string]string{"flag": "unknown"}, Nodes: []*register.Node{{Id: "bar-1"}}},
+	}
+	for _, srv := range testData {
+		if err := m.Register(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	visible := func() []string {
+		srvs, err := m.ListServices(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []string
+		for _, s := range srvs {
+			result = append(result, s.Name+"/"+s.Version)
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	if expect := []string{"foo/1.0.0"}; !reflect.DeepEqual(visible(), expect) {
+		t.Fatalf("Expected %v, got %v", expect, visible())
+	}
+	if srvs, err := m.LookupService(ctx, "foo"); err != nil || len(srvs) != 1 {
+		t.Fatalf("Expected only foo 1.0.0, got %+v, %v", srvs, err)
+	}
+	if _, err := m.LookupService(ctx, "bar"); err != register.ErrNotFound {
+		t.Fatalf("Expected bar behind an unknown flag to be hidden, got %v", err)
+	}
+
+	// every other read path hides them as well
+	if srvs, err := m.LookupByEndpoint(ctx, "Foo.Beta"); err != register.ErrNotFound {
+		t.Fatalf("Expected the endpoint behind a flag to be hidden, got %+v, %v", srvs, err)
+	}
+	if srvs, err := m.LookupByPrefix(ctx, "ba"); err != register.ErrNotFound {
+		t.Fatalf("Expected bar behind an unknown flag to be hidden by prefix, got %+v, %v", srvs, err)
+	}
+	if srvs, err := m.ExportServices(ctx); err != nil || len(srvs) != 1 {
+		t.Fatalf("Expected only foo 1.0.0 to be exported, got %+v, %v", srvs, err)
+	}
+	if dump, err := m.Dump(ctx); err != nil || len(dump[register.DefaultDomain]) != 1 {
+		t.Fatalf("Expected only foo 1.0.0 to be dumped, got %+v, %v", dump, err)
+	}
+
+	if err := m.Init(EnabledFlags(map[string]bool{"beta": true, "unknown": true})); err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"bar/1.0.0", "foo/1.0.0", "foo/2.0.0"}; !reflect.DeepEqual(visible(), expect) {
+		t.Fatalf("Expected %v, got %v", expect, visible())
+	}
+	if srvs, err := m.LookupService(ctx, "foo"); err != nil || len(srvs) != 2 {
+		t.Fatalf("Expected both foo versions, got %+v, %v", srvs, err)
+	}
+	if srvs, err := m.LookupByEndpoint(ctx, "Foo.Beta"); err != nil || len(srvs) != 1 {
+		t.Fatalf("Expected the enabled endpoint, got %+v, %v", srvs, err)
+	}
+	if srvs, err := m.LookupByPrefix(ctx, "ba"); err != nil || len(srvs) != 1 {
+		t.Fatalf("Expected the enabled bar by prefix, got %+v, %v", srvs, err)
+	}
+}
+
+func TestMemoryNodePool(t *testing.T) {
+	m := newMemory(register.NewOptions(NodePool(true)))
+	ctx := context.TODO()
+
+	old := &register.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes: []*register.Node{
+			{Id: "foo-1", Address: "10.0.0.1:8080", Metadata: map[string]string{"zone": "a", "secret": "x"}},
+		},
+	}
+	if err := m.Register(ctx, old, OnExpire(func(*register.Node) {})); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetNodeError(register.DefaultDomain, "foo", "1.0.0", "foo-1", "boom"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Deregister(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		srv := &register.Service{
+			Name:    "foo",
+			Version: "1.0.0",
+			Nodes: []*register.Node{
+				{Id: fmt.Sprintf("foo-%d", i+2), Address: "10.0.0.2:8080"},
+			},
+		}
+		if err := m.Register(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+
+		m.RLock()
+		n := m.records[register.DefaultDomain]["foo"]["1.0.0"].Nodes[srv.Nodes[0].Id]
+		m.RUnlock()
+		if expect := (metadata.Metadata{"domain": register.DefaultDomain}); !reflect.DeepEqual(n.Metadata, expect) {
+			t.Fatalf("Expected metadata %v, got %v", expect, n.Metadata)
+		}
+		if len(n.LastError) > 0 || n.Drained || n.OnExpire != nil || n.Address != "10.0.0.2:8080" {
+			t.Fatalf("Expected a clean node, got %+v", n)
+		}
+
+		if err := m.Deregister(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func benchmarkRegisterChurn(b *testing.B, opts ...register.Option) {
+	m := newMemory(register.NewOptions(opts...))
+	ctx := context.TODO()
+
+	srv := &register.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes: []*register.Node{
+			{Id: "foo-1", Address: "10.0.0.1:8080", Metadata: map[string]string{"zone": "a", "rack": "1"}},
+		},
+	}
+	// keep the version alive so only the nodes churn
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-0"}}}); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := m.Register(ctx, srv); err != nil {
+			b.Fatal(err)
+		}
+		if err := m.Deregister(ctx, srv); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRegisterChurn(b *testing.B) {
+	benchmarkRegisterChurn(b)
+}
+
+func BenchmarkRegisterChurnNodePool(b *testing.B) {
+	benchmarkRegisterChurn(b, NodePool(true))
+}
+
+// fakeUpstream is a memory register sending the events pushed to its watcher
+// instead of its own
+type fakeUpstream struct {
+	*memory
+	watcher *fakeWatcher
+}
+
+func (f *fakeUpstream) Watch(ctx context.Context, opts ...register.WatchOption) (register.Watcher, error) {
+	return f.watcher, nil
+}
+
+type fakeWatcher struct {
+	events chan *register.Result
+	exit   chan struct{}
+	once   sync.Once
+}
+
+func (w *fakeWatcher) Next() (*register.Result, error) {
+	select {
+	case r := <-w.events:
+		return r, nil
+	case <-w.exit:
+		return nil, register.ErrWatcherStopped
+	}
+}
+
+func (w *fakeWatcher) Stop() {
+	w.once.Do(func() { close(w.exit) })
+}
+
+func TestMemoryReplicaOf(t *testing.T) {
+	upstream := &fakeUpstream{
+		memory:  newMemory(register.NewOptions()),
+		watcher: &fakeWatcher{events: make(chan *register.Result), exit: make(chan struct{})},
+	}
+	ctx := context.TODO()
+
+	foo := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1", Address: "10.0.0.1:8080"}}}
+	if err := upstream.Register(ctx, foo, register.RegisterDomain("eu")); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewRegister(ReplicaOf(upstream))
+	defer m.Disconnect(context.TODO())
+
+	nodes := func(name string) []string {
+		srvs, err := m.LookupService(ctx, name, register.LookupDomain("eu"))
+		if err == register.ErrNotFound {
+			return nil
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, s := range srvs {
+			for _, n := range s.Nodes {
+				ids = append(ids, s.Version+"/"+n.Id)
+			}
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	if expect := []string{"1.0.0/foo-1"}; !reflect.DeepEqual(nodes("foo"), expect) {
+		t.Fatalf("Expected the bootstrapped nodes %v, got %v", expect, nodes("foo"))
+	}
+
+	if err := m.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0"}); err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly, got %v", err)
+	}
+	if err := m.Deregister(ctx, foo, register.DeregisterDomain("eu")); err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly, got %v", err)
+	}
+
+	// every other change is rejected as well
+	rm := m.(*memory)
+	changes := map[string]func() error{
+		"node error":   func() error { return rm.SetNodeError("eu", "foo", "1.0.0", "foo-1", "failed") },
+		"node drained": func() error { return rm.SetNodeDrained("eu", "foo", "1.0.0", "foo-1", true) },
+		"node ready":   func() error { return rm.SetNodeReady("eu", "foo", "1.0.0", "foo-1", false) },
+		"rename":       func() error { return rm.RenameDomain("eu", "us") },
+		"promote":      func() error { return rm.PromoteVersion("eu", "foo", "1.0.0") },
+		"touch": func() error {
+			_, err := rm.TouchAll("eu")
+			return err
+		},
+		"domain ttl": func() error { return rm.SetDomainTTL("eu", time.Minute) },
+		"schema":     func() error { return rm.SetSchema("eu", "foo", "1.0.0", []byte("{}")) },
+	}
+	for name, change := range changes {
+		if err := change(); err != ErrReadOnly {
+			t.Fatalf("Expected ErrReadOnly on %s, got %v", name, err)
+		}
+	}
+
+	// a clone of the replica is a writable register of its own
+	c := rm.Clone()
+	defer c.Disconnect(context.TODO())
+	if err := c.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0"}, register.RegisterDomain("eu")); err != nil {
+		t.Fatalf("Expected the clone to accept changes, got %v", err)
+	}
+	if _, err := m.LookupService(ctx, "bar", register.LookupDomain("eu")); err != register.ErrNotFound {
+		t.Fatalf("Expected the clone changes to stay out of the replica, got %v", err)
+	}
+
+	events := []*register.Result{
+		{Action: "create", Service: &register.Service{
+			Name: "foo", Version: "2.0.0", Metadata: map[string]string{"domain": "eu"},
+			Nodes: []*register.Node{{Id: "foo-2", Address: "10.0.0.2:8080"}},
+		}},
+		{Action: "update", Service: &register.Service{
+			Name: "foo", Version: "1.0.0", Metadata: map[string]string{"domain": "eu"},
+			Nodes: []*register.Node{{Id: "foo-3", Address: "10.0.0.3:8080"}},
+		}},
+		{Action: "delete", Service: &register.Service{
+			Name: "foo", Version: "1.0.0", Metadata: map[string]string{"domain": "eu"},
+			Nodes: []*register.Node{{Id: "foo-1", Address: "10.0.0.1:8080"}},
+		}},
+	}
+	expected := [][]string{
+		{"1.0.0/foo-1", "2.0.0/foo-2"},
+		{"1.0.0/foo-1", "1.0.0/foo-3", "2.0.0/foo-2"},
+		{"1.0.0/foo-3", "2.0.0/foo-2"},
+	}
+
+	for i, r := range events {
+		// update events are resynced from the upstream state
+		if r.Action == "update" {
+			if err := upstream.Register(ctx, r.Service, register.RegisterDomain("eu")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		upstream.watcher.events <- r
+		// the second send waits for the event to be applied
+		upstream.watcher.events <- &register.Result{Action: "update", Service: &register.Service{Metadata: map[string]string{"event": "domain"}}}
+		if got := nodes("foo"); !reflect.DeepEqual(got, expected[i]) {
+			t.Fatalf("Expected %v after the %s event, got %v", expected[i], r.Action, got)
+		}
+	}
+
+	// a delete without a version removes the whole service
+	upstream.watcher.events <- &register.Result{Action: "delete", Service: &register.Service{Name: "foo", Metadata: map[string]string{"domain": "eu"}}}
+	upstream.watcher.events <- &register.Result{Action: "update", Service: &register.Service{Metadata: map[string]string{"event": "domain"}}}
+	if got := nodes("foo"); got != nil {
+		t.Fatalf("Expected foo to be removed, got %v", got)
+	}
+}
+
+func TestMemoryReplicaOfWriteChecks(t *testing.T) {
+	upstream := &fakeUpstream{
+		memory:  newMemory(register.NewOptions()),
+		watcher: &fakeWatcher{events: make(chan *register.Result), exit: make(chan struct{})},
+	}
+	ctx := context.TODO()
+
+	// the local write checks reject what the upstream accepted
+	m := NewRegister(ReplicaOf(upstream), MaxServices(1), RejectEmpty(true), NormalizeMetadataKeys(true))
+	defer m.Disconnect(context.TODO())
+	rm := m.(*memory)
+	rm.SetMaintenance(true)
+
+	md := map[string]string{"Zone": "eu-1"}
+	events := []*register.Result{
+		{Action: "create", Service: &register.Service{
+			Name: "foo", Version: "1.0.0", Metadata: map[string]string{"domain": "eu"},
+			Nodes: []*register.Node{{Id: "foo-1", Address: "10.0.0.1:8080", Metadata: md}},
+		}},
+		{Action: "create", Service: &register.Service{Name: "bar", Version: "1.0.0", Metadata: map[string]string{"domain": "eu"}}},
+	}
+	for _, r := range events {
+		upstream.watcher.events <- r
+	}
+	// the last send waits for the events to be applied
+	upstream.watcher.events <- &register.Result{Action: "update", Service: &register.Service{Metadata: map[string]string{"event": "domain"}}}
+
+	for _, name := range []string{"foo", "bar"} {
+		if _, err := m.LookupService(ctx, name, register.LookupDomain("eu")); err != nil {
+			t.Fatalf("Expected %s to be mirrored, got %v", name, err)
+		}
+	}
+	if _, ok := md["Zone"]; !ok || len(md) != 1 {
+		t.Fatalf("Expected the upstream node metadata to stay unchanged, got %v", md)
+	}
+	if n := events[0].Service.Nodes[0]; n.Metadata["Zone"] != "eu-1" {
+		t.Fatalf("Expected the upstream node to stay unchanged, got %v", n.Metadata)
+	}
+
+	upstream.watcher.events <- &register.Result{Action: "delete", Service: &register.Service{Name: "foo", Metadata: map[string]string{"domain": "eu"}}}
+	upstream.watcher.events <- &register.Result{Action: "update", Service: &register.Service{Metadata: map[string]string{"event": "domain"}}}
+	if _, err := m.LookupService(ctx, "foo", register.LookupDomain("eu")); err != register.ErrNotFound {
+		t.Fatalf("Expected foo to be removed during maintenance, got %v", err)
+	}
+
+	// local changes are still rejected
+	if err := m.Register(ctx, &register.Service{Name: "baz", Version: "1.0.0"}); err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly, got %v", err)
+	}
+}
+
+func TestMemoryReplicaOfMemory(t *testing.T) {
+	upstream := newMemory(register.NewOptions(EventTimeout(time.Second)))
+	ctx := context.TODO()
+
+	foo := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "a"}, {Id: "b"}}}
+	if err := upstream.Register(ctx, foo); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewRegister(ReplicaOf(upstream))
+	defer m.Disconnect(context.TODO())
+
+	// the replica applies the upstream events in the background
+	eventually := func(expect []string) {
+		var ids []string
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			ids = nil
+			srvs, err := m.LookupService(ctx, "foo")
+			if err != nil && err != register.ErrNotFound {
+				t.Fatal(err)
+			}
+			for _, s := range srvs {
+				for _, n := range s.Nodes {
+					ids = append(ids, s.Version+"/"+n.Id)
+				}
+			}
+			sort.Strings(ids)
+			if reflect.DeepEqual(ids, expect) {
+				return
+			}
+		}
+		t.Fatalf("Expected the replica nodes %v, got %v", expect, ids)
+	}
+
+	eventually([]string{"1.0.0/a", "1.0.0/b"})
+
+	if err := upstream.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "c"}}}); err != nil {
+		t.Fatal(err)
+	}
+	eventually([]string{"1.0.0/a", "1.0.0/b", "1.0.0/c"})
+
+	// the upstream reports the removed node in an update event
+	if err := upstream.Deregister(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "a"}}}); err != nil {
+		t.Fatal(err)
+	}
+	eventually([]string{"1.0.0/b", "1.0.0/c"})
+
+	if err := upstream.Deregister(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "b"}, {Id: "c"}}}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(nil)
+}
+
+func TestMemoryQuery(t *testing.T) {
+	m := newMemory(register.NewOptions())
+	ctx := context.TODO()
+
+	services := []struct {
+		srv    *register.Service
+		domain string
+	}{
+		{&register.Service{Name: "foo", Version: "1.0.0", Metadata: map[string]string{"team": "core"}, Nodes: []*register.Node{{Id: "foo-1"}}}, "a"},
+		{&register.Service{Name: "foo", Version: "2.0.0", Nodes: []*register.Node{{Id: "foo-2"}}}, "a"},
+		{&register.Service{Name: "bar", Version: "2.0.0", Metadata: map[string]string{"team": "core"}, Nodes: []*register.Node{{Id: "bar-1"}}}, "b"},
+	}
+	for _, s := range services {
+		if err := m.Register(ctx, s.srv, register.RegisterDomain(s.domain)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := func(srvs []*register.Service) []string {
+		var result []string
+		for _, s := range srvs {
+			result = append(result, s.Metadata["domain"]+"/"+s.Name+"/"+s.Version)
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	testCases := []struct {
+		name   string
+		pred   func(*register.Service) bool
+		opts   []register.ListOption
+		expect []string
+	}{
+		{"name", func(s *register.Service) bool { return s.Name == "foo" }, []register.ListOption{register.ListDomain(register.WildcardDomain)}, []string{"a/foo/1.0.0", "a/foo/2.0.0"}},
+		{"version", func(s *register.Service) bool { return s.Version == "2.0.0" }, []register.ListOption{register.ListDomain(register.WildcardDomain)}, []string{"a/foo/2.0.0", "b/bar/2.0.0"}},
+		{"metadata", func(s *register.Service) bool { return s.Metadata["team"] == "core" }, []register.ListOption{register.ListDomain(register.WildcardDomain)}, []string{"a/foo/1.0.0", "b/bar/2.0.0"}},
+		{"domain", func(s *register.Service) bool { return s.Metadata["team"] == "core" }, []register.ListOption{register.ListDomain("b")}, []string{"b/bar/2.0.0"}},
+		{"none", func(s *register.Service) bool { return false }, []register.ListOption{register.ListDomain(register.WildcardDomain)}, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srvs, err := m.Query(ctx, tc.pred, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(srvs); !reflect.DeepEqual(got, tc.expect) {
+				t.Fatalf("Expected %v, got %v", tc.expect, got)
+			}
+		})
+	}
+
+	// the predicate can't change the register
+	if _, err := m.Query(ctx, func(s *register.Service) bool {
+		s.Metadata["team"] = "changed"
+		s.Nodes = nil
+		return true
+	}, register.ListDomain(register.WildcardDomain)); err != nil {
+		t.Fatal(err)
+	}
+	srvs, err := m.LookupService(ctx, "bar", register.LookupDomain("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srvs[0].Metadata["team"] != "core" || len(srvs[0].Nodes) != 1 {
+		t.Fatalf("Expected the predicate changes to be discarded, got %+v", srvs[0])
+	}
+}
+
+func TestMemoryRejectEmpty(t *testing.T) {
+	ctx := context.TODO()
+	placeholder := &register.Service{Name: "foo", Version: "1.0.0"}
+
+	m := newMemory(register.NewOptions())
+	if err := m.Register(ctx, placeholder); err != nil {
+		t.Fatalf("Expected the placeholder to be registered, got %v", err)
+	}
+	if srvs, err := m.LookupService(ctx, "foo"); err != nil || len(srvs) != 1 || len(srvs[0].Nodes) != 0 {
+		t.Fatalf("Expected the placeholder without nodes, got %+v, %v", srvs, err)
+	}
+
+	m = newMemory(register.NewOptions(RejectEmpty(true)))
+	if err := m.Register(ctx, placeholder); err != ErrNoNodes {
+		t.Fatalf("Expected ErrNoNodes, got %v", err)
+	}
+	if _, err := m.LookupService(ctx, "foo"); err != register.ErrNotFound {
+		t.Fatalf("Expected the rejected service not to be registered, got %v", err)
+	}
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the option is hot-reloadable
+	if err := m.Init(RejectEmpty(false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryExpireAt(t *testing.T) {
+	start := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	m := newMemory(register.NewOptions(Clock(func() time.Time { return now })))
+	ctx := context.TODO()
+
+	registrations := []struct {
+		id   string
+		opts []register.RegisterOption
+	}{
+		{"ttl", []register.RegisterOption{register.RegisterTTL(time.Minute)}},
+		{"deadline", []register.RegisterOption{ExpireAt(start.Add(3 * time.Minute))}},
+		// the deadline takes precedence over the shorter TTL
+		{"both", []register.RegisterOption{register.RegisterTTL(time.Minute), ExpireAt(start.Add(2 * time.Minute))}},
+		{"none", nil},
+	}
+	for _, r := range registrations {
+		srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: r.id}}}
+		if err := m.Register(ctx, srv, r.opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nodes := func() []string {
+		m.Lock()
+		m.prune()
+		m.Unlock()
+
+		srvs, err := m.LookupService(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, n := range srvs[0].Nodes {
+			ids = append(ids, n.Id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	steps := []struct {
+		at     time.Duration
+		expect []string
+	}{
+		{30 * time.Second, []string{"both", "deadline", "none", "ttl"}},
+		{90 * time.Second, []string{"both", "deadline", "none"}},
+		{150 * time.Second, []string{"deadline", "none"}},
+		{210 * time.Second, []string{"none"}},
+	}
+	for _, step := range steps {
+		now = start.Add(step.at)
+		if got := nodes(); !reflect.DeepEqual(got, step.expect) {
+			t.Fatalf("Expected nodes %v after %v, got %v", step.expect, step.at, got)
+		}
+	}
+}
+
+func TestMemoryUptime(t *testing.T) {
+	start := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	m := newMemory(register.NewOptions(Clock(func() time.Time { return now })))
+
+	if !m.StartedAt().Equal(start) {
+		t.Fatalf("Expected the register to start at %v, got %v", start, m.StartedAt())
+	}
+	if uptime := m.Uptime(); uptime != 0 {
+		t.Fatalf("Expected no uptime, got %v", uptime)
+	}
+
+	now = start.Add(time.Minute)
+	if uptime := m.Uptime(); uptime != time.Minute {
+		t.Fatalf("Expected an uptime of 1m, got %v", uptime)
+	}
+
+	now = start.Add(time.Hour)
+	if uptime := m.Uptime(); uptime != time.Hour {
+		t.Fatalf("Expected an uptime of 1h, got %v", uptime)
+	}
+	if !m.StartedAt().Equal(start) {
+		t.Fatalf("Expected the start time not to change, got %v", m.StartedAt())
+	}
+}
+
+func TestMemorySingleton(t *testing.T) {
+	ctx := context.TODO()
+	leader := func(id string) *register.Service {
+		return &register.Service{Name: "leader", Version: "1.0.0", Nodes: []*register.Node{{Id: id, Address: id + ":8080"}}}
+	}
+	nodes := func(m *memory) []string {
+		srvs, err := m.LookupService(ctx, "leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, n := range srvs[0].Nodes {
+			ids = append(ids, n.Id)
+		}
+		return ids
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		m := newMemory(register.NewOptions())
+		if err := m.Register(ctx, leader("a"), Singleton(true)); err != nil {
+			t.Fatal(err)
+		}
+		// the registered node can refresh
+		if err := m.Register(ctx, leader("a"), Singleton(true)); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Register(ctx, leader("b"), Singleton(true)); err != ErrSingleton {
+			t.Fatalf("Expected ErrSingleton, got %v", err)
+		}
+		two := &register.Service{Name: "other", Version: "1.0.0", Nodes: []*register.Node{{Id: "a"}, {Id: "b"}}}
+		if err := m.Register(ctx, two, Singleton(true)); err != ErrSingleton {
+			t.Fatalf("Expected ErrSingleton for several nodes, got %v", err)
+		}
+		if expect := []string{"a"}; !reflect.DeepEqual(nodes(m), expect) {
+			t.Fatalf("Expected nodes %v, got %v", expect, nodes(m))
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		m := newMemory(register.NewOptions())
+		if err := m.Register(ctx, leader("a"), Singleton(true), SingletonReplace(true)); err != nil {
+			t.Fatal(err)
+		}
+
+		m.Lock()
+		events, err := m.register(leader("b"), register.NewRegisterOptions(Singleton(true), SingletonReplace(true)))
+		m.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, e := range events {
+			for _, n := range e.Service.Nodes {
+				got = append(got, e.Action+"/"+n.Id)
+			}
+		}
+		if expect := []string{"delete/a", "update/b"}; !reflect.DeepEqual(got, expect) {
+			t.Fatalf("Expected events %v, got %v", expect, got)
+		}
+		if expect := []string{"b"}; !reflect.DeepEqual(nodes(m), expect) {
+			t.Fatalf("Expected nodes %v, got %v", expect, nodes(m))
+		}
+	})
+
+	t.Run("pinned", func(t *testing.T) {
+		m := newMemory(register.NewOptions())
+		if err := m.Register(ctx, leader("a"), Singleton(true), Pinned(true)); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Register(ctx, leader("b"), Singleton(true), SingletonReplace(true)); err != ErrPinned {
+			t.Fatalf("Expected ErrPinned, got %v", err)
+		}
+		if expect := []string{"a"}; !reflect.DeepEqual(nodes(m), expect) {
+			t.Fatalf("Expected the pinned node %v to stay, got %v", expect, nodes(m))
+		}
+	})
+
+	t.Run("static", func(t *testing.T) {
+		m := newMemory(register.NewOptions())
+		if err := m.Register(ctx, leader("a"), Singleton(true), Static(true)); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Register(ctx, leader("b"), Singleton(true), SingletonReplace(true)); err != ErrSingleton {
+			t.Fatalf("Expected ErrSingleton, got %v", err)
+		}
+		if expect := []string{"a"}; !reflect.DeepEqual(nodes(m), expect) {
+			t.Fatalf("Expected the static node %v to stay, got %v", expect, nodes(m))
+		}
+	})
+}
+
+func TestMemoryListNodeIDs(t *testing.T) {
+	m := newMemory(register.NewOptions())
+	ctx := context.TODO()
+
+	services := []struct {
+		srv    *register.Service
+		domain string
+	}{
+		{&register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-2"}, {Id: "foo-1"}}}, "a"},
+		{&register.Service{Name: "foo", Version: "2.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}, "a"},
+		{&register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}}, "a"},
+		{&register.Service{Name: "baz", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}, "b"},
+	}
+	for _, s := range services {
+		if err := m.Register(ctx, s.srv, register.RegisterDomain(s.domain)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		name   string
+		opts   []register.ListOption
+		expect []string
+	}{
+		{"domain", []register.ListOption{register.ListDomain("a")}, []string{"bar-1", "foo-1", "foo-2"}},
+		{"wildcard", []register.ListOption{register.ListDomain(register.WildcardDomain)}, []string{"bar-1", "foo-1", "foo-2"}},
+		{"prefixed", []register.ListOption{register.ListDomain(register.WildcardDomain), WithServicePrefix(true)}, []string{"bar/bar-1", "baz/foo-1", "foo/foo-1", "foo/foo-2"}},
+		{"missing", []register.ListOption{register.ListDomain("c")}, []string{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ids, err := m.ListNodeIDs(ctx, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ids, tc.expect) {
+				t.Fatalf("Expected node ids %v, got %v", tc.expect, ids)
+			}
+		})
+	}
+}
+
+func TestMemoryDependencyGraph(t *testing.T) {
+	m := newMemory(register.NewOptions())
+	ctx := context.TODO()
+
+	services := []struct {
+		srv    *register.Service
+		domain string
+	}{
+		{&register.Service{Name: "api", Version: "1.0.0", Metadata: map[string]string{"depends": "auth, users"}, Nodes: []*register.Node{{Id: "api-1"}}}, "a"},
+		{&register.Service{Name: "api", Version: "2.0.0", Metadata: map[string]string{"depends": "users,billing"}, Nodes: []*register.Node{{Id: "api-2"}}}, "a"},
+		{&register.Service{Name: "users", Version: "1.0.0", Metadata: map[string]string{"depends": "auth"}, Nodes: []*register.Node{{Id: "users-1"}}}, "a"},
+		{&register.Service{Name: "auth", Version: "1.0.0", Nodes: []*register.Node{{Id: "auth-1"}}}, "a"},
+		{&register.Service{Name: "billing", Version: "1.0.0", Metadata: map[string]string{"depends": "auth"}, Nodes: []*register.Node{{Id: "billing-1"}}}, "b"},
+	}
+	for _, s := range services {
+		if err := m.Register(ctx, s.srv, register.RegisterDomain(s.domain)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	graph, err := m.DependencyGraph(ctx, register.ListDomain("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"api":   {"auth", "billing", "users"},
+		"users": {"auth"},
+		"auth":  {},
+	}
+	if !reflect.DeepEqual(graph, expected) {
+		t.Fatalf("Expected the graph %v, got %v", expected, graph)
+	}
+
+	graph, err = m.DependencyGraph(ctx, register.ListDomain(register.WildcardDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected["billing"] = []string{"auth"}
+	if !reflect.DeepEqual(graph, expected) {
+		t.Fatalf("Expected the wildcard graph %v, got %v", expected, graph)
+	}
+}
+
+func TestMemoryNodeHash(t *testing.T) {
+	ctx := context.TODO()
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}, {Id: "foo-2"}}}
+
+	hashes := func(m *memory) map[string]string {
+		srvs, err := m.LookupService(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := make(map[string]string)
+		for _, n := range srvs[0].Nodes {
+			result[n.Id] = n.Metadata["nodeHash"]
+		}
+		return result
+	}
+
+	m := newMemory(register.NewOptions(NodeHash(true)))
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+	first := hashes(m)
+	if first["foo-1"] != "cbabb5afa3c5dfed" {
+		t.Fatalf("Expected the fnv hash of the node id, got %q", first["foo-1"])
+	}
+	if first["foo-1"] == first["foo-2"] {
+		t.Fatalf("Expected distinct hashes per node, got %v", first)
+	}
+	if got := hashes(m); !reflect.DeepEqual(got, first) {
+		t.Fatalf("Expected stable hashes across lookups %v, got %v", first, got)
+	}
+
+	// a restarted register computes the same hashes
+	restarted := newMemory(register.NewOptions(NodeHash(true)))
+	if err := restarted.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+	if got := hashes(restarted); !reflect.DeepEqual(got, first) {
+		t.Fatalf("Expected stable hashes across restarts %v, got %v", first, got)
+	}
+
+	disabled := newMemory(register.NewOptions())
+	if err := disabled.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+	if got := hashes(disabled); got["foo-1"] != "" {
+		t.Fatalf("Expected no node hash by default, got %v", got)
+	}
+}
+
+func TestMemorySeedFile(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.TODO()
+
+	valid := filepath.Join(dir, "valid.json")
+	if err := ioutil.WriteFile(valid, []byte(`[
+		{"name": "foo", "version": "1.0.0", "nodes": [{"id": "foo-1", "address": "10.0.0.1:8080"}]},
+		{"domain": "eu", "name": "bar", "version": "1.0.0", "metadata": {"team": "core"}, "nodes": [{"id": "bar-1", "address": "10.0.0.2:8080"}]}
+	]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewRegister(SeedFile(valid)).(*memory)
+	defer m.Disconnect(ctx)
+
+	if srvs, err := m.LookupService(ctx, "foo"); err != nil || len(srvs) != 1 || srvs[0].Nodes[0].Address != "10.0.0.1:8080" {
+		t.Fatalf("Expected foo in the default domain, got %+v, %v", srvs, err)
+	}
+	srvs, err := m.LookupService(ctx, "bar", register.LookupDomain("eu"))
+	if err != nil || len(srvs) != 1 || srvs[0].Metadata["team"] != "core" {
+		t.Fatalf("Expected bar in the eu domain, got %+v, %v", srvs, err)
+	}
+	m.RLock()
+	static := m.records["eu"]["bar"]["1.0.0"].Nodes["bar-1"].Static
+	m.RUnlock()
+	if !static {
+		t.Fatal("Expected the seeded nodes to be static")
+	}
+
+	testCases := []struct {
+		name    string
+		content string
+		expect  string
+	}{
+		{"malformed", `[{"name": "foo",]`, "invalid character"},
+		{"not an array", `{"name": "foo"}`, "cannot unmarshal"},
+		{"unnamed", `[{"version": "1.0.0"}]`, "service 0 has no name"},
+		{"rejected", `[{"name": "foo", "version": "1.0.0"}, {"name": "bar", "metadata": {"tier": "unknown"}}]`, ErrInvalidTier.Error()},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Replace(tc.name, " ", "-", -1)+".json")
+			if err := ioutil.WriteFile(path, []byte(tc.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := New(SeedFile(path))
+			if m != nil || err == nil || !strings.Contains(err.Error(), path) || !strings.Contains(err.Error(), tc.expect) {
+				t.Fatalf("Expected an error naming %s and %q, got %v, %v", path, tc.expect, m, err)
+			}
+
+			// NewRegister logs the error and starts without the seed
+			r := NewRegister(SeedFile(path))
+			defer r.Disconnect(context.TODO())
+			if _, err := r.LookupService(context.TODO(), "foo"); err != register.ErrNotFound {
+				t.Fatalf("Expected no seeded services, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryDeregisterBatch(t *testing.T) {
+	ctx := context.TODO()
+	m := NewRegister(EventQueue(16, QueueBlock), EventTimeout(time.Second)).(*memory)
+	defer m.Disconnect(ctx)
+
+	w, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	foo := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}, {Id: "foo-2"}, {Id: "foo-3"}}}
+	bar := &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}}
+	for _, srv := range []*register.Service{foo, bar} {
+		if err := m.Register(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch := []*register.Service{
+		{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}},
+		{Name: "missing", Version: "1.0.0", Nodes: []*register.Node{{Id: "missing-1"}}},
+		{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-2"}}},
+		{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}},
+	}
+
+	if err := m.DeregisterBatch(ctx, batch, DeregisterStrict(true)); !errors.Is(err, register.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound in strict mode, got %v", err)
+	}
+	if srvs, err := m.LookupService(ctx, "foo"); err != nil || len(srvs[0].Nodes) != 3 {
+		t.Fatalf("Expected the failed batch to change nothing, got %+v, %v", srvs, err)
+	}
+
+	if err := m.DeregisterBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	if srvs, err := m.LookupService(ctx, "foo"); err != nil || len(srvs[0].Nodes) != 1 || srvs[0].Nodes[0].Id != "foo-3" {
+		t.Fatalf("Expected only foo-3 left, got %+v, %v", srvs, err)
+	}
+	if _, err := m.LookupService(ctx, "bar"); err != register.ErrNotFound {
+		t.Fatalf("Expected bar to be removed, got %v", err)
+	}
+
+	// a single event per service version of the batch
+	if err := m.Register(ctx, &register.Service{Name: "marker", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for len(got) == 0 || got[len(got)-1] != "create/marker" {
+		r, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r.Action+"/"+r.Service.Name)
+	}
+	if expect := []string{"create/foo", "create/bar", "update/foo", "delete/bar", "create/marker"}; !reflect.DeepEqual(got, expect) {
+		t.Fatalf("Expected events %v, got %v", expect, got)
+	}
+}
+
+func TestMemoryNodeTTL(t *testing.T) {
+	m := newMemory(register.NewOptions())
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, srv, register.RegisterTTL(30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	other := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-2"}}}
+	if err := m.Register(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+
+	// the configured TTL is returned whatever the time elapsed
+	time.Sleep(10 * time.Millisecond)
+	if ttl, err := m.NodeTTL(register.DefaultDomain, "foo", "1.0.0", "foo-1"); err != nil || ttl != 30*time.Second {
+		t.Fatalf("Expected a TTL of 30s, got %v, %v", ttl, err)
+	}
+	if ttl, err := m.NodeTTL(register.DefaultDomain, "foo", "1.0.0", "foo-2"); err != nil || ttl != 0 {
+		t.Fatalf("Expected no TTL, got %v, %v", ttl, err)
+	}
+	if _, err := m.NodeTTL(register.DefaultDomain, "foo", "1.0.0", "foo-3"); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for an unknown node, got %v", err)
+	}
+	if _, err := m.NodeTTL(register.DefaultDomain, "bar", "1.0.0", "foo-1"); err != register.ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for an unknown service, got %v", err)
+	}
+}
+
+func TestMemoryNamePattern(t *testing.T) {
+	m := newMemory(register.NewOptions())
+	ctx := context.TODO()
+
+	services := []struct {
+		srv    *register.Service
+		domain string
+	}{
+		{&register.Service{Name: "payments.api", Version: "1.0.0"}, "a"},
+		{&register.Service{Name: "payments.api", Version: "2.0.0"}, "a"},
+		{&register.Service{Name: "payments.worker", Version: "1.0.0"}, "b"},
+		{&register.Service{Name: "billing.api", Version: "1.0.0"}, "a"},
+	}
+	for _, s := range services {
+		if err := m.Register(ctx, s.srv, register.RegisterDomain(s.domain)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		name    string
+		pattern string
+		domain  string
+		expect  []string
+	}{
+		{"domain", "payments.*", "a", []string{"a/payments.api/1.0.0", "a/payments.api/2.0.0"}},
+		{"wildcard", "payments.*", register.WildcardDomain, []string{"a/payments.api/1.0.0", "a/payments.api/2.0.0", "b/payments.worker/1.0.0"}},
+		{"suffix", "*.api", register.WildcardDomain, []string{"a/billing.api/1.0.0", "a/payments.api/1.0.0", "a/payments.api/2.0.0"}},
+		{"single character", "payments.ap?", "a", []string{"a/payments.api/1.0.0", "a/payments.api/2.0.0"}},
+		{"no match", "orders.*", register.WildcardDomain, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srvs, err := m.LookupService(ctx, "", NamePattern(tc.pattern), register.LookupDomain(tc.domain))
+			if tc.expect == nil {
+				if err != register.ErrNotFound {
+					t.Fatalf("Expected ErrNotFound, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, s := range srvs {
+				got = append(got, s.Metadata["domain"]+"/"+s.Name+"/"+s.Version)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.expect) {
+				t.Fatalf("Expected %v, got %v", tc.expect, got)
+			}
+		})
+	}
+}
+
+func TestMemoryInternMetadata(t *testing.T) {
+	m := newMemory(register.NewOptions(InternMetadata(true)))
+	ctx := context.TODO()
+
+	// build the values at runtime so each node gets its own copy
+	zone := func() string { return strings.Join([]string{"eu", "west", "1a"}, "-") }
+	for i := 0; i < 3; i++ {
+		srv := &register.Service{
+			Name:     "foo",
+			Version:  fmt.Sprintf("1.0.%d", i),
+			Metadata: map[string]string{"region": zone()},
+			Nodes:    []*register.Node{{Id: fmt.Sprintf("foo-%d", i), Metadata: map[string]string{"zone": zone(), "index": fmt.Sprint(i)}}},
+		}
+		if err := m.Register(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srvs, err := m.LookupService(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(srvs, func(i, j int) bool { return srvs[i].Version < srvs[j].Version })
+	for i, srv := range srvs {
+		if srv.Metadata["region"] != "eu-west-1a" {
+			t.Fatalf("Expected the region to round-trip, got %q", srv.Metadata["region"])
+		}
+		expect := metadata.Metadata{"zone": "eu-west-1a", "index": fmt.Sprint(i), "domain": register.DefaultDomain}
+		if !reflect.DeepEqual(srv.Nodes[0].Metadata, expect) {
+			t.Fatalf("Expected node metadata %v, got %v", expect, srv.Nodes[0].Metadata)
+		}
+	}
+
+	// the stored values share their storage
+	data := func(s string) uintptr {
+		return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+	}
+	m.RLock()
+	a := m.records[register.DefaultDomain]["foo"]["1.0.0"]
+	b := m.records[register.DefaultDomain]["foo"]["1.0.1"]
+	shared := data(a.Nodes["foo-0"].Metadata["zone"]) == data(b.Nodes["foo-1"].Metadata["zone"]) &&
+		data(a.Metadata["region"]) == data(b.Nodes["foo-1"].Metadata["zone"])
+	m.RUnlock()
+	if !shared {
+		t.Fatal("Expected the equal metadata values to share their storage")
+	}
+}
+
+func benchmarkRetainedMetadata(b *testing.B, opts ...register.Option) {
+	const nodes = 1000
+	ctx := context.TODO()
+	var retained uint64
+
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		m := newMemory(register.NewOptions(opts...))
+		for n := 0; n < nodes; n++ {
+			// distinct copies of the same metadata as decoded from the wire
+			md := make(map[string]string)
+			for k, v := range map[string]string{
+				"topology.kubernetes.io/region":    "europe-west1",
+				"topology.kubernetes.io/zone":      "europe-west1-b",
+				"node.kubernetes.io/instance-type": "n2-standard-8",
+			} {
+				md[string([]byte(k))] = string([]byte(v))
+			}
+			srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: fmt.Sprintf("foo-%d", n), Metadata: md}}}
+			if err := m.Register(ctx, srv); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		// let the event goroutines holding the registered services finish
+		time.Sleep(50 * time.Millisecond)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		retained += after.HeapAlloc - before.HeapAlloc
+		runtime.KeepAlive(m)
+	}
+
+	b.ReportMetric(float64(retained)/float64(b.N*nodes), "retained-B/node")
+}
+
+func BenchmarkRetainedMetadata(b *testing.B) {
+	benchmarkRetainedMetadata(b)
+}
+
+func BenchmarkRetainedMetadataInterned(b *testing.B) {
+	benchmarkRetainedMetadata(b, InternMetadata(true))
+}
+
+func TestMemoryMaintenance(t *testing.T) {
+	start := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	m := newMemory(register.NewOptions(Clock(func() time.Time { return now })))
+	ctx := context.TODO()
+
+	foo := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, foo, register.RegisterTTL(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	prune := func() {
+		m.Lock()
+		m.prune()
+		m.Unlock()
+	}
+	nodes := func() int {
+		srvs, err := m.LookupService(ctx, "foo")
+		if err == register.ErrNotFound {
+			return 0
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return len(srvs[0].Nodes)
+	}
+
+	// the node aged 50s before the freeze
+	now = start.Add(50 * time.Second)
+	m.SetMaintenance(true)
+
+	bar := &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}}
+	if err := m.Register(ctx, bar); err != ErrMaintenance {
+		t.Fatalf("Expected ErrMaintenance on register, got %v", err)
+	}
+	if err := m.Deregister(ctx, foo); err != ErrMaintenance {
+		t.Fatalf("Expected ErrMaintenance on deregister, got %v", err)
+	}
+	if err := m.DeregisterService(ctx, register.DefaultDomain, "foo"); err != ErrMaintenance {
+		t.Fatalf("Expected ErrMaintenance on service deregister, got %v", err)
+	}
+
+	// every other change is frozen as well
+	changes := map[string]func() error{
+		"batch deregister": func() error { return m.DeregisterBatch(ctx, []*register.Service{foo}) },
+		"compare and deregister": func() error {
+			_, err := m.CompareAndDeregister(ctx, register.DefaultDomain, "foo", "1.0.0", "foo-1", "")
+			return err
+		},
+		"node error":   func() error { return m.SetNodeError(register.DefaultDomain, "foo", "1.0.0", "foo-1", "failed") },
+		"node drained": func() error { return m.SetNodeDrained(register.DefaultDomain, "foo", "1.0.0", "foo-1", true) },
+		"node ready":   func() error { return m.SetNodeReady(register.DefaultDomain, "foo", "1.0.0", "foo-1", false) },
+		"rename":       func() error { return m.RenameDomain(register.DefaultDomain, "other") },
+		"promote":      func() error { return m.PromoteVersion(register.DefaultDomain, "foo", "1.0.0") },
+		"touch": func() error {
+			_, err := m.TouchAll(register.DefaultDomain)
+			return err
+		},
+		"domain ttl":  func() error { return m.SetDomainTTL(register.DefaultDomain, time.Minute) },
+		"schema":      func() error { return m.SetSchema(register.DefaultDomain, "foo", "1.0.0", []byte("{}")) },
+		"transaction": func() error { return m.Transaction(func(tx *Tx) error { return nil }) },
+	}
+	for name, change := range changes {
+		if err := change(); err != ErrMaintenance {
+			t.Fatalf("Expected ErrMaintenance on %s, got %v", name, err)
+		}
+	}
+
+	// reads and watches are available and nothing expires
+	now = start.Add(time.Hour)
+	prune()
+	if n := nodes(); n != 1 {
+		t.Fatalf("Expected the node to be kept during the maintenance, got %d nodes", n)
+	}
+	w, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Expected watches during the maintenance, got %v", err)
+	}
+	w.Stop()
+
+	// the node resumes with the age it had when frozen
+	m.SetMaintenance(false)
+	prune()
+	if n := nodes(); n != 1 {
+		t.Fatalf("Expected no expiry when the maintenance ends, got %d nodes", n)
+	}
+	now = start.Add(time.Hour + 5*time.Second)
+	if prune(); nodes() != 1 {
+		t.Fatal("Expected the node to be alive within its TTL")
+	}
+	now = start.Add(time.Hour + 15*time.Second)
+	if prune(); nodes() != 0 {
+		t.Fatal("Expected the node to expire once its TTL passed")
+	}
+
+	if err := m.Register(ctx, bar); err != nil {
+		t.Fatalf("Expected writes after the maintenance, got %v", err)
+	}
+}
+
+func TestMemoryDomainTTL(t *testing.T) {
+	start := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	m := newMemory(register.NewOptions(Clock(func() time.Time { return now })))
+	ctx := context.TODO()
+
+	if err := m.SetDomainTTL("fast", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetDomainTTL("slow", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	registrations := []struct {
+		domain string
+		id     string
+		opts   []register.RegisterOption
+	}{
+		{"fast", "fast-1", nil},
+		{"slow", "slow-1", nil},
+		// an explicit TTL takes precedence over the domain default
+		{"fast", "fast-2", []register.RegisterOption{register.RegisterTTL(time.Minute)}},
+		{"other", "other-1", nil},
+	}
+	for _, r := range registrations {
+		srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: r.id}}}
+		if err := m.Register(ctx, srv, append(r.opts, register.RegisterDomain(r.domain))...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ttl, err := m.NodeTTL("fast", "foo", "1.0.0", "fast-1"); err != nil || ttl != 10*time.Second {
+		t.Fatalf("Expected the fast domain TTL, got %v, %v", ttl, err)
+	}
+
+	alive := func() []string {
+		m.Lock()
+		m.prune()
+		m.Unlock()
+
+		ids, err := m.ListNodeIDs(ctx, register.ListDomain(register.WildcardDomain))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+
+	now = start.Add(30 * time.Second)
+	if expect := []string{"fast-2", "other-1", "slow-1"}; !reflect.DeepEqual(alive(), expect) {
+		t.Fatalf("Expected nodes %v, got %v", expect, alive())
+	}
+
+	now = start.Add(2 * time.Minute)
+	if expect := []string{"other-1"}; !reflect.DeepEqual(alive(), expect) {
+		t.Fatalf("Expected nodes %v, got %v", expect, alive())
+	}
+
+	// removing the default only affects the next registrations
+	if err := m.SetDomainTTL("slow", 0); err != nil {
+		t.Fatal(err)
+	}
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "slow-2"}}}
+	if err := m.Register(ctx, srv, register.RegisterDomain("slow")); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := m.NodeTTL("slow", "foo", "1.0.0", "slow-2"); err != nil || ttl != 0 {
+		t.Fatalf("Expected no TTL once the default was removed, got %v, %v", ttl, err)
+	}
+}
+
+func TestMemoryRegisterValidator(t *testing.T) {
+	errHostTaken := errors.New("host already runs the service")
+
+	// no two nodes of a service on the same host
+	antiAffinity := func(s *register.Service, existing []*register.Service) error {
+		hosts := make(map[string]string)
+		for _, srv := range existing {
+			for _, n := range srv.Nodes {
+				hosts[n.Metadata["host"]] = n.Id
+			}
+		}
+		for _, n := range s.Nodes {
+			if id, ok := hosts[n.Metadata["host"]]; ok && id != n.Id {
+				return fmt.Errorf("%w: node %s on %s", errHostTaken, id, n.Metadata["host"])
+			}
+			hosts[n.Metadata["host"]] = n.Id
+		}
+		return nil
+	}
+
+	m := newMemory(register.NewOptions(RegisterValidator(antiAffinity)))
+	ctx := context.TODO()
+
+	node := func(id, host string) *register.Node {
+		return &register.Node{Id: id, Metadata: map[string]string{"host": host}}
+	}
+
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{node("foo-1", "host-a")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{node("foo-2", "host-b")}}); err != nil {
+		t.Fatal(err)
+	}
+	// the constraint spans the versions of the service
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "2.0.0", Nodes: []*register.Node{node("foo-3", "host-a")}}); !errors.Is(err, errHostTaken) {
+		t.Fatalf("Expected the duplicate host to be rejected, got %v", err)
+	}
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{node("foo-4", "host-c"), node("foo-5", "host-c")}}); !errors.Is(err, errHostTaken) {
+		t.Fatalf("Expected the duplicate host within the registration to be rejected, got %v", err)
+	}
+	// other services can share the host
+	if err := m.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{node("bar-1", "host-a")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := m.ListNodeIDs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"bar-1", "foo-1", "foo-2"}; !reflect.DeepEqual(ids, expect) {
+		t.Fatalf("Expected the rejected registrations not to be applied, got %v", ids)
+	}
+}
+
+func TestMemoryWAL(t *testing.T) {
+	ctx := context.TODO()
+	wal := &bytes.Buffer{}
+	m := newMemory(register.NewOptions(WALWriter(wal)))
+
+	ops := []func() error{
+		func() error {
+			return m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Metadata: map[string]string{"team": "core"}, Nodes: []*register.Node{{Id: "foo-1", Address: "10.0.0.1:8080"}, {Id: "foo-2"}}})
+		},
+		func() error {
+			return m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Metadata: map[string]string{"team": "core"}, Nodes: []*register.Node{{Id: "foo-3", Metadata: map[string]string{"zone": "a"}}}})
+		},
+		func() error {
+			return m.Deregister(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}})
+		},
+		func() error {
+			return m.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}}, register.RegisterDomain("eu"))
+		},
+		func() error {
+			return m.Register(ctx, &register.Service{Name: "baz", Version: "1.0.0", Nodes: []*register.Node{{Id: "baz-1"}}}, register.RegisterDomain("eu"))
+		},
+		func() error {
+			return m.Deregister(ctx, &register.Service{Name: "baz", Version: "1.0.0", Nodes: []*register.Node{{Id: "baz-1"}}}, register.DeregisterDomain("eu"))
+		},
+		func() error {
+			return m.Register(ctx, &register.Service{Name: "qux", Version: "1.0.0", Nodes: []*register.Node{{Id: "qux-1"}}})
+		},
+		func() error {
+			return m.DeregisterService(ctx, register.DefaultDomain, "qux")
+		},
+	}
+	for _, op := range ops {
+		if err := op(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replayed := newMemory(register.NewOptions())
+	if err := replayed.ReplayWAL(bytes.NewReader(wal.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	dump := func(m *memory) map[string][]*register.Service {
+		d, err := m.Dump(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, srvs := range d {
+			for _, s := range srvs {
+				sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].Id < s.Nodes[j].Id })
+			}
+		}
+		return d
+	}
+	if expect, got := dump(m), dump(replayed); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("Expected the replayed state %+v, got %+v", expect, got)
+	}
+
+	ids, err := replayed.ListNodeIDs(ctx, register.ListDomain(register.WildcardDomain), WithServicePrefix(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"bar/bar-1", "foo/foo-2", "foo/foo-3"}; !reflect.DeepEqual(ids, expect) {
+		t.Fatalf("Expected the replayed nodes %v, got %v", expect, ids)
+	}
+
+	// a torn entry is reported
+	if err := newMemory(register.NewOptions()).ReplayWAL(bytes.NewReader(wal.Bytes()[:wal.Len()-1])); !errors.Is(err, ErrInvalidEncoding) {
+		t.Fatalf("Expected ErrInvalidEncoding for a truncated WAL, got %v", err)
+	}
+}
+
+func TestMemoryWALState(t *testing.T) {
+	ctx := context.TODO()
+	wal := &bytes.Buffer{}
+	m := newMemory(register.NewOptions(WALWriter(wal)))
+
+	ops := []func() error{
+		func() error {
+			return m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}, {Id: "foo-2"}, {Id: "foo-3"}}})
+		},
+		func() error {
+			return m.Register(ctx, &register.Service{Name: "foo", Version: "2.0.0", Nodes: []*register.Node{{Id: "foo-4"}}})
+		},
+		func() error { return m.PromoteVersion(register.DefaultDomain, "foo", "1.0.0") },
+		func() error { return m.PromoteVersion(register.DefaultDomain, "foo", "2.0.0") },
+		func() error { return m.SetNodeReady(register.DefaultDomain, "foo", "1.0.0", "foo-1", false) },
+		func() error { return m.SetNodeDrained(register.DefaultDomain, "foo", "1.0.0", "foo-2", true) },
+		func() error { return m.SetNodeError(register.DefaultDomain, "foo", "1.0.0", "foo-3", "failed") },
+		func() error {
+			return m.Register(ctx, &register.Service{Name: "foo", Version: "2.0.0", Nodes: []*register.Node{{Id: "foo-4"}}}, Pinned(true), Static(true))
+		},
+	}
+	for _, op := range ops {
+		if err := op(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replayed := newMemory(register.NewOptions())
+	if err := replayed.ReplayWAL(bytes.NewReader(wal.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	dump := func(m *memory) map[string][]*register.Service {
+		d, err := m.Dump(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, srvs := range d {
+			sort.Slice(srvs, func(i, j int) bool { return srvs[i].Version < srvs[j].Version })
+			for _, s := range srvs {
+				sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].Id < s.Nodes[j].Id })
+			}
+		}
+		return d
+	}
+	if expect, got := dump(m), dump(replayed); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("Expected the replayed state %+v, got %+v", expect, got)
+	}
+
+	rec := replayed.records[register.DefaultDomain]["foo"]
+	if rec["1.0.0"].Metadata["primary"] == "true" || rec["2.0.0"].Metadata["primary"] != "true" {
+		t.Fatalf("Expected 2.0.0 to be the replayed primary version")
+	}
+	if n := rec["2.0.0"].Nodes["foo-4"]; !rec["2.0.0"].Pinned || !n.Static {
+		t.Fatalf("Expected the replayed version to be pinned and its node static")
+	}
+
+	// a cleared error is logged as well
+	if err := m.SetNodeError(register.DefaultDomain, "foo", "1.0.0", "foo-3", ""); err != nil {
+		t.Fatal(err)
+	}
+	replayed = newMemory(register.NewOptions())
+	if err := replayed.ReplayWAL(bytes.NewReader(wal.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if n := replayed.records[register.DefaultDomain]["foo"]["1.0.0"].Nodes["foo-3"]; len(n.LastError) > 0 {
+		t.Fatalf("Expected the replayed error to be cleared, got %q", n.LastError)
+	}
+
+	// a replica never replays a WAL
+	replica := &memory{upstream: m}
+	if err := replica.ReplayWAL(bytes.NewReader(wal.Bytes())); err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly, got %v", err)
+	}
+}
+
+func TestMemoryWALSchemaTTL(t *testing.T) {
+	ctx := context.TODO()
+	wal := &bytes.Buffer{}
+	m := newMemory(register.NewOptions(WALWriter(wal)))
+
+	ops := []func() error{
+		func() error {
+			return m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}, register.RegisterDomain("old"))
+		},
+		func() error { return m.SetSchema("old", "foo", "1.0.0", []byte(`{"openapi": "3.0.0"}`)) },
+		func() error { return m.SetDomainTTL("old", time.Minute) },
+		func() error { return m.SetDomainTTL("eu", time.Hour) },
+		func() error { return m.SetDomainTTL("eu", 0) },
+		func() error { return m.RenameDomain("old", "new") },
+	}
+	for _, op := range ops {
+		if err := op(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replayed := newMemory(register.NewOptions())
+	if err := replayed.ReplayWAL(bytes.NewReader(wal.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	schema, err := replayed.GetSchema("new", "foo", "1.0.0")
+	if err != nil || string(schema) != `{"openapi": "3.0.0"}` {
+		t.Fatalf("Expected the replayed schema, got %q, %v", schema, err)
+	}
+	if !reflect.DeepEqual(replayed.domainTTLs, map[string]time.Duration{"new": time.Minute}) {
+		t.Fatalf("Expected the replayed domain TTLs, got %v", replayed.domainTTLs)
+	}
+}
+
+func TestMemoryWALExpiry(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := Clock(func() time.Time { return now })
+	ctx := context.TODO()
+	wal := &bytes.Buffer{}
+	m := newMemory(register.NewOptions(WALWriter(wal), clock))
+
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}, register.RegisterTTL(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-2"}}}, register.RegisterTTL(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// foo-2 expires and its expiry is logged
+	now = now.Add(30 * time.Second)
+	m.Lock()
+	m.prune()
+	m.Unlock()
+
+	replayed := newMemory(register.NewOptions(clock))
+	if err := replayed.ReplayWAL(bytes.NewReader(wal.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := replayed.NodeTTL(register.DefaultDomain, "foo", "1.0.0", "foo-1"); err != nil || ttl != time.Minute {
+		t.Fatalf("Expected foo-1 to keep its TTL, got %v, %v", ttl, err)
+	}
+	if _, err := replayed.NodeTTL(register.DefaultDomain, "foo", "1.0.0", "foo-2"); err != register.ErrNotFound {
+		t.Fatalf("Expected the expired foo-2 to stay removed, got %v", err)
+	}
+	srvs, err := replayed.LookupService(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srvs[0].Nodes[0].Metadata[walTTLKey]; ok {
+		t.Fatalf("Expected the WAL metadata to be removed, got %v", srvs[0].Nodes[0].Metadata)
+	}
+
+	// the replayed node expires again
+	now = now.Add(2 * time.Minute)
+	replayed.Lock()
+	replayed.prune()
+	replayed.Unlock()
+	if ids, err := replayed.ListNodeIDs(ctx); err != nil || len(ids) != 0 {
+		t.Fatalf("Expected the replayed node to expire, got %v, %v", ids, err)
+	}
+}
+
+func TestMemoryWALOrder(t *testing.T) {
+	ctx := context.TODO()
+	wal := &bytes.Buffer{}
+	m := newMemory(register.NewOptions(WALWriter(wal)))
+
+	// without an event queue the changes still log in commit order
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: fmt.Sprintf("foo-%d", j%5)}}}
+				if (i+j)%2 == 0 {
+					_ = m.Register(ctx, srv)
+				} else {
+					_ = m.Deregister(ctx, srv)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// a rolled back transaction logs nothing
+	pinned := &register.Service{Name: "baz", Version: "1.0.0", Nodes: []*register.Node{{Id: "baz-1"}}}
+	if err := m.Register(ctx, pinned, Pinned(true)); err != nil {
+		t.Fatal(err)
+	}
+	size := wal.Len()
+	if err := m.Transaction(func(tx *Tx) error {
+		tx.Register(&register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}})
+		tx.Deregister(pinned)
+		return nil
+	}); err != ErrPinned {
+		t.Fatalf("Expected error: %v, got: %v", ErrPinned, err)
+	}
+	if wal.Len() != size {
+		t.Fatalf("Expected the rolled back transaction to log nothing, got %d bytes", wal.Len()-size)
+	}
+
+	replayed := newMemory(register.NewOptions())
+	if err := replayed.ReplayWAL(bytes.NewReader(wal.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	expect, err := m.ListNodeIDs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := replayed.ListNodeIDs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("Expected the replayed nodes %v, got %v", expect, got)
+	}
+}
@@ -0,0 +1,58 @@
+package memory
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+)
+
+// metric is a single metric family of the exposition
+type metric struct {
+	name  string
+	typ   string
+	help  string
+	value float64
+}
+
+// WriteMetrics writes the register stats in the OpenMetrics text format, the
+// output can be served as is by an http handler
+func (m *memory) WriteMetrics(w io.Writer) error {
+	stats := m.Stats()
+
+	var quotaWarning float64
+	if stats.QuotaWarning {
+		quotaWarning = 1
+	}
+
+	metrics := []metric{
+		{name: "register_memory_services", typ: "gauge", help: "Number of service versions across all domains.", value: float64(stats.Services)},
+		{name: "register_memory_nodes", typ: "gauge", help: "Number of nodes across all domains.", value: float64(stats.Nodes)},
+		{name: "register_memory_watchers", typ: "gauge", help: "Number of active watchers.", value: float64(stats.Watchers)},
+		{name: "register_memory_quota_warning", typ: "gauge", help: "Whether the services exceed the soft limit.", value: quotaWarning},
+		{name: "register_memory_dropped_events", typ: "counter", help: "Events dropped by the full event queue.", value: float64(stats.DroppedEvents)},
+		{name: "register_memory_delivered_events", typ: "counter", help: "Events received by unbuffered watchers.", value: float64(stats.DeliveredEvents)},
+		{name: "register_memory_delivery_latency_p50_seconds", typ: "gauge", help: "Median of the recent event delivery latencies.", value: seconds(stats.DeliveryLatencyP50)},
+		{name: "register_memory_delivery_latency_p99_seconds", typ: "gauge", help: "99th percentile of the recent event delivery latencies.", value: seconds(stats.DeliveryLatencyP99)},
+		{name: "register_memory_delivery_latency_max_seconds", typ: "gauge", help: "Maximum event delivery latency.", value: seconds(stats.DeliveryLatencyMax)},
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, mt := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n", mt.name, mt.help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", mt.name, mt.typ)
+		name := mt.name
+		if mt.typ == "counter" {
+			name += "_total"
+		}
+		fmt.Fprintf(bw, "%s %v\n", name, mt.value)
+	}
+	fmt.Fprint(bw, "# EOF\n")
+
+	return bw.Flush()
+}
+
+// seconds returns the duration in seconds
+func seconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Second)
+}
@@ -0,0 +1,1235 @@
+package memory
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/unistack-org/micro/v3/register"
+)
+
+type pruneIntervalKey struct{}
+
+// PruneInterval sets how often expired nodes are pruned
+func PruneInterval(d time.Duration) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, pruneIntervalKey{}, d)
+	}
+}
+
+type eventTimeoutKey struct{}
+
+// EventTimeout sets how long an event waits for a watcher before it's dropped
+func EventTimeout(d time.Duration) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, eventTimeoutKey{}, d)
+	}
+}
+
+type maxServicesKey struct{}
+
+// MaxServices limits the number of service versions across all domains
+func MaxServices(n int) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, maxServicesKey{}, n)
+	}
+}
+
+type queueKey struct{}
+
+type queueOptions struct {
+	size   int
+	policy QueuePolicy
+}
+
+// EventQueue dispatches the events in order from a queue of the size
+// instead of one goroutine per event, the policy applies when the queue is
+// full and the dropped events are counted in Stats
+func EventQueue(size int, policy QueuePolicy) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, queueKey{}, queueOptions{size: size, policy: policy})
+	}
+}
+
+func getQueue(ctx context.Context) (int, QueuePolicy, bool) {
+	if ctx == nil {
+		return 0, QueueBlock, false
+	}
+	v, ok := ctx.Value(queueKey{}).(queueOptions)
+	return v.size, v.policy, ok
+}
+
+type seedFileKey struct{}
+
+// SeedFile registers the services of the JSON file as static services when
+// the register is created, the file holds an array of services with an
+// optional domain field, e.g. [{"domain": "eu", "name": "foo", "nodes": [...]}].
+// None of the services of a file failing to load are registered, New returns
+// the error and NewRegister logs it and starts without them.
+func SeedFile(path string) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, seedFileKey{}, path)
+	}
+}
+
+type internMetadataKey struct{}
+
+// InternMetadata shares the storage of the equal metadata keys and values of
+// the registered services and nodes, saving memory in large registers where
+// many nodes carry the same region or zone. The interned strings are kept for
+// the lifetime of the register.
+func InternMetadata(b bool) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, internMetadataKey{}, b)
+	}
+}
+
+type nodeHashKey struct{}
+
+// NodeHash sets the stable hash of the node id in the nodeHash metadata of
+// the nodes registered from then on, clients can use it for session affinity
+func NodeHash(b bool) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, nodeHashKey{}, b)
+	}
+}
+
+type eventSequenceKey struct{}
+
+// EventSequence stamps every sent event with its sequence number in the
+// sequence metadata, the number increases by one per event so watchers can
+// detect the events they missed
+func EventSequence(b bool) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, eventSequenceKey{}, b)
+	}
+}
+
+type dispatchWorkersKey struct{}
+
+// DispatchWorkers shards the watchers by id across n dispatch workers of the
+// EventQueue so a slow watcher only delays the watchers of its shard, the
+// events are delivered in order within a shard and the queue policy applies
+// to each shard
+func DispatchWorkers(n int) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, dispatchWorkersKey{}, n)
+	}
+}
+
+type maxWatchersKey struct{}
+
+// MaxWatchers limits the number of active watchers, Watch returns
+// ErrLimitExceeded once the limit is reached
+func MaxWatchers(n int) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, maxWatchersKey{}, n)
+	}
+}
+
+type softMaxServicesKey struct{}
+
+// SoftMaxServices logs a warning and sets the QuotaWarning stat when the
+// number of service versions exceeds n, registration still proceeds
+func SoftMaxServices(n int) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, softMaxServicesKey{}, n)
+	}
+}
+
+type loaderKey struct{}
+
+// Loader is called by LookupService when the service is missing from a
+// domain, the loaded services are registered into the domain before the
+// lookup returns, concurrent misses of a service share a single call,
+// wildcard lookups and lookups during the maintenance don't use the loader
+func Loader(fn func(context.Context, string) ([]*register.Service, error)) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, loaderKey{}, fn)
+	}
+}
+
+func getLoader(ctx context.Context) func(context.Context, string) ([]*register.Service, error) {
+	if ctx == nil {
+		return nil
+	}
+	v, _ := ctx.Value(loaderKey{}).(func(context.Context, string) ([]*register.Service, error))
+	return v
+}
+
+type walKey struct{}
+
+// WALWriter appends every change to the write-ahead log in the order of the
+// changes, registrations carry the node TTLs and expired nodes are logged as
+// removals, the schemas and the domain TTLs are logged as they are set.
+// Each entry is the EncodeResult encoding prefixed by its big endian uint32
+// size and can be replayed with ReplayWAL.
+func WALWriter(w io.Writer) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, walKey{}, w)
+	}
+}
+
+func getWAL(ctx context.Context) io.Writer {
+	if ctx == nil {
+		return nil
+	}
+	v, _ := ctx.Value(walKey{}).(io.Writer)
+	return v
+}
+
+type validatorKey struct{}
+
+// RegisterValidator is called by Register with the service and a copy of the
+// registered versions of the service in the domain before any change, an
+// error aborts the registration and is returned as is. Identical
+// registrations only refreshing the nodes aren't validated. The validator is
+// called with the register lock held and must not use the register.
+func RegisterValidator(fn func(*register.Service, []*register.Service) error) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, validatorKey{}, fn)
+	}
+}
+
+func getValidator(ctx context.Context) func(*register.Service, []*register.Service) error {
+	if ctx == nil {
+		return nil
+	}
+	v, _ := ctx.Value(validatorKey{}).(func(*register.Service, []*register.Service) error)
+	return v
+}
+
+type domainEventsKey struct{}
+
+// DomainEvents sends a create event when a domain gets its first service and
+// a delete event when it loses its last one, the events have the event
+// metadata set to domain, no service name and are only delivered to the
+// wildcard domain watchers
+func DomainEvents(b bool) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, domainEventsKey{}, b)
+	}
+}
+
+type pruneEmptyKey struct{}
+
+// PruneEmpty removes the versions left without nodes once their nodes expired,
+// and then the empty services and domains, a delete event is sent per version
+func PruneEmpty(b bool) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, pruneEmptyKey{}, b)
+	}
+}
+
+type replicaOfKey struct{}
+
+// ReplicaOf makes the register a read only replica of the upstream register,
+// it is bootstrapped from the upstream services and then kept in sync with
+// the upstream events, every change to the register returns ErrReadOnly
+func ReplicaOf(r register.Register) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, replicaOfKey{}, r)
+	}
+}
+
+func getReplicaOf(ctx context.Context) register.Register {
+	if ctx == nil {
+		return nil
+	}
+	v, _ := ctx.Value(replicaOfKey{}).(register.Register)
+	return v
+}
+
+type nodePoolKey struct{}
+
+// NodePool recycles the nodes removed from the register for the next
+// registrations, reducing the allocations of high churn registers
+func NodePool(b bool) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, nodePoolKey{}, b)
+	}
+}
+
+type maxSchemaKey struct{}
+
+// MaxSchemaBytes limits the size of the schema documents set with SetSchema,
+// it defaults to 1MiB
+func MaxSchemaBytes(n int) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, maxSchemaKey{}, n)
+	}
+}
+
+type maxMetadataKey struct{}
+
+// MaxMetadataBytes limits the summed length of the service and node
+// metadata keys and values of a registration
+func MaxMetadataBytes(n int) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, maxMetadataKey{}, n)
+	}
+}
+
+type addressCheckKey struct{}
+
+// DuplicateAddressCheck detects nodes registering the address of another
+// node of the same service version, duplicates are logged as warnings or
+// rejected with ErrDuplicateAddress in strict mode
+func DuplicateAddressCheck(strict bool) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, addressCheckKey{}, strict)
+	}
+}
+
+type readyRefreshKey struct{}
+
+// RefreshOnlyReady makes Register refresh the TTL only for the nodes with
+// the ready metadata not set to false, nodes stuck not ready expire
+func RefreshOnlyReady(b bool) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, readyRefreshKey{}, b)
+	}
+}
+
+type uniqueNodesKey struct{}
+
+// UniqueNodeVersions rejects nodes already registered under another version
+// of the service in the domain with ErrNodeConflict
+func UniqueNodeVersions(b bool) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, uniqueNodesKey{}, b)
+	}
+}
+
+type validateEndpointsKey struct{}
+
+// ValidateEndpoints rejects services with malformed endpoints with
+// ErrInvalidEndpoint, endpoints must be named and the required metadata lists
+// the request and response values which must be set, e.g. "request,response"
+func ValidateEndpoints(b bool) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, validateEndpointsKey{}, b)
+	}
+}
+
+type rejectEmptyKey struct{}
+
+// RejectEmpty rejects services registered without nodes with ErrNoNodes, by
+// default they are registered so placeholder services can carry a schema
+func RejectEmpty(b bool) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, rejectEmptyKey{}, b)
+	}
+}
+
+type identityKeyKey struct{}
+
+// RequireIdentityKey rejects nodes without the metadata key holding their
+// identity, the key is also used by LookupByIdentity
+func RequireIdentityKey(key string) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, identityKeyKey{}, key)
+	}
+}
+
+type staleThresholdKey struct{}
+
+// StaleThreshold makes the pruner send an update event with the stale
+// metadata set for nodes older than the fraction of their TTL, the
+// warning is sent once per node until it registers again
+func StaleThreshold(f float64) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, staleThresholdKey{}, f)
+	}
+}
+
+type removedHistoryKey struct{}
+
+// RemovedHistory keeps the nodes removed from a service for the window,
+// see RecentlyRemoved
+func RemovedHistory(window time.Duration) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, removedHistoryKey{}, window)
+	}
+}
+
+type defaultDomainKey struct{}
+
+// DefaultDomain sets the domain used by the register when a call
+// doesn't specify one
+func DefaultDomain(name string) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, defaultDomainKey{}, name)
+	}
+}
+
+type sinkKey struct{}
+
+// EventSink publishes every event to fn, for example to mirror the events
+// to a message bus, errors are logged. The events are passed one at a time
+// in the order they were produced
+func EventSink(fn func(context.Context, *register.Result) error) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, sinkKey{}, fn)
+	}
+}
+
+func getSink(ctx context.Context) func(context.Context, *register.Result) error {
+	if ctx == nil {
+		return nil
+	}
+	v, _ := ctx.Value(sinkKey{}).(func(context.Context, *register.Result) error)
+	return v
+}
+
+type sinkRetriesKey struct{}
+
+// EventSinkRetries sets how many times a failed EventSink call is retried
+func EventSinkRetries(n int) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, sinkRetriesKey{}, n)
+	}
+}
+
+type clockKey struct{}
+
+// Clock sets the function returning the current time used for the TTLs,
+// histories and availability windows, time.Now is used by default
+func Clock(fn func() time.Time) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, clockKey{}, fn)
+	}
+}
+
+func getClock(ctx context.Context) func() time.Time {
+	if ctx == nil {
+		return time.Now
+	}
+	if fn, ok := ctx.Value(clockKey{}).(func() time.Time); ok && fn != nil {
+		return fn
+	}
+	return time.Now
+}
+
+type idGeneratorKey struct{}
+
+// IDGenerator sets the function generating the watcher ids, random uuids are
+// used by default
+func IDGenerator(fn func() string) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, idGeneratorKey{}, fn)
+	}
+}
+
+func getIDGenerator(ctx context.Context) func() string {
+	if ctx != nil {
+		if fn, ok := ctx.Value(idGeneratorKey{}).(func() string); ok && fn != nil {
+			return fn
+		}
+	}
+	return func() string {
+		return uuid.New().String()
+	}
+}
+
+type allowedDomainsKey struct{}
+
+// AllowedDomains restricts Register and Deregister to the domains, other
+// domains are rejected with ErrDomainNotAllowed
+func AllowedDomains(domains []string) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, allowedDomainsKey{}, domains)
+	}
+}
+
+type enabledFlagsKey struct{}
+
+// EnabledFlags sets the feature flags, services with the flag metadata are
+// hidden from every lookup, listing and watcher unless their flag is enabled,
+// the flags can be updated with Init
+func EnabledFlags(flags map[string]bool) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, enabledFlagsKey{}, flags)
+	}
+}
+
+func getFlags(ctx context.Context) map[string]bool {
+	if ctx == nil {
+		return nil
+	}
+	v, _ := ctx.Value(enabledFlagsKey{}).(map[string]bool)
+	return v
+}
+
+type hooksKey struct{}
+
+// OnEvent adds a hook invoked for every event the register produces,
+// hooks are called in the order they were added and see the events one at
+// a time in the order they were produced
+func OnEvent(fn func(*register.Result)) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		hooks := append(getHooks(o.Context), fn)
+		o.Context = context.WithValue(o.Context, hooksKey{}, hooks)
+	}
+}
+
+func getHooks(ctx context.Context) []func(*register.Result) {
+	if ctx == nil {
+		return nil
+	}
+	hooks, _ := ctx.Value(hooksKey{}).([]func(*register.Result))
+	// copy so appending never shares the backing array
+	return append([]func(*register.Result){}, hooks...)
+}
+
+type watchdogKey struct{}
+
+type watchdog struct {
+	threshold int
+	window    time.Duration
+	stop      bool
+}
+
+// WatcherWatchdog logs a warning for watchers dropping more than threshold
+// consecutive events within the window, the watchers are also stopped when
+// stop is true
+func WatcherWatchdog(threshold int, window time.Duration, stop bool) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, watchdogKey{}, watchdog{threshold: threshold, window: window, stop: stop})
+	}
+}
+
+func getWatchdog(ctx context.Context) watchdog {
+	if ctx == nil {
+		return watchdog{}
+	}
+	v, _ := ctx.Value(watchdogKey{}).(watchdog)
+	return v
+}
+
+type normalizeKeysKey struct{}
+
+type normalizerKey struct{}
+
+// NormalizeMetadataKeys lowercases the service and node metadata keys on
+// Register, ListMetadata filters are normalized the same way
+func NormalizeMetadataKeys(b bool) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, normalizeKeysKey{}, b)
+	}
+}
+
+// MetadataKeyNormalizer applies fn instead of lowercasing the metadata keys,
+// it enables NormalizeMetadataKeys
+func MetadataKeyNormalizer(fn func(string) string) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, normalizerKey{}, fn)
+	}
+}
+
+func getNormalizer(ctx context.Context) func(string) string {
+	if ctx == nil {
+		return nil
+	}
+	if fn, ok := ctx.Value(normalizerKey{}).(func(string) string); ok && fn != nil {
+		return fn
+	}
+	if getBool(ctx, normalizeKeysKey{}) {
+		return strings.ToLower
+	}
+	return nil
+}
+
+type consistentWildcardKey struct{}
+
+// ConsistentWildcardReads makes wildcard LookupService and ListServices
+// hold the lock once across all domains, so concurrent writes are never
+// observed halfway, by default the lock is taken per domain
+func ConsistentWildcardReads(b bool) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, consistentWildcardKey{}, b)
+	}
+}
+
+type indexKeysKey struct{}
+
+// IndexMetadata maintains secondary indexes for the service metadata keys,
+// filtered lists on indexed keys don't scan all the services
+func IndexMetadata(keys ...string) register.Option {
+	return func(o *register.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, indexKeysKey{}, keys)
+	}
+}
+
+type pinnedKey struct{}
+
+// Pinned marks the service as pinned, pinned services never expire
+// and can't be deregistered
+func Pinned(b bool) register.RegisterOption {
+	return func(o *register.RegisterOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, pinnedKey{}, b)
+	}
+}
+
+type staticKey struct{}
+
+// Static marks the registered nodes as static, static nodes never expire
+// and are only removed by Deregister
+func Static(b bool) register.RegisterOption {
+	return func(o *register.RegisterOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, staticKey{}, b)
+	}
+}
+
+type deregisterStrictKey struct{}
+
+// DeregisterStrict fails a DeregisterBatch with register.ErrNotFound when one
+// of its services isn't registered
+func DeregisterStrict(b bool) register.DeregisterOption {
+	return func(o *register.DeregisterOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, deregisterStrictKey{}, b)
+	}
+}
+
+type singletonKey struct{}
+
+// Singleton allows a single node per service version, registering another
+// node returns ErrSingleton unless SingletonReplace is set
+func Singleton(b bool) register.RegisterOption {
+	return func(o *register.RegisterOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, singletonKey{}, b)
+	}
+}
+
+type singletonReplaceKey struct{}
+
+// SingletonReplace makes a Singleton registration evict the registered node,
+// a delete event is sent for the evicted node. Pinned versions fail with
+// ErrPinned and static nodes with ErrSingleton as they are never evicted.
+func SingletonReplace(b bool) register.RegisterOption {
+	return func(o *register.RegisterOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, singletonReplaceKey{}, b)
+	}
+}
+
+type onExpireKey struct{}
+
+// OnExpire calls fn with every node of the registration pruned for its TTL,
+// fn is called outside of the register lock
+func OnExpire(fn func(*register.Node)) register.RegisterOption {
+	return func(o *register.RegisterOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, onExpireKey{}, fn)
+	}
+}
+
+func getOnExpire(ctx context.Context) func(*register.Node) {
+	if ctx == nil {
+		return nil
+	}
+	v, _ := ctx.Value(onExpireKey{}).(func(*register.Node))
+	return v
+}
+
+type expireAtKey struct{}
+
+// ExpireAt sets the absolute deadline of the registered nodes, the pruner
+// removes them once the deadline passed whatever their TTL
+func ExpireAt(t time.Time) register.RegisterOption {
+	return func(o *register.RegisterOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, expireAtKey{}, t)
+	}
+}
+
+func getExpireAt(ctx context.Context) time.Time {
+	if ctx == nil {
+		return time.Time{}
+	}
+	v, _ := ctx.Value(expireAtKey{}).(time.Time)
+	return v
+}
+
+type resyncIntervalKey struct{}
+
+// ResyncInterval makes the watcher periodically receive create events
+// for all the services matching its filters
+func ResyncInterval(d time.Duration) register.WatchOption {
+	return func(o *register.WatchOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, resyncIntervalKey{}, d)
+	}
+}
+
+type protocolKey struct{}
+
+// ByProtocol returns only the services having at least one node with the protocol
+func ByProtocol(protocol string) register.LookupOption {
+	return func(o *register.LookupOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, protocolKey{}, strings.ToLower(protocol))
+	}
+}
+
+type onlyHealthyKey struct{}
+
+// OnlyHealthy returns only the nodes which are ready and not drained,
+// services without such nodes are skipped
+func OnlyHealthy() register.LookupOption {
+	return func(o *register.LookupOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, onlyHealthyKey{}, true)
+	}
+}
+
+type namePatternKey struct{}
+
+// NamePattern looks up all the services with a name matching the glob
+// pattern instead of the service name, * matches any sequence of characters
+// and ? a single character, e.g. "payments.*"
+func NamePattern(glob string) register.LookupOption {
+	return func(o *register.LookupOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, namePatternKey{}, glob)
+	}
+}
+
+type minTierKey struct{}
+
+// MinTier returns only the services of the tier or a higher one, tiers rank
+// best-effort, standard and critical, services without a tier are standard
+func MinTier(tier string) register.LookupOption {
+	return func(o *register.LookupOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, minTierKey{}, strings.ToLower(strings.TrimSpace(tier)))
+	}
+}
+
+type activeOnlyKey struct{}
+
+// ActiveOnly returns only the services and nodes inside their availability
+// window, see the availability metadata
+func ActiveOnly(b bool) register.LookupOption {
+	return func(o *register.LookupOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, activeOnlyKey{}, b)
+	}
+}
+
+type withCountsKey struct{}
+
+// WithCounts lists a single service per name and domain sorted by domain and
+// name, with the number of versions and nodes in the versionCount and
+// nodeCount metadata
+func WithCounts(b bool) register.ListOption {
+	return func(o *register.ListOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, withCountsKey{}, b)
+	}
+}
+
+type withServicePrefixKey struct{}
+
+// WithServicePrefix prefixes the node ids returned by ListNodeIDs with the
+// service name, e.g. "foo/foo-1"
+func WithServicePrefix(b bool) register.ListOption {
+	return func(o *register.ListOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, withServicePrefixKey{}, b)
+	}
+}
+
+type listActiveOnlyKey struct{}
+
+// ListActiveOnly lists only the services and nodes inside their
+// availability window, see the availability metadata
+func ListActiveOnly(b bool) register.ListOption {
+	return func(o *register.ListOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, listActiveOnlyKey{}, b)
+	}
+}
+
+type preferZoneKey struct{}
+
+// PreferZone orders the nodes with the zone metadata first, the other
+// nodes follow so no node is dropped
+func PreferZone(zone string) register.LookupOption {
+	return func(o *register.LookupOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, preferZoneKey{}, zone)
+	}
+}
+
+type consistentHashKey struct{}
+
+// ConsistentHash orders the nodes by the hash of the key and the node id,
+// the order is stable for the same key and nodes
+func ConsistentHash(key string) register.LookupOption {
+	return func(o *register.LookupOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, consistentHashKey{}, key)
+	}
+}
+
+type flattenKey struct{}
+
+// FlattenVersions merges all the versions of the service into a single
+// service with the nodes and endpoints of every version, the version is
+// the comma separated list of the merged versions. With NamePattern or the
+// wildcard domain each service of each domain is flattened on its own.
+func FlattenVersions(b bool) register.LookupOption {
+	return func(o *register.LookupOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, flattenKey{}, b)
+	}
+}
+
+type primaryOnlyKey struct{}
+
+// PrimaryOnly returns only the version of the service promoted as the
+// primary one, all the versions are returned when none is promoted
+func PrimaryOnly(b bool) register.LookupOption {
+	return func(o *register.LookupOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, primaryOnlyKey{}, b)
+	}
+}
+
+type mergeDomainsKey struct{}
+
+// MergeDomains merges the services sharing a name and version across the
+// domains of a wildcard lookup, the merged services carry the comma
+// separated list of the domains in the domains metadata
+func MergeDomains(b bool) register.LookupOption {
+	return func(o *register.LookupOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, mergeDomainsKey{}, b)
+	}
+}
+
+type endpointMetadataKey struct{}
+
+// ByEndpointMetadata returns only the services having an endpoint with all
+// the metadata pairs, the endpoints not matching are dropped
+func ByEndpointMetadata(md map[string]string) register.LookupOption {
+	return func(o *register.LookupOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, endpointMetadataKey{}, md)
+	}
+}
+
+func getEndpointMetadata(ctx context.Context) map[string]string {
+	if ctx == nil {
+		return nil
+	}
+	v, _ := ctx.Value(endpointMetadataKey{}).(map[string]string)
+	return v
+}
+
+type metadataFilterKey struct{}
+
+type metadataFilter struct {
+	key   string
+	value string
+}
+
+// ListMetadata returns only the services with the metadata key set to value
+func ListMetadata(key, value string) register.ListOption {
+	return func(o *register.ListOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, metadataFilterKey{}, metadataFilter{key: key, value: value})
+	}
+}
+
+func getMetadataFilter(ctx context.Context) (string, string, bool) {
+	if ctx == nil {
+		return "", "", false
+	}
+	f, ok := ctx.Value(metadataFilterKey{}).(metadataFilter)
+	return f.key, f.value, ok
+}
+
+type hashResyncIntervalKey struct{}
+
+// HashResyncInterval makes the watcher periodically receive resync events
+// carrying only the name, version and content hash in the hash metadata of
+// the services matching its filters, so only changed services need to be
+// fetched again
+func HashResyncInterval(d time.Duration) register.WatchOption {
+	return func(o *register.WatchOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, hashResyncIntervalKey{}, d)
+	}
+}
+
+type actionsKey struct{}
+
+// WatchActions delivers only the events with the given actions
+// (create, update or delete), all actions are delivered by default
+func WatchActions(actions ...string) register.WatchOption {
+	return func(o *register.WatchOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, actionsKey{}, actions)
+	}
+}
+
+type nodeMetadataKey struct{}
+
+// WatchNodeMetadata delivers only the events with at least one node having
+// all the metadata pairs, e.g. the nodes of a zone, events without nodes such
+// as the removal of a whole service aren't delivered
+func WatchNodeMetadata(md map[string]string) register.WatchOption {
+	return func(o *register.WatchOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, nodeMetadataKey{}, md)
+	}
+}
+
+func getNodeMetadata(ctx context.Context) map[string]string {
+	if ctx == nil {
+		return nil
+	}
+	v, _ := ctx.Value(nodeMetadataKey{}).(map[string]string)
+	return v
+}
+
+type filterNodesKey struct{}
+
+// WatchFilterNodes drops the nodes not matching WatchNodeMetadata from the
+// delivered events
+func WatchFilterNodes(b bool) register.WatchOption {
+	return func(o *register.WatchOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, filterNodesKey{}, b)
+	}
+}
+
+type newestFirstKey struct{}
+
+// WatchNewestFirst buffers up to size events for the watcher and delivers
+// the newest first, the oldest events are dropped when the buffer is full,
+// events are delivered oldest first by default
+func WatchNewestFirst(size int) register.WatchOption {
+	return func(o *register.WatchOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, newestFirstKey{}, size)
+	}
+}
+
+type diffKey struct{}
+
+// WatchDiff delivers the update events of Register and Deregister without
+// nodes, the added and removed metadata carry the comma separated ids of
+// the added and removed nodes
+func WatchDiff() register.WatchOption {
+	return func(o *register.WatchOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, diffKey{}, true)
+	}
+}
+
+type keepaliveKey struct{}
+
+// Keepalive makes the watcher periodically receive a result with the
+// keepalive action and no service, so quiet registers can be told apart
+// from broken watches
+func Keepalive(d time.Duration) register.WatchOption {
+	return func(o *register.WatchOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, keepaliveKey{}, d)
+	}
+}
+
+type skipKeepaliveKey struct{}
+
+// SkipKeepalive makes Next skip the keepalive results, they still wake
+// up the watcher but aren't returned
+func SkipKeepalive(b bool) register.WatchOption {
+	return func(o *register.WatchOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, skipKeepaliveKey{}, b)
+	}
+}
+
+type resumeFromKey struct{}
+
+// ResumeFrom makes the watcher first receive create events for the services
+// changed after the register revision, services deleted in the meantime
+// aren't replayed
+func ResumeFrom(rev uint64) register.WatchOption {
+	return func(o *register.WatchOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, resumeFromKey{}, rev)
+	}
+}
+
+func getRevision(ctx context.Context) (uint64, bool) {
+	if ctx == nil {
+		return 0, false
+	}
+	v, ok := ctx.Value(resumeFromKey{}).(uint64)
+	return v, ok
+}
+
+func getBool(ctx context.Context, key interface{}) bool {
+	if ctx == nil {
+		return false
+	}
+	v, _ := ctx.Value(key).(bool)
+	return v
+}
+
+// lookupBool returns the value and whether it was set
+func lookupBool(ctx context.Context, key interface{}) (bool, bool) {
+	if ctx == nil {
+		return false, false
+	}
+	v, ok := ctx.Value(key).(bool)
+	return v, ok
+}
+
+func getDuration(ctx context.Context, key interface{}, def time.Duration) time.Duration {
+	if ctx == nil {
+		return def
+	}
+	if v, ok := ctx.Value(key).(time.Duration); ok && v > 0 {
+		return v
+	}
+	return def
+}
+
+func getInt(ctx context.Context, key interface{}) int {
+	if ctx == nil {
+		return 0
+	}
+	v, _ := ctx.Value(key).(int)
+	return v
+}
+
+func getString(ctx context.Context, key interface{}) string {
+	if ctx == nil {
+		return ""
+	}
+	v, _ := ctx.Value(key).(string)
+	return v
+}
+
+func getStrings(ctx context.Context, key interface{}) []string {
+	if ctx == nil {
+		return nil
+	}
+	v, _ := ctx.Value(key).([]string)
+	return v
+}
+
+// lookupStrings returns the value and whether it was set
+func lookupStrings(ctx context.Context, key interface{}) ([]string, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	v, ok := ctx.Value(key).([]string)
+	return v, ok
+}
+
+func getFloat(ctx context.Context, key interface{}) float64 {
+	if ctx == nil {
+		return 0
+	}
+	v, _ := ctx.Value(key).(float64)
+	return v
+}
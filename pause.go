@@ -0,0 +1,108 @@
+package memory
+
+import (
+	"github.com/unistack-org/micro/v3/register"
+)
+
+// PauseEvents buffers the events until ResumeEvents, e.g. during bulk changes
+func (m *memory) PauseEvents() {
+	m.Lock()
+	m.paused = true
+	m.Unlock()
+}
+
+// ResumeEvents delivers the events buffered since PauseEvents coalesced to a
+// single event per service version reflecting its current state, versions
+// created and removed while paused aren't reported
+func (m *memory) ResumeEvents() {
+	m.Lock()
+	events := m.coalesce(m.pausedEvents)
+	m.paused = false
+	m.pausedEvents = nil
+	m.Unlock()
+
+	m.sendEvents(events)
+}
+
+// pause buffers the events while the delivery is paused and reports whether
+// they were buffered
+func (m *memory) pause(events []*register.Result) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.paused {
+		return false
+	}
+	m.pausedEvents = append(m.pausedEvents, events...)
+	return true
+}
+
+// coalesce returns an event per service version, or per domain for the
+// domain events, in the order they first changed, the caller must hold the lock
+func (m *memory) coalesce(events []*register.Result) []*register.Result {
+	type change struct {
+		first string
+		last  *register.Result
+	}
+
+	var keys []string
+	changes := make(map[string]*change)
+
+	for _, r := range events {
+		// the buffered events are replaced so their diffs are never used
+		delete(m.diffs, r)
+		delete(m.hidden, r)
+		if r.Service == nil {
+			continue
+		}
+
+		key := r.Service.Metadata["domain"] + "\x00" + r.Service.Name + "\x00" + r.Service.Version
+		if r.Service.Metadata["event"] == "domain" {
+			key = r.Service.Metadata["domain"] + "\x00domain"
+		}
+		c, ok := changes[key]
+		if !ok {
+			c = &change{first: r.Action}
+			changes[key] = c
+			keys = append(keys, key)
+		}
+		c.last = r
+	}
+
+	result := make([]*register.Result, 0, len(keys))
+	for _, key := range keys {
+		c := changes[key]
+		srv := c.last.Service
+		domain := srv.Metadata["domain"]
+
+		var exists bool
+		var r *record
+		switch {
+		case srv.Metadata["event"] == "domain":
+			exists = len(m.records[domain]) > 0
+		case len(srv.Version) == 0 && c.last.Action == "delete":
+			// a whole service removal
+			exists = len(m.records[domain][srv.Name]) > 0
+		default:
+			r, exists = m.records[domain][srv.Name][srv.Version]
+		}
+
+		switch {
+		case exists && c.first == "create":
+			if r != nil {
+				srv = recordToService(r, domain)
+			}
+			result = append(result, &register.Result{Action: "create", Service: srv})
+		case exists && r != nil:
+			result = append(result, &register.Result{Action: "update", Service: recordToService(r, domain)})
+		case exists:
+			result = append(result, c.last)
+		case c.first == "create":
+			// created and removed while paused
+		default:
+			result = append(result, &register.Result{Action: "delete", Service: srv})
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,122 @@
+package memory
+
+import (
+	"time"
+
+	"github.com/unistack-org/micro/v3/register"
+)
+
+var (
+	// peakBucketTime is the resolution of the peak node counts
+	peakBucketTime = time.Second
+	// peakRetention is how long the peak node counts are kept
+	peakRetention = time.Hour
+)
+
+type peakKey struct {
+	domain  string
+	service string
+	version string
+}
+
+// peak is the node count of a service version during a bucket
+type peak struct {
+	Start time.Time
+	Max   int
+	Last  int
+}
+
+// observePeak records the current node count of the service version,
+// the caller must hold the lock
+func (m *memory) observePeak(domain string, r *record) {
+	key := peakKey{domain: domain, service: r.Name, version: r.Version}
+	count := len(r.Nodes)
+	start := m.now().Truncate(m.peakBucket)
+
+	peaks := m.peaks[key]
+	if n := len(peaks); n > 0 && peaks[n-1].Start.Equal(start) {
+		if count > peaks[n-1].Max {
+			peaks[n-1].Max = count
+		}
+		peaks[n-1].Last = count
+		return
+	}
+
+	m.peaks[key] = append(peaks, peak{Start: start, Max: count, Last: count})
+}
+
+// copyPeaks returns a copy of the peak node counts of the domains, the
+// caller must hold the lock
+func (m *memory) copyPeaks(domains map[string]services) map[peakKey][]peak {
+	c := make(map[peakKey][]peak)
+	for key, peaks := range m.peaks {
+		if _, ok := domains[key.domain]; ok {
+			c[key] = append([]peak(nil), peaks...)
+		}
+	}
+	return c
+}
+
+// restorePeaks replaces the peak node counts of the domains with the copy,
+// the caller must hold the lock
+func (m *memory) restorePeaks(domains map[string]services, c map[peakKey][]peak) {
+	for key := range m.peaks {
+		if _, ok := domains[key.domain]; ok {
+			delete(m.peaks, key)
+		}
+	}
+	for key, peaks := range c {
+		m.peaks[key] = peaks
+	}
+}
+
+// prunePeaks drops the buckets older than the retention, the latest of them
+// is kept as it carries the node count into the retained buckets, the caller
+// must hold the lock
+func (m *memory) prunePeaks() {
+	cutoff := m.now().Add(-peakRetention)
+
+	for key, peaks := range m.peaks {
+		i := 0
+		for i < len(peaks)-1 && peaks[i+1].Start.Before(cutoff) {
+			i++
+		}
+		peaks = peaks[i:]
+
+		if len(peaks) == 1 && peaks[0].Last == 0 && peaks[0].Start.Before(cutoff) {
+			delete(m.peaks, key)
+			continue
+		}
+		m.peaks[key] = peaks
+	}
+}
+
+// PeakNodes returns the highest node count of the service version during
+// the window, the counts are kept for an hour
+func (m *memory) PeakNodes(domain, service, version string, window time.Duration) (int, error) {
+	domain = m.defaultDomain(domain)
+
+	m.RLock()
+	defer m.RUnlock()
+
+	peaks, ok := m.peaks[peakKey{domain: domain, service: service, version: version}]
+	if !ok {
+		return 0, register.ErrNotFound
+	}
+
+	start := m.now().Add(-window).Truncate(m.peakBucket)
+
+	var max int
+	for _, p := range peaks {
+		if p.Start.Before(start) {
+			// the count at the end of older buckets carries into the window
+			max = p.Last
+			continue
+		}
+		if p.Max > max {
+			max = p.Max
+		}
+	}
+
+	return max, nil
+}
@@ -0,0 +1,42 @@
+package memory
+
+import (
+	"sync"
+
+	"github.com/unistack-org/micro/v3/register"
+)
+
+// nodePool recycles the nodes removed from the records with NodePool
+var nodePool = sync.Pool{
+	New: func() interface{} {
+		return &node{Node: &register.Node{Metadata: make(map[string]string)}}
+	},
+}
+
+// newNode returns a node with an empty metadata map, taken from the pool
+// when enabled
+func (m *memory) newNode() *node {
+	if !m.pooling {
+		return &node{Node: &register.Node{Metadata: make(map[string]string)}}
+	}
+	return nodePool.Get().(*node)
+}
+
+// releaseNode resets the node removed from its record and returns it to the
+// pool when enabled, the caller must hold the lock and must not keep any
+// reference to the node or its metadata
+func (m *memory) releaseNode(n *node) {
+	if !m.pooling {
+		return
+	}
+
+	metadata := n.Metadata
+	for k := range metadata {
+		delete(metadata, k)
+	}
+	inner := n.Node
+	*inner = register.Node{Metadata: metadata}
+	*n = node{Node: inner}
+
+	nodePool.Put(n)
+}
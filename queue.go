@@ -0,0 +1,186 @@
+package memory
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"github.com/unistack-org/micro/v3/logger"
+	"github.com/unistack-org/micro/v3/register"
+)
+
+// QueuePolicy decides what happens to an event when the event queue is full
+type QueuePolicy int
+
+const (
+	// QueueBlock blocks the writer up to the EventTimeout before dropping
+	// the event, writes slow down but events are only lost under sustained
+	// overload
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldest drops the oldest queued event, writers never block and
+	// watchers converge to the latest state but miss intermediate events
+	QueueDropOldest
+	// QueueDropNewest drops the event being sent, writers never block and the
+	// queued events are kept but watchers miss the latest changes
+	QueueDropNewest
+)
+
+// queuedEvent is an event waiting in the queue
+type queuedEvent struct {
+	result *register.Result
+	// sent is when the event was queued
+	sent time.Time
+}
+
+// enqueue adds the event to the queue applying the queue policy
+func (m *memory) enqueue(r *register.Result) {
+	e := queuedEvent{result: r, sent: time.Now()}
+	switch m.queuePolicy {
+	case QueueDropNewest:
+		select {
+		case m.queue <- e:
+		default:
+			m.dropEvent(r)
+		}
+	case QueueDropOldest:
+		for {
+			select {
+			case m.queue <- e:
+				return
+			default:
+			}
+			select {
+			case old := <-m.queue:
+				m.dropEvent(old.result)
+			default:
+			}
+		}
+	default:
+		select {
+		case m.queue <- e:
+		case <-time.After(m.queueTimeout):
+			m.dropEvent(r)
+		}
+	}
+}
+
+// dropEvent counts and logs an event dropped by the queue, its diff is
+// released as it will never be published
+func (m *memory) dropEvent(r *register.Result) {
+	m.Lock()
+	delete(m.diffs, r)
+	delete(m.hidden, r)
+	m.Unlock()
+
+	atomic.AddUint64(&m.droppedEvents, 1)
+	m.logf(logger.WarnLevel, nil, "Register event queue is full, event dropped")
+}
+
+// shardEvent is a queued event handed to a dispatch worker
+type shardEvent struct {
+	queuedEvent
+	diff *register.Result
+}
+
+// dispatch sends the queued events to the watchers in order, with dispatch
+// workers the events are handed to every worker in order instead
+func (m *memory) dispatch() {
+	for i, shard := range m.shards {
+		go m.dispatchShard(i, shard)
+	}
+
+	for {
+		select {
+		case <-m.exit:
+			return
+		case e := <-m.queue:
+			if len(m.shards) == 0 {
+				m.sendEventAt(e.result, e.sent)
+				continue
+			}
+			r, diff := m.publish(e.result)
+			if r == nil {
+				continue
+			}
+			m.enqueueShards(shardEvent{queuedEvent: queuedEvent{result: r, sent: e.sent}, diff: diff})
+		}
+	}
+}
+
+// enqueueShards hands the event to every dispatch worker applying the queue
+// policy per shard, the shards with room get the event first so a shard held
+// up by a slow watcher never holds up the others
+func (m *memory) enqueueShards(se shardEvent) {
+	var full []chan shardEvent
+	for _, shard := range m.shards {
+		select {
+		case shard <- se:
+		default:
+			full = append(full, shard)
+		}
+	}
+
+	switch m.queuePolicy {
+	case QueueDropNewest:
+		for range full {
+			m.dropEvent(se.result)
+		}
+	case QueueDropOldest:
+		for _, shard := range full {
+			m.enqueueOldest(shard, se)
+		}
+	default:
+		// the full shards share a single timeout
+		deadline := time.Now().Add(m.queueTimeout)
+		for _, shard := range full {
+			t := time.NewTimer(time.Until(deadline))
+			select {
+			case shard <- se:
+			case <-t.C:
+				m.dropEvent(se.result)
+			case <-m.exit:
+				t.Stop()
+				return
+			}
+			t.Stop()
+		}
+	}
+}
+
+// enqueueOldest adds the event to the shard dropping its oldest events
+func (m *memory) enqueueOldest(shard chan shardEvent, se shardEvent) {
+	for {
+		select {
+		case shard <- se:
+			return
+		default:
+		}
+		select {
+		case old := <-shard:
+			m.dropEvent(old.result)
+		default:
+		}
+	}
+}
+
+// dispatchShard sends the events of the worker to the watchers of its shard
+func (m *memory) dispatchShard(i int, shard chan shardEvent) {
+	for {
+		select {
+		case <-m.exit:
+			return
+		case e := <-shard:
+			m.deliver(e.result, e.diff, e.sent, i)
+		}
+	}
+}
+
+// shardOf returns the dispatch shard of the watcher
+func (m *memory) shardOf(id string) int {
+	if len(m.shards) == 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(len(m.shards)))
+}
@@ -0,0 +1,344 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/unistack-org/micro/v3/register"
+)
+
+func queuedVersions(m *memory) []string {
+	var versions []string
+	for {
+		select {
+		case e := <-m.queue:
+			versions = append(versions, e.result.Service.Version)
+		default:
+			return versions
+		}
+	}
+}
+
+func TestEventQueuePolicies(t *testing.T) {
+	testData := []struct {
+		policy   QueuePolicy
+		expected []string
+	}{
+		{QueueBlock, []string{"1", "2"}},
+		{QueueDropOldest, []string{"3", "4"}},
+		{QueueDropNewest, []string{"1", "2"}},
+	}
+
+	for _, tt := range testData {
+		// no dispatch loop runs so the queue stays saturated
+		m := newMemory(register.NewOptions(EventQueue(2, tt.policy), EventTimeout(time.Millisecond)))
+
+		var events []*register.Result
+		for _, version := range []string{"1", "2", "3", "4"} {
+			events = append(events, &register.Result{Action: "update", Service: &register.Service{Name: "foo", Version: version}})
+		}
+		m.sendEvents(events)
+
+		if versions := queuedVersions(m); len(versions) != 2 || versions[0] != tt.expected[0] || versions[1] != tt.expected[1] {
+			t.Fatalf("Expected queued versions %v for policy %d, got %v", tt.expected, tt.policy, versions)
+		}
+		if stats := m.Stats(); stats.DroppedEvents != 2 {
+			t.Fatalf("Expected 2 dropped events for policy %d, got %d", tt.policy, stats.DroppedEvents)
+		}
+	}
+}
+
+func TestEventQueueDropDiffs(t *testing.T) {
+	for _, policy := range []QueuePolicy{QueueBlock, QueueDropOldest, QueueDropNewest} {
+		m := NewRegister(EventQueue(1, policy), EventTimeout(time.Millisecond)).(*memory)
+		ctx := context.TODO()
+
+		// a stalled watcher keeps the queue overflowing
+		w, err := m.Watch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 200; i++ {
+			srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: fmt.Sprintf("foo-%d", i)}}}
+			if err := m.Register(ctx, srv); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if stats := m.Stats(); stats.DroppedEvents == 0 {
+			t.Fatalf("Expected the queue to overflow for policy %d", policy)
+		}
+
+		// the diffs of the dropped and the delivered events are released
+		var diffs int
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			m.RLock()
+			diffs = len(m.diffs)
+			m.RUnlock()
+			if diffs == 0 {
+				break
+			}
+		}
+		if diffs != 0 {
+			t.Fatalf("Expected no diffs left for policy %d, got %d", policy, diffs)
+		}
+
+		w.Stop()
+		m.Disconnect(ctx)
+	}
+}
+
+func TestEventQueueBlock(t *testing.T) {
+	m := newMemory(register.NewOptions(EventQueue(1, QueueBlock), EventTimeout(time.Second)))
+
+	m.sendEvents([]*register.Result{{Action: "create", Service: &register.Service{Name: "foo", Version: "1"}}})
+
+	// the writer blocks until the queue has room
+	done := make(chan struct{})
+	go func() {
+		m.sendEvents([]*register.Result{{Action: "create", Service: &register.Service{Name: "foo", Version: "2"}}})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Expected the writer to block on the full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-m.queue
+	<-done
+
+	if stats := m.Stats(); stats.DroppedEvents != 0 {
+		t.Fatalf("Expected no dropped events, got %d", stats.DroppedEvents)
+	}
+}
+
+func TestEventQueueDispatch(t *testing.T) {
+	m := NewRegister(EventQueue(16, QueueBlock), EventTimeout(time.Second)).(*memory)
+	ctx := context.TODO()
+
+	w, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	for _, version := range []string{"1.0.0", "1.0.1", "1.0.2"} {
+		if err := m.Register(ctx, &register.Service{Name: "foo", Version: version}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the dispatch loop keeps the write order
+	for _, version := range []string{"1.0.0", "1.0.1", "1.0.2"} {
+		r, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Service.Version != version {
+			t.Fatalf("Expected version %s, got %s", version, r.Service.Version)
+		}
+	}
+}
+
+func TestEventQueueDispatchWorkers(t *testing.T) {
+	m := NewRegister(EventQueue(16, QueueBlock), DispatchWorkers(4), EventTimeout(time.Second)).(*memory)
+	defer m.Disconnect(context.TODO())
+	ctx := context.TODO()
+
+	// the slow watcher never reads its events
+	slow, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Stop()
+
+	var fast []register.Watcher
+	for len(fast) < 3 {
+		w, err := m.Watch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Stop()
+		if m.shardOf(w.(*Watcher).id) == m.shardOf(slow.(*Watcher).id) {
+			continue
+		}
+		fast = append(fast, w)
+	}
+
+	versions := []string{"1.0.0", "1.0.1", "1.0.2"}
+	for _, version := range versions {
+		if err := m.Register(ctx, &register.Service{Name: "foo", Version: version}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	errs := make(chan error, len(fast))
+	for _, w := range fast {
+		go func(w register.Watcher) {
+			for _, version := range versions {
+				r, err := w.Next()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if r.Service.Version != version {
+					errs <- fmt.Errorf("expected version %s, got %s", version, r.Service.Version)
+					return
+				}
+			}
+			errs <- nil
+		}(w)
+	}
+	for range fast {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("Expected the slow watcher not to delay the other shards, took %v", d)
+	}
+}
+
+func TestEventQueueDispatchWorkersFull(t *testing.T) {
+	for _, policy := range []QueuePolicy{QueueDropOldest, QueueDropNewest} {
+		m := NewRegister(EventQueue(8, policy), DispatchWorkers(4), EventTimeout(time.Second)).(*memory)
+		ctx := context.TODO()
+
+		// the slow watcher never reads its events and fills its shard
+		slow, err := m.Watch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var fast []register.Watcher
+		for len(fast) < 3 {
+			w, err := m.Watch(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.shardOf(w.(*Watcher).id) == m.shardOf(slow.(*Watcher).id) {
+				w.Stop()
+				continue
+			}
+			fast = append(fast, w)
+		}
+
+		const events = 50
+		received := make([]chan string, len(fast))
+		for i, w := range fast {
+			received[i] = make(chan string, events)
+			go func(w register.Watcher, ids chan string) {
+				for {
+					r, err := w.Next()
+					if err != nil {
+						return
+					}
+					ids <- r.Service.Nodes[0].Id
+				}
+			}(w, received[i])
+		}
+
+		// every event is awaited so only the full shard drops events
+		start := time.Now()
+		for i := 0; i < events; i++ {
+			id := fmt.Sprintf("foo-%d", i)
+			if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: id}}}); err != nil {
+				t.Fatal(err)
+			}
+			for _, ids := range received {
+				select {
+				case got := <-ids:
+					if got != id {
+						t.Fatalf("Expected node %s for policy %d, got %s", id, policy, got)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("Expected node %s for policy %d to be delivered", id, policy)
+				}
+			}
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("Expected the full shard not to delay the other shards for policy %d, took %v", policy, d)
+		}
+		if stats := m.Stats(); stats.DroppedEvents == 0 {
+			t.Fatalf("Expected the full shard to drop events for policy %d", policy)
+		}
+
+		for _, w := range fast {
+			w.Stop()
+		}
+		slow.Stop()
+		m.Disconnect(ctx)
+	}
+}
+
+func benchmarkDispatchWorkers(b *testing.B, workers int) {
+	// the queue holds every event so none is dropped
+	m := NewRegister(EventQueue(b.N, QueueBlock), DispatchWorkers(workers), EventTimeout(time.Millisecond)).(*memory)
+	defer m.Disconnect(context.TODO())
+	ctx := context.TODO()
+
+	// the slow watcher never reads its events
+	slow, err := m.Watch(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer slow.Stop()
+
+	const watchers = 32
+	// done receives when each watcher caught up with the last event
+	done := make(chan time.Time, watchers)
+	for i := 0; i < watchers; i++ {
+		w, err := m.Watch(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer w.Stop()
+		// read until the last event as the events can be dropped
+		go func() {
+			last := fmt.Sprintf("foo-%d", b.N-1)
+			for {
+				r, err := w.Next()
+				if err != nil {
+					return
+				}
+				if len(r.Service.Nodes) == 1 && r.Service.Nodes[0].Id == last {
+					done <- time.Now()
+					return
+				}
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		// every registration adds a node so an event is sent
+		srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: fmt.Sprintf("foo-%d", i)}}}
+		if err := m.Register(ctx, srv); err != nil {
+			b.Fatal(err)
+		}
+	}
+	caughtUp := make([]time.Duration, 0, watchers)
+	for i := 0; i < watchers; i++ {
+		caughtUp = append(caughtUp, (<-done).Sub(start))
+	}
+	b.StopTimer()
+
+	// only the watchers sharing the shard of the slow watcher lag behind
+	sort.Slice(caughtUp, func(i, j int) bool { return caughtUp[i] < caughtUp[j] })
+	b.ReportMetric(float64(caughtUp[watchers/2])/float64(time.Millisecond), "p50-catchup-ms")
+}
+
+func BenchmarkDispatchWorkers1(b *testing.B) {
+	benchmarkDispatchWorkers(b, 1)
+}
+
+func BenchmarkDispatchWorkers8(b *testing.B) {
+	benchmarkDispatchWorkers(b, 8)
+}
@@ -0,0 +1,216 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/unistack-org/micro/v3/logger"
+	"github.com/unistack-org/micro/v3/register"
+)
+
+// mirrorKey marks the changes mirrored from the upstream, they skip the
+// local write checks since the upstream already accepted them
+type mirrorKey struct{}
+
+func mirrorRegister(o *register.RegisterOptions) {
+	o.Context = context.WithValue(o.Context, mirrorKey{}, true)
+}
+
+func mirrorDeregister(o *register.DeregisterOptions) {
+	o.Context = context.WithValue(o.Context, mirrorKey{}, true)
+}
+
+// startReplica watches the upstream before copying its services so no change
+// is missed, then applies the upstream events in the background
+func (m *memory) startReplica() {
+	w, err := m.upstream.Watch(m.opts.Context, register.WatchDomain(register.WildcardDomain))
+	if err != nil {
+		m.logf(logger.ErrorLevel, nil, "Register replica failed to watch the upstream: %v", err)
+		return
+	}
+
+	if err := m.bootstrap(m.opts.Context); err != nil {
+		m.logf(logger.ErrorLevel, nil, "Register replica failed to bootstrap from the upstream: %v", err)
+	}
+
+	go m.replicate(w)
+}
+
+// bootstrap copies the services listed by the upstream into the records
+func (m *memory) bootstrap(ctx context.Context) error {
+	srvs, err := m.upstream.ListServices(ctx, register.ListDomain(register.WildcardDomain))
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	var events []*register.Result
+	for _, s := range srvs {
+		evts, err := m.mirror(&register.Result{Action: "create", Service: s})
+		if err != nil {
+			m.Unlock()
+			return err
+		}
+		events = append(events, evts...)
+	}
+	m.Unlock()
+
+	m.sendEvents(events)
+	return nil
+}
+
+// replicate applies the upstream events until the register is disconnected
+// or the upstream watcher fails
+func (m *memory) replicate(w register.Watcher) {
+	go func() {
+		<-m.exit
+		w.Stop()
+	}()
+
+	for {
+		r, err := w.Next()
+		if err != nil {
+			if !m.isClosed() {
+				m.logf(logger.ErrorLevel, nil, "Register replica watcher failed: %v", err)
+			}
+			return
+		}
+
+		// update events carry either the added or the removed nodes, so the
+		// current state of the version is fetched from the upstream instead
+		var current *register.Service
+		if r.Action == "update" && r.Service != nil && r.Service.Metadata["event"] != "domain" {
+			if current, err = m.fetch(m.Options().Context, r.Service); err != nil {
+				m.logf(logger.ErrorLevel, resultFields(r), "Register replica failed to fetch the service from the upstream: %v", err)
+				continue
+			}
+		}
+
+		m.Lock()
+		var events []*register.Result
+		if r.Action == "update" {
+			events, err = m.mirrorState(r.Service, current)
+		} else {
+			events, err = m.mirror(r)
+		}
+		m.Unlock()
+		if err != nil {
+			m.logf(logger.ErrorLevel, resultFields(r), "Register replica failed to apply the event: %v", err)
+		}
+		m.sendEvents(events)
+	}
+}
+
+// mirror applies the upstream event to the records, create and update events
+// merge the nodes of the service while delete events remove the listed nodes,
+// or the whole version or service when none are listed. The caller must hold
+// the lock.
+func (m *memory) mirror(r *register.Result) ([]*register.Result, error) {
+	if r == nil || r.Service == nil || r.Service.Metadata["event"] == "domain" {
+		return nil, nil
+	}
+
+	domain := mirrorDomain(r.Service)
+
+	// the upstream owns the event, never change its service or nodes
+	s := *r.Service
+	s.Metadata = copyMetadata(r.Service.Metadata)
+	s.Nodes = make([]*register.Node, 0, len(r.Service.Nodes))
+	for _, n := range r.Service.Nodes {
+		if n == nil {
+			continue
+		}
+		s.Nodes = append(s.Nodes, &register.Node{Id: n.Id, Address: n.Address, Metadata: copyMetadata(n.Metadata)})
+	}
+
+	switch r.Action {
+	case "create", "update":
+		return m.register(&s, register.NewRegisterOptions(register.RegisterDomain(domain), mirrorRegister))
+	case "delete":
+		var versions []string
+		if len(s.Version) > 0 {
+			versions = []string{s.Version}
+		} else {
+			for version := range m.records[domain][s.Name] {
+				versions = append(versions, version)
+			}
+		}
+
+		var events []*register.Result
+		for _, version := range versions {
+			srv := &register.Service{Name: s.Name, Version: version, Metadata: s.Metadata, Nodes: s.Nodes}
+			if len(s.Nodes) == 0 || len(s.Version) == 0 {
+				srv.Nodes = nil
+				if rec, ok := m.records[domain][s.Name][version]; ok {
+					for _, n := range rec.Nodes {
+						srv.Nodes = append(srv.Nodes, &register.Node{Id: n.Id, Address: n.Address})
+					}
+				}
+			}
+			evts, err := m.deregister(srv, register.NewDeregisterOptions(register.DeregisterDomain(domain), mirrorDeregister))
+			if err != nil {
+				return events, err
+			}
+			events = append(events, evts...)
+		}
+		return events, nil
+	}
+
+	return nil, nil
+}
+
+// fetch returns the current upstream state of the service version, or nil
+// when the version is gone from the upstream
+func (m *memory) fetch(ctx context.Context, s *register.Service) (*register.Service, error) {
+	srvs, err := m.upstream.LookupService(ctx, s.Name, register.LookupDomain(mirrorDomain(s)))
+	if err == register.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, srv := range srvs {
+		if srv.Version == s.Version {
+			return srv, nil
+		}
+	}
+	return nil, nil
+}
+
+// mirrorState replaces the nodes of the version with the current upstream state,
+// the version is removed when the upstream no longer has it. The caller must
+// hold the lock.
+func (m *memory) mirrorState(s, current *register.Service) ([]*register.Result, error) {
+	if s == nil || s.Metadata["event"] == "domain" {
+		return nil, nil
+	}
+	if current == nil {
+		return m.mirror(&register.Result{Action: "delete", Service: &register.Service{Name: s.Name, Version: s.Version, Metadata: s.Metadata}})
+	}
+
+	keep := make(map[string]bool, len(current.Nodes))
+	for _, n := range current.Nodes {
+		keep[n.Id] = true
+	}
+	var stale []*register.Node
+	if rec, ok := m.records[mirrorDomain(s)][s.Name][s.Version]; ok {
+		for id, n := range rec.Nodes {
+			if !keep[id] {
+				stale = append(stale, &register.Node{Id: id, Address: n.Address})
+			}
+		}
+	}
+
+	events, err := m.mirror(&register.Result{Action: "update", Service: current})
+	if err != nil || len(stale) == 0 {
+		return events, err
+	}
+	evts, err := m.mirror(&register.Result{Action: "delete", Service: &register.Service{Name: s.Name, Version: s.Version, Metadata: s.Metadata, Nodes: stale}})
+	return append(events, evts...), err
+}
+
+// mirrorDomain returns the domain of the upstream service
+func mirrorDomain(s *register.Service) string {
+	if domain := s.Metadata["domain"]; len(domain) > 0 {
+		return domain
+	}
+	return register.DefaultDomain
+}
@@ -0,0 +1,64 @@
+package memory
+
+import (
+	"github.com/unistack-org/micro/v3/register"
+)
+
+// SetSchema stores the schema document, e.g. an OpenAPI or proto descriptor,
+// of the service version replacing the previous one, schemas larger than
+// MaxSchemaBytes are rejected with ErrLimitExceeded
+func (m *memory) SetSchema(domain, service, version string, schema []byte) error {
+	if m.upstream != nil {
+		return ErrReadOnly
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if err := m.mutable(); err != nil {
+		return err
+	}
+	if len(schema) > m.maxSchema {
+		return ErrLimitExceeded
+	}
+
+	if domain == register.DefaultDomain && len(m.domain) > 0 {
+		domain = m.domain
+	}
+
+	r, ok := m.records[domain][service][version]
+	if !ok {
+		return register.ErrNotFound
+	}
+
+	r.Schema = make([]byte, len(schema))
+	copy(r.Schema, schema)
+	m.walSchema(domain, r)
+
+	return nil
+}
+
+// GetSchema returns a copy of the schema document of the service version,
+// register.ErrNotFound is returned if the version or its schema doesn't exist
+func (m *memory) GetSchema(domain, service, version string) ([]byte, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	if domain == register.DefaultDomain && len(m.domain) > 0 {
+		domain = m.domain
+	}
+
+	r, ok := m.records[domain][service][version]
+	if !ok || r.Schema == nil {
+		return nil, register.ErrNotFound
+	}
+
+	schema := make([]byte, len(r.Schema))
+	copy(schema, r.Schema)
+
+	return schema, nil
+}
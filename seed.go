@@ -0,0 +1,51 @@
+package memory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/unistack-org/micro/v3/register"
+)
+
+// seedService is a service of the seed file
+type seedService struct {
+	// Domain is the domain of the service, the default domain when empty
+	Domain string `json:"domain"`
+	register.Service
+}
+
+// seed registers the services of the JSON seed file as static services, the
+// file is applied in a single transaction so nothing is registered on error
+func (m *memory) seed(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("seed file %s: %w", path, err)
+	}
+
+	var srvs []seedService
+	if err := json.Unmarshal(b, &srvs); err != nil {
+		return fmt.Errorf("seed file %s: %w", path, err)
+	}
+
+	for i, s := range srvs {
+		if len(s.Name) == 0 {
+			return fmt.Errorf("seed file %s: service %d has no name", path, i)
+		}
+	}
+
+	err = m.Transaction(func(tx *Tx) error {
+		for i := range srvs {
+			domain := srvs[i].Domain
+			if len(domain) == 0 {
+				domain = register.DefaultDomain
+			}
+			tx.Register(&srvs[i].Service, register.RegisterDomain(domain), Static(true))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("seed file %s: %w", path, err)
+	}
+	return nil
+}
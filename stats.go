@@ -0,0 +1,111 @@
+package memory
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxLatencySamples bounds the delivery latencies kept for the percentiles
+const maxLatencySamples = 1024
+
+// Stats describes the register state
+type Stats struct {
+	// Services is the number of service versions across all domains
+	Services int
+	// Nodes is the number of nodes across all domains
+	Nodes int
+	// Watchers is the number of active watchers
+	Watchers int
+	// QuotaWarning is set while the services exceed SoftMaxServices
+	QuotaWarning bool
+	// DroppedEvents is the number of events dropped by the full event queue
+	DroppedEvents uint64
+	// DeliveredEvents is the number of events received by unbuffered watchers
+	DeliveredEvents uint64
+	// DeliveryLatencyP50, DeliveryLatencyP99 and DeliveryLatencyMax describe the
+	// time from sending an event to its receipt by a watcher, the percentiles
+	// cover the most recent deliveries
+	DeliveryLatencyP50 time.Duration
+	DeliveryLatencyP99 time.Duration
+	DeliveryLatencyMax time.Duration
+}
+
+// latencies records the event delivery latencies
+type latencies struct {
+	sync.Mutex
+	count   uint64
+	max     time.Duration
+	samples []time.Duration
+	next    int
+}
+
+// observe records a delivery latency
+func (l *latencies) observe(d time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.count++
+	if d > l.max {
+		l.max = d
+	}
+	if len(l.samples) < maxLatencySamples {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % maxLatencySamples
+}
+
+// percentile returns the latency below which the fraction p of the sorted
+// samples fall
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// Stats returns the current register stats
+func (m *memory) Stats() Stats {
+	m.RLock()
+	defer m.RUnlock()
+
+	stats := Stats{
+		Services: m.countServices(),
+	}
+	// stopped watchers are only removed on the next event or Watch
+	for _, w := range m.watchers {
+		select {
+		case <-w.exit:
+		default:
+			stats.Watchers++
+		}
+	}
+	for _, services := range m.records {
+		for _, versions := range services {
+			for _, r := range versions {
+				stats.Nodes += len(r.Nodes)
+			}
+		}
+	}
+	stats.QuotaWarning = m.softMaxServices > 0 && stats.Services > m.softMaxServices
+	stats.DroppedEvents = atomic.LoadUint64(&m.droppedEvents)
+
+	m.latency.Lock()
+	sorted := make([]time.Duration, len(m.latency.samples))
+	copy(sorted, m.latency.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	stats.DeliveredEvents = m.latency.count
+	stats.DeliveryLatencyMax = m.latency.max
+	stats.DeliveryLatencyP50 = percentile(sorted, 0.5)
+	stats.DeliveryLatencyP99 = percentile(sorted, 0.99)
+	m.latency.Unlock()
+
+	return stats
+}
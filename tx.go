@@ -0,0 +1,124 @@
+package memory
+
+import (
+	"github.com/unistack-org/micro/v3/register"
+)
+
+// Tx buffers the changes applied atomically by Transaction
+type Tx struct {
+	ops []txOp
+}
+
+type txOp struct {
+	domain string
+	apply  func(m *memory) ([]*register.Result, error)
+}
+
+// Register buffers the registration until the transaction commits
+func (tx *Tx) Register(s *register.Service, opts ...register.RegisterOption) {
+	options := register.NewRegisterOptions(opts...)
+	tx.ops = append(tx.ops, txOp{
+		domain: options.Domain,
+		apply: func(m *memory) ([]*register.Result, error) {
+			return m.register(s, options)
+		},
+	})
+}
+
+// Deregister buffers the deregistration until the transaction commits
+func (tx *Tx) Deregister(s *register.Service, opts ...register.DeregisterOption) {
+	options := register.NewDeregisterOptions(opts...)
+	tx.ops = append(tx.ops, txOp{
+		domain: options.Domain,
+		apply: func(m *memory) ([]*register.Result, error) {
+			return m.deregister(s, options)
+		},
+	})
+}
+
+// Transaction applies the changes buffered by fn under a single lock. If fn
+// or any of the changes returns an error nothing is applied, otherwise the
+// events are sent after the commit.
+func (m *memory) Transaction(fn func(tx *Tx) error) error {
+	if m.upstream != nil {
+		return ErrReadOnly
+	}
+
+	tx := &Tx{}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	m.Lock()
+	if err := m.mutable(); err != nil {
+		m.Unlock()
+		return err
+	}
+
+	// keep a copy of the touched domains to roll back on error
+	revision := m.revision
+	backup := make(map[string]services, len(tx.ops))
+	removed := make(map[string]map[string][]RemovedNode, len(tx.ops))
+	for _, op := range tx.ops {
+		// the changes are applied to the configured default domain
+		domain := op.domain
+		if domain == register.DefaultDomain && len(m.domain) > 0 {
+			domain = m.domain
+		}
+		if _, ok := backup[domain]; ok {
+			continue
+		}
+		removed[domain] = copyRemoved(m.removed[domain])
+		srvs, ok := m.records[domain]
+		if !ok {
+			backup[domain] = nil
+			continue
+		}
+		backup[domain] = copyServices(srvs)
+	}
+	peaks := m.copyPeaks(backup)
+
+	// the WAL entries are only written once the transaction commits
+	m.walBuffered = true
+
+	var events []*register.Result
+
+	for _, op := range tx.ops {
+		evts, err := op.apply(m)
+		if err != nil {
+			for domain, srvs := range backup {
+				if srvs == nil {
+					delete(m.records, domain)
+				} else {
+					m.records[domain] = srvs
+				}
+				if removed[domain] == nil {
+					delete(m.removed, domain)
+				} else {
+					m.removed[domain] = removed[domain]
+				}
+			}
+			m.restorePeaks(backup, peaks)
+			m.revision = revision
+			m.indexRebuild()
+			// the events are never sent
+			for _, r := range append(events, evts...) {
+				delete(m.diffs, r)
+			}
+			m.walBuffered, m.walPending = false, nil
+			m.Unlock()
+			return err
+		}
+		events = append(events, evts...)
+	}
+
+	for _, entry := range m.walPending {
+		m.writeWAL(entry)
+	}
+	m.walBuffered, m.walPending = false, nil
+
+	m.Unlock()
+
+	m.sendEvents(events)
+	return nil
+}
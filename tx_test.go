@@ -0,0 +1,164 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/unistack-org/micro/v3/register"
+)
+
+func TestTransactionCommit(t *testing.T) {
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	w, err := m.Watch(ctx, register.WatchDomain(register.WildcardDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	mirror := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+
+	if err := m.Transaction(func(tx *Tx) error {
+		tx.Register(srv, register.RegisterDomain("primary"))
+		tx.Register(mirror, register.RegisterDomain("dr"))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, domain := range []string{"primary", "dr"} {
+		if _, err := m.LookupService(ctx, "foo", register.LookupDomain(domain)); err != nil {
+			t.Fatalf("Expected foo in domain %s, got %v", domain, err)
+		}
+	}
+
+	domains := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		r, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		domains[r.Service.Metadata["domain"]] = true
+	}
+	if !domains["primary"] || !domains["dr"] {
+		t.Fatalf("Expected events for both domains, got %v", domains)
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	pinned := &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}}
+	if err := m.Register(ctx, pinned, Pinned(true)); err != nil {
+		t.Fatal(err)
+	}
+	rev := m.Revision()
+
+	// let the registration events settle before watching
+	time.Sleep(50 * time.Millisecond)
+
+	w, err := m.Watch(ctx, register.WatchDomain(register.WildcardDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	errTx := errors.New("abort")
+	if err := m.Transaction(func(tx *Tx) error {
+		tx.Register(&register.Service{Name: "foo", Version: "1.0.0"})
+		return errTx
+	}); err != errTx {
+		t.Fatalf("Expected error: %v, got: %v", errTx, err)
+	}
+
+	// the second change fails so the first one must be rolled back
+	if err := m.Transaction(func(tx *Tx) error {
+		tx.Register(&register.Service{Name: "foo", Version: "1.0.0"})
+		tx.Register(&register.Service{Name: "foo", Version: "1.0.0"}, register.RegisterDomain("dr"))
+		tx.Deregister(pinned)
+		return nil
+	}); err != ErrPinned {
+		t.Fatalf("Expected error: %v, got: %v", ErrPinned, err)
+	}
+
+	if _, err := m.LookupService(ctx, "foo", register.LookupDomain(register.WildcardDomain)); err != register.ErrNotFound {
+		t.Fatalf("Expected error: %v, got: %v", register.ErrNotFound, err)
+	}
+	if _, err := m.LookupService(ctx, "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if m.Revision() != rev {
+		t.Fatalf("Expected revision %d, got %d", rev, m.Revision())
+	}
+
+	res := make(chan *register.Result, 1)
+	go func() {
+		if r, err := w.Next(); err == nil {
+			res <- r
+		}
+	}()
+
+	select {
+	case r := <-res:
+		t.Fatalf("unexpected event %s for %s", r.Action, r.Service.Name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTransactionRollbackDefaultDomain(t *testing.T) {
+	m := newMemory(register.NewOptions(DefaultDomain("custom")))
+	ctx := context.TODO()
+
+	pinned := &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}}
+	if err := m.Register(ctx, pinned, Pinned(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	// both changes apply to the custom domain, the first one must be rolled back
+	if err := m.Transaction(func(tx *Tx) error {
+		tx.Register(&register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}})
+		tx.Deregister(pinned)
+		return nil
+	}); err != ErrPinned {
+		t.Fatalf("Expected error: %v, got: %v", ErrPinned, err)
+	}
+
+	if _, err := m.LookupService(ctx, "foo", register.LookupDomain("custom")); err != register.ErrNotFound {
+		t.Fatalf("Expected foo to be rolled back, got: %v", err)
+	}
+	if _, err := m.LookupService(ctx, "bar", register.LookupDomain("custom")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransactionRollbackPeaks(t *testing.T) {
+	m := newMemory(register.NewOptions())
+	ctx := context.TODO()
+
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1", Nodes: []*register.Node{{Id: "foo-1"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := &register.Service{Name: "bad", Version: "1", Nodes: []*register.Node{{Id: "bad-1", Metadata: map[string]string{"protocol": "carrier-pigeon"}}}}
+	if err := m.Transaction(func(tx *Tx) error {
+		tx.Register(&register.Service{Name: "ghost", Version: "1", Nodes: []*register.Node{{Id: "ghost-1"}}})
+		tx.Register(&register.Service{Name: "foo", Version: "1", Nodes: []*register.Node{{Id: "foo-2"}, {Id: "foo-3"}}})
+		tx.Register(invalid)
+		return nil
+	}); err != ErrInvalidProtocol {
+		t.Fatalf("Expected error: %v, got: %v", ErrInvalidProtocol, err)
+	}
+
+	// the peaks observed by the rolled back changes are rolled back as well
+	if n, err := m.PeakNodes(register.DefaultDomain, "ghost", "1", time.Minute); err != register.ErrNotFound {
+		t.Fatalf("Expected no peak for the rolled back service, got %d, %v", n, err)
+	}
+	if n, err := m.PeakNodes(register.DefaultDomain, "foo", "1", time.Minute); err != nil || n != 1 {
+		t.Fatalf("Expected the peak of 1 node to be kept, got %d, %v", n, err)
+	}
+}
@@ -1,25 +1,672 @@
 package memory
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/unistack-org/micro/v3/register"
 )
 
-func serviceToRecord(s *register.Service, ttl time.Duration) *record {
-	metadata := make(map[string]string, len(s.Metadata))
+// protocols are the known node protocols
+var protocols = map[string]bool{
+	"http":  true,
+	"https": true,
+	"grpc":  true,
+}
+
+// nodeProtocol returns the normalized protocol from the node metadata,
+// an empty string is returned if the protocol isn't set
+func nodeProtocol(md map[string]string) (string, error) {
+	protocol := strings.ToLower(strings.TrimSpace(md["protocol"]))
+	if len(protocol) == 0 {
+		return "", nil
+	}
+	if !protocols[protocol] {
+		return "", ErrInvalidProtocol
+	}
+	return protocol, nil
+}
+
+// tiers are the known service tiers ranked from the lowest to the highest,
+// services without a tier are standard
+var tiers = map[string]int{
+	"best-effort": 1,
+	"standard":    2,
+	"critical":    3,
+}
+
+// serviceTier returns the normalized tier from the service metadata,
+// an empty string is returned if the tier isn't set
+func serviceTier(md map[string]string) (string, error) {
+	tier := strings.ToLower(strings.TrimSpace(md["tier"]))
+	if len(tier) == 0 {
+		return "", nil
+	}
+	if _, ok := tiers[tier]; !ok {
+		return "", ErrInvalidTier
+	}
+	return tier, nil
+}
+
+// atLeastTier reports whether the service metadata tier ranks at least as high
+// as the minimum tier, unknown minimum tiers match no service
+func atLeastTier(md map[string]string, min string) bool {
+	rank, ok := tiers[min]
+	if !ok {
+		return false
+	}
+	tier := md["tier"]
+	if len(tier) == 0 {
+		tier = "standard"
+	}
+	return tiers[tier] >= rank
+}
+
+// Tags are the routing tags parsed from the node metadata
+type Tags struct {
+	Region   string
+	Zone     string
+	Weight   int
+	Protocol string
+}
+
+// NodeTags returns the routing tags of the node, absent or invalid
+// values are left zero
+func NodeTags(n *register.Node) Tags {
+	var tags Tags
+	if n == nil || n.Metadata == nil {
+		return tags
+	}
+
+	tags.Region = n.Metadata["region"]
+	tags.Zone = n.Metadata["zone"]
+	if weight, err := strconv.Atoi(n.Metadata["weight"]); err == nil {
+		tags.Weight = weight
+	}
+	tags.Protocol, _ = nodeProtocol(n.Metadata)
+
+	return tags
+}
+
+// metadataSize returns the summed length of the service and node metadata keys and values
+func metadataSize(s *register.Service) int {
+	var size int
 	for k, v := range s.Metadata {
-		metadata[k] = v
+		size += len(k) + len(v)
+	}
+	for _, n := range s.Nodes {
+		for k, v := range n.Metadata {
+			size += len(k) + len(v)
+		}
+	}
+	return size
+}
+
+// duplicateAddress returns an address of the nodes already used by a node
+// with another id in the record or in the nodes
+func duplicateAddress(r *record, nodes []*register.Node) (string, bool) {
+	owners := make(map[string]string)
+	if r != nil {
+		for id, n := range r.Nodes {
+			if len(n.Address) > 0 {
+				owners[n.Address] = id
+			}
+		}
+	}
+
+	for _, n := range nodes {
+		if len(n.Address) == 0 {
+			continue
+		}
+		if id, ok := owners[n.Address]; ok && id != n.Id {
+			return n.Address, true
+		}
+		owners[n.Address] = n.Id
+	}
+
+	return "", false
+}
+
+// hashService returns the content hash of the service, it's stable across
+// map iteration order so equal services have equal hashes
+func hashService(s *register.Service) string {
+	h := sha256.New()
+
+	write := func(v string) {
+		fmt.Fprintf(h, "%d:%s", len(v), v)
+	}
+	writeMetadata := func(md map[string]string) {
+		keys := make([]string, 0, len(md))
+		for k := range md {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		write(strconv.Itoa(len(keys)))
+		for _, k := range keys {
+			write(k)
+			write(md[k])
+		}
+	}
+	var writeValue func(v *register.Value)
+	writeValue = func(v *register.Value) {
+		if v == nil {
+			write("")
+			return
+		}
+		write(v.Name)
+		write(v.Type)
+		write(strconv.Itoa(len(v.Values)))
+		for _, sv := range v.Values {
+			writeValue(sv)
+		}
+	}
+
+	write(s.Name)
+	write(s.Version)
+	writeMetadata(s.Metadata)
+
+	nodes := make([]*register.Node, len(s.Nodes))
+	copy(nodes, s.Nodes)
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Id < nodes[j].Id })
+	write(strconv.Itoa(len(nodes)))
+	for _, n := range nodes {
+		write(n.Id)
+		write(n.Address)
+		writeMetadata(n.Metadata)
+	}
+
+	endpoints := make([]*register.Endpoint, len(s.Endpoints))
+	copy(endpoints, s.Endpoints)
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Name < endpoints[j].Name })
+	write(strconv.Itoa(len(endpoints)))
+	for _, e := range endpoints {
+		write(e.Name)
+		writeMetadata(e.Metadata)
+		writeValue(e.Request)
+		writeValue(e.Response)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashResult returns a resync result carrying only the service name,
+// version, domain and content hash
+func hashResult(s *register.Service) *register.Result {
+	return &register.Result{
+		Action: "resync",
+		Service: &register.Service{
+			Name:    s.Name,
+			Version: s.Version,
+			Metadata: map[string]string{
+				"domain": s.Metadata["domain"],
+				"hash":   hashService(s),
+			},
+		},
+	}
+}
+
+// diffResult returns an update result carrying only the ids of the added
+// and removed nodes
+func diffResult(s *register.Service, domain string, added, removed []string) *register.Result {
+	return &register.Result{
+		Action: "update",
+		Service: &register.Service{
+			Name:    s.Name,
+			Version: s.Version,
+			Metadata: map[string]string{
+				"domain":  domain,
+				"added":   strings.Join(added, ","),
+				"removed": strings.Join(removed, ","),
+			},
+		},
+	}
+}
+
+// withSequence returns a copy of the event with the sequence number in the
+// service metadata, the sent event is shared so it's never changed
+func withSequence(r *register.Result, seq uint64) *register.Result {
+	if r.Service == nil {
+		return r
+	}
+
+	srv := *r.Service
+	srv.Metadata = make(map[string]string, len(r.Service.Metadata)+1)
+	for k, v := range r.Service.Metadata {
+		srv.Metadata[k] = v
+	}
+	srv.Metadata["sequence"] = strconv.FormatUint(seq, 10)
+
+	res := *r
+	res.Service = &srv
+	return &res
+}
+
+// equalKeys reports whether both key sets are equal
+func equalKeys(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if !b[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// copyValue returns a deep copy of the value tree
+func copyValue(v *register.Value) *register.Value {
+	if v == nil {
+		return nil
+	}
+
+	c := &register.Value{Name: v.Name, Type: v.Type}
+	if v.Values != nil {
+		c.Values = make([]*register.Value, len(v.Values))
+		for i, sv := range v.Values {
+			c.Values[i] = copyValue(sv)
+		}
+	}
+
+	return c
+}
+
+// flagMetadata returns the event metadata of the record in the domain, the
+// feature flag of the record is kept so the event is hidden like the record
+func flagMetadata(r *record, domain string) map[string]string {
+	md := map[string]string{"domain": domain}
+	if flag, ok := r.Metadata["flag"]; ok {
+		md["flag"] = flag
+	}
+	return md
+}
+
+// copyMetadata returns a copy of the metadata
+func copyMetadata(md map[string]string) map[string]string {
+	if md == nil {
+		return nil
+	}
+	c := make(map[string]string, len(md))
+	for k, v := range md {
+		c[k] = v
+	}
+	return c
+}
+
+// nodeIDs returns the ids of the nodes of the record
+func nodeIDs(r *record) []string {
+	ids := make([]string, 0, len(r.Nodes))
+	for id := range r.Nodes {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// copyRecord returns a deep copy of the record, endpoints are shared
+// as they are never modified after registration
+func copyRecord(r *record) *record {
+	c := *r
+
+	c.Metadata = make(map[string]string, len(r.Metadata))
+	for k, v := range r.Metadata {
+		c.Metadata[k] = v
+	}
+
+	c.Nodes = make(map[string]*node, len(r.Nodes))
+	for id, n := range r.Nodes {
+		cn := *n
+		cn.Node = &register.Node{
+			Id:       n.Id,
+			Address:  n.Address,
+			Metadata: make(map[string]string, len(n.Metadata)),
+		}
+		for k, v := range n.Metadata {
+			cn.Metadata[k] = v
+		}
+		c.Nodes[id] = &cn
+	}
+
+	c.Endpoints = make([]*register.Endpoint, len(r.Endpoints))
+	copy(c.Endpoints, r.Endpoints)
+
+	return &c
+}
+
+// copyServices returns a deep copy of the services map
+func copyServices(srvs services) services {
+	c := make(services, len(srvs))
+	for name, versions := range srvs {
+		c[name] = make(map[string]*record, len(versions))
+		for version, r := range versions {
+			c[name][version] = copyRecord(r)
+		}
+	}
+	return c
+}
+
+// normalizeMetadata returns a copy of the metadata with normalized keys,
+// keys already in normal form win over the ones normalized into them
+func normalizeMetadata(md map[string]string, fn func(string) string) map[string]string {
+	if md == nil {
+		return nil
+	}
+	normalized := make(map[string]string, len(md))
+	for k, v := range md {
+		nk := fn(k)
+		if _, ok := md[nk]; ok && nk != k {
+			continue
+		}
+		normalized[nk] = v
+	}
+	return normalized
+}
+
+// nodeReady reports whether the node is ready to serve, nodes are ready
+// unless the ready metadata is false
+func nodeReady(md map[string]string) bool {
+	return md["ready"] != "false"
+}
+
+// filterHealthy drops the service nodes which aren't ready or are drained,
+// it returns false if no node is left
+func filterHealthy(s *register.Service) bool {
+	nodes := s.Nodes[:0]
+	for _, n := range s.Nodes {
+		if nodeReady(n.Metadata) && n.Metadata["drained"] != "true" {
+			nodes = append(nodes, n)
+		}
+	}
+	s.Nodes = nodes
+	return len(nodes) > 0
+}
+
+// globMatch reports whether the name matches the glob pattern, * matches any
+// sequence of characters and ? matches a single character
+func globMatch(pattern, name string) bool {
+	p, n := 0, 0
+	// the position after the last star and the name position it matched up to
+	star, next := -1, 0
+
+	for n < len(name) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star = p + 1
+			next = n
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == name[n]):
+			p++
+			n++
+		case star >= 0:
+			// let the last star match one more character
+			next++
+			p = star
+			n = next
+		default:
+			return false
+		}
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
 	}
+	return p == len(pattern)
+}
+
+// nodeHash returns the stable hash of the node id, it only depends on the id
+// so it is equal across lookups, registers and restarts
+func nodeHash(id string) string {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// hashNodes orders the service nodes by the hash of the key and node id
+func hashNodes(s *register.Service, key string) {
+	hashes := make(map[string]uint64, len(s.Nodes))
+	for _, n := range s.Nodes {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(n.Id))
+		hashes[n.Id] = h.Sum64()
+	}
+
+	sort.Slice(s.Nodes, func(i, j int) bool {
+		a, b := hashes[s.Nodes[i].Id], hashes[s.Nodes[j].Id]
+		if a != b {
+			return a < b
+		}
+		return s.Nodes[i].Id < s.Nodes[j].Id
+	})
+}
+
+// preferZone moves the service nodes in the zone first keeping the order
+// of the nodes otherwise
+func preferZone(s *register.Service, zone string) {
+	sort.SliceStable(s.Nodes, func(i, j int) bool {
+		return s.Nodes[i].Metadata["zone"] == zone && s.Nodes[j].Metadata["zone"] != zone
+	})
+}
+
+// flattenServices merges the services into one, nodes are deduplicated by
+// id and endpoints by name, the lowest version wins on conflicts
+func flattenServices(srvs []*register.Service) *register.Service {
+	sort.Slice(srvs, func(i, j int) bool { return srvs[i].Version < srvs[j].Version })
+
+	flat := &register.Service{Name: srvs[0].Name, Metadata: make(map[string]string)}
+	versions := make([]string, 0, len(srvs))
+	seenVersions := make(map[string]bool, len(srvs))
+	seenNodes := make(map[string]bool)
+	seenEndpoints := make(map[string]bool)
+
+	for _, srv := range srvs {
+		if !seenVersions[srv.Version] {
+			seenVersions[srv.Version] = true
+			versions = append(versions, srv.Version)
+		}
+		for k, v := range srv.Metadata {
+			if _, ok := flat.Metadata[k]; !ok {
+				flat.Metadata[k] = v
+			}
+		}
+		for _, n := range srv.Nodes {
+			if !seenNodes[n.Id] {
+				seenNodes[n.Id] = true
+				flat.Nodes = append(flat.Nodes, n)
+			}
+		}
+		for _, e := range srv.Endpoints {
+			if !seenEndpoints[e.Name] {
+				seenEndpoints[e.Name] = true
+				flat.Endpoints = append(flat.Endpoints, e)
+			}
+		}
+	}
+	flat.Version = strings.Join(versions, ",")
+
+	return flat
+}
+
+// flattenNames flattens the versions of each service separately, the
+// services are grouped by name and, unless the domains are merged, by domain.
+// The merged services carry the domains metadata, the result is sorted by
+// name and domain.
+func flattenNames(srvs []*register.Service, merge bool) []*register.Service {
+	var keys []string
+	grouped := make(map[string][]*register.Service)
+
+	for _, s := range srvs {
+		key := s.Name
+		if !merge {
+			key += "\x00" + s.Metadata["domain"]
+		}
+		if _, ok := grouped[key]; !ok {
+			keys = append(keys, key)
+		}
+		grouped[key] = append(grouped[key], s)
+	}
+	sort.Strings(keys)
+
+	result := make([]*register.Service, 0, len(keys))
+	for _, key := range keys {
+		flat := flattenServices(grouped[key])
+		if merge {
+			setDomains(flat, grouped[key])
+		}
+		result = append(result, flat)
+	}
+
+	return result
+}
+
+// primaryVersions returns the versions marked as primary, or all the
+// versions when none is marked
+func primaryVersions(srvs []*register.Service) []*register.Service {
+	var primary []*register.Service
+	for _, s := range srvs {
+		if s.Metadata["primary"] == "true" {
+			primary = append(primary, s)
+		}
+	}
+	if len(primary) == 0 {
+		return srvs
+	}
+	return primary
+}
+
+// mergeDomains merges the services sharing a name and version into a
+// single service carrying the domains metadata, sorted by name and version
+func mergeDomains(srvs []*register.Service) []*register.Service {
+	var result []*register.Service
+	grouped := make(map[string][]*register.Service)
+
+	for _, s := range srvs {
+		key := s.Name + "\x00" + s.Version
+		grouped[key] = append(grouped[key], s)
+	}
+
+	for _, group := range grouped {
+		merged := flattenServices(group)
+		setDomains(merged, group)
+		result = append(result, merged)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].Version < result[j].Version
+	})
+
+	return result
+}
+
+// setDomains sets the sorted comma separated domains of the services in
+// the domains metadata of the merged service, the domain metadata is set
+// to the first of them so it doesn't depend on the merge order
+func setDomains(merged *register.Service, srvs []*register.Service) {
+	var domains []string
+	seen := make(map[string]bool, len(srvs))
+
+	for _, s := range srvs {
+		if d := s.Metadata["domain"]; !seen[d] {
+			seen[d] = true
+			domains = append(domains, d)
+		}
+	}
+	sort.Strings(domains)
+
+	merged.Metadata["domain"] = domains[0]
+	merged.Metadata["domains"] = strings.Join(domains, ",")
+}
+
+// available reports whether the time is inside the daily availability
+// window of the metadata, the window is set as availability=HH:MM-HH:MM
+// in the time location and may wrap around midnight, metadata without a
+// valid window is always available
+func available(md map[string]string, t time.Time) bool {
+	window, ok := md["availability"]
+	if !ok {
+		return true
+	}
+
+	bounds := strings.SplitN(window, "-", 2)
+	if len(bounds) != 2 {
+		return true
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return true
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(bounds[1]))
+	if err != nil {
+		return true
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	from := start.Hour()*60 + start.Minute()
+	until := end.Hour()*60 + end.Minute()
+
+	if from <= until {
+		return minute >= from && minute < until
+	}
+	// the window wraps around midnight
+	return minute >= from || minute < until
+}
 
-	nodes := make(map[string]*node, len(s.Nodes))
+// filterAvailable drops the service nodes outside their availability window,
+// it returns false if the service is outside its window or no node is left
+func filterAvailable(s *register.Service, t time.Time) bool {
+	if !available(s.Metadata, t) {
+		return false
+	}
+	if len(s.Nodes) == 0 {
+		return true
+	}
+	nodes := s.Nodes[:0]
 	for _, n := range s.Nodes {
-		nodes[n.Id] = &node{
-			Node:     n,
-			TTL:      ttl,
-			LastSeen: time.Now(),
+		if available(n.Metadata, t) {
+			nodes = append(nodes, n)
 		}
 	}
+	s.Nodes = nodes
+	return len(nodes) > 0
+}
+
+// filterEndpoints drops the service endpoints without all the metadata
+// pairs, it returns false if no endpoint is left
+func filterEndpoints(s *register.Service, md map[string]string) bool {
+	endpoints := s.Endpoints[:0]
+	for _, e := range s.Endpoints {
+		matched := true
+		for k, v := range md {
+			if ev, ok := e.Metadata[k]; !ok || ev != v {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			endpoints = append(endpoints, e)
+		}
+	}
+	s.Endpoints = endpoints
+	return len(endpoints) > 0
+}
+
+// serviceToRecord returns a record without nodes, the nodes are added by Register
+func serviceToRecord(s *register.Service) *record {
+	metadata := make(map[string]string, len(s.Metadata))
+	for k, v := range s.Metadata {
+		metadata[k] = v
+	}
 
 	endpoints := make([]*register.Endpoint, len(s.Endpoints))
 	for i, e := range s.Endpoints {
@@ -30,7 +677,7 @@ func serviceToRecord(s *register.Service, ttl time.Duration) *record {
 		Name:      s.Name,
 		Version:   s.Version,
 		Metadata:  metadata,
-		Nodes:     nodes,
+		Nodes:     make(map[string]*node, len(s.Nodes)),
 		Endpoints: endpoints,
 	}
 }
@@ -48,11 +695,11 @@ func recordToService(r *record, domain string) *register.Service {
 	for i, e := range r.Endpoints {
 		request := new(register.Value)
 		if e.Request != nil {
-			*request = *e.Request
+			request = copyValue(e.Request)
 		}
 		response := new(register.Value)
 		if e.Response != nil {
-			*response = *e.Response
+			response = copyValue(e.Response)
 		}
 
 		metadata := make(map[string]string, len(e.Metadata))
@@ -76,6 +723,17 @@ func recordToService(r *record, domain string) *register.Service {
 			metadata[k] = v
 		}
 
+		if n.Drained {
+			metadata["drained"] = "true"
+		}
+		if len(n.LastError) > 0 {
+			metadata["last_error"] = n.LastError
+			metadata["last_error_at"] = n.LastErrorAt.UTC().Format(time.RFC3339)
+		}
+		if len(n.Hash) > 0 {
+			metadata["nodeHash"] = n.Hash
+		}
+
 		nodes[i] = &register.Node{
 			Id:       n.Id,
 			Address:  n.Address,
@@ -92,3 +750,137 @@ func recordToService(r *record, domain string) *register.Service {
 		Nodes:     nodes,
 	}
 }
+
+// groupVersions returns a service per name and domain with the version and
+// node counts in metadata, sorted by domain and name
+func groupVersions(srvs []*register.Service) []*register.Service {
+	var result []*register.Service
+	grouped := make(map[string]*register.Service)
+	versions := make(map[string]map[string]bool)
+	nodes := make(map[string]int)
+
+	for _, s := range srvs {
+		key := s.Metadata["domain"] + "/" + s.Name
+		if _, ok := grouped[key]; !ok {
+			grouped[key] = &register.Service{Name: s.Name, Metadata: map[string]string{"domain": s.Metadata["domain"]}}
+			versions[key] = make(map[string]bool)
+			result = append(result, grouped[key])
+		}
+		versions[key][s.Version] = true
+		nodes[key] += len(s.Nodes)
+	}
+
+	for key, s := range grouped {
+		s.Metadata["versionCount"] = strconv.Itoa(len(versions[key]))
+		s.Metadata["nodeCount"] = strconv.Itoa(nodes[key])
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Metadata["domain"] != result[j].Metadata["domain"] {
+			return result[i].Metadata["domain"] < result[j].Metadata["domain"]
+		}
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+// nodeMatches reports whether the node metadata has all the pairs
+func nodeMatches(n *register.Node, md map[string]string) bool {
+	if n == nil {
+		return false
+	}
+	for k, v := range md {
+		if n.Metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// anyNodeMatches reports whether any node metadata has all the pairs
+func anyNodeMatches(nodes []*register.Node, md map[string]string) bool {
+	for _, n := range nodes {
+		if nodeMatches(n, md) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordEqual reports whether registering the service into the domain leaves
+// the record unchanged, the service metadata, endpoints and nodes match the
+// record, the record may have additional nodes
+func recordEqual(r *record, s *register.Service, domain string) bool {
+	if !metadataEqual(r.Metadata, s.Metadata) || len(r.Endpoints) != len(s.Endpoints) {
+		return false
+	}
+	for i, e := range s.Endpoints {
+		if !reflect.DeepEqual(r.Endpoints[i], e) {
+			return false
+		}
+	}
+
+	for _, n := range s.Nodes {
+		rn, ok := r.Nodes[n.Id]
+		if !ok || rn.Address != n.Address {
+			return false
+		}
+
+		// the stored metadata carries the domain and the normalized protocol
+		metadata := make(map[string]string, len(n.Metadata)+2)
+		for k, v := range n.Metadata {
+			metadata[k] = v
+		}
+		metadata["domain"] = domain
+		if protocol, _ := nodeProtocol(n.Metadata); len(protocol) > 0 {
+			metadata["protocol"] = protocol
+		}
+		if !metadataEqual(rn.Metadata, metadata) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// metadataEqual reports whether the metadata have the same pairs, it is
+// compared key by key as the register and stored metadata types differ
+func metadataEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// earthRadius is the mean earth radius in kilometers
+const earthRadius = 6371.0
+
+// nodePosition parses the lat and lon metadata in degrees, it returns false
+// if either is missing or out of range
+func nodePosition(md map[string]string) (lat, lon float64, ok bool) {
+	lat, err := strconv.ParseFloat(md["lat"], 64)
+	if err != nil || math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return 0, 0, false
+	}
+	lon, err = strconv.ParseFloat(md["lon"], 64)
+	if err != nil || math.IsNaN(lon) || lon < -180 || lon > 180 {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// distance returns the great-circle distance in kilometers between the
+// points in degrees using the haversine formula
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlon := (lon2 - lon1) * rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
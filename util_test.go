@@ -0,0 +1,85 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/unistack-org/micro/v3/register"
+)
+
+func TestNodeTags(t *testing.T) {
+	testCases := []struct {
+		name     string
+		node     *register.Node
+		expected Tags
+	}{
+		{
+			name: "full",
+			node: &register.Node{Metadata: map[string]string{
+				"region":   "eu",
+				"zone":     "eu-1a",
+				"weight":   "10",
+				"protocol": "GRPC",
+			}},
+			expected: Tags{Region: "eu", Zone: "eu-1a", Weight: 10, Protocol: "grpc"},
+		},
+		{
+			name: "partial",
+			node: &register.Node{Metadata: map[string]string{
+				"zone":   "eu-1b",
+				"weight": "heavy",
+			}},
+			expected: Tags{Zone: "eu-1b"},
+		},
+		{
+			name:     "empty",
+			node:     &register.Node{},
+			expected: Tags{},
+		},
+	}
+
+	for _, tc := range testCases {
+		if tags := NodeTags(tc.node); tags != tc.expected {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expected, tags)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	// london to paris is about 344km
+	if d := distance(51.51, -0.13, 48.86, 2.35); d < 340 || d > 348 {
+		t.Fatalf("Expected about 344km, got %v", d)
+	}
+	if d := distance(10, 20, 10, 20); d != 0 {
+		t.Fatalf("Expected no distance, got %v", d)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"payments.*", "payments.api", true},
+		{"payments.*", "payments.", true},
+		{"payments.*", "payments", false},
+		{"payments.*", "billing.api", false},
+		{"*.api", "payments.api", true},
+		{"*.api", "payments.api.v2", false},
+		{"*api*", "payments.api.v2", true},
+		{"foo?", "foo1", true},
+		{"foo?", "foo", false},
+		{"foo?", "foo12", false},
+		{"f*o*o", "foooo", true},
+		{"*", "", true},
+		{"", "", true},
+		{"", "foo", false},
+		{"foo", "foo", true},
+	}
+
+	for _, tc := range testCases {
+		if got := globMatch(tc.pattern, tc.name); got != tc.match {
+			t.Errorf("Expected globMatch(%q, %q) to be %v, got %v", tc.pattern, tc.name, tc.match, got)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package memory
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/unistack-org/micro/v3/register"
+)
+
+// Validate checks the register invariants and returns an error describing
+// the first violation found, it's meant for tests and debugging
+func (m *memory) Validate() error {
+	m.RLock()
+	defer m.RUnlock()
+
+	for domain, srvs := range m.records {
+		if srvs == nil {
+			return fmt.Errorf("domain %s: nil services", domain)
+		}
+		for name, versions := range srvs {
+			if len(versions) == 0 {
+				return fmt.Errorf("domain %s, service %s: no versions", domain, name)
+			}
+			for version, r := range versions {
+				if err := validateRecord(domain, name, version, r); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateRecord checks the record stored under the domain, name and version
+func validateRecord(domain, name, version string, r *record) error {
+	if r == nil {
+		return fmt.Errorf("domain %s, service %s, version %s: nil record", domain, name, version)
+	}
+	if r.Name != name || r.Version != version {
+		return fmt.Errorf("domain %s, service %s, version %s: record is %s %s", domain, name, version, r.Name, r.Version)
+	}
+	if d := r.Metadata["domain"]; d != domain {
+		return fmt.Errorf("domain %s, service %s, version %s: domain metadata is %q", domain, name, version, d)
+	}
+	if r.Nodes == nil {
+		return fmt.Errorf("domain %s, service %s, version %s: nil nodes", domain, name, version)
+	}
+
+	for id, n := range r.Nodes {
+		if n == nil || n.Node == nil {
+			return fmt.Errorf("domain %s, service %s, version %s: nil node %s", domain, name, version, id)
+		}
+		if len(n.Id) == 0 {
+			return fmt.Errorf("domain %s, service %s, version %s: node with empty id", domain, name, version)
+		}
+		if n.Id != id {
+			return fmt.Errorf("domain %s, service %s, version %s: node %s stored as %s", domain, name, version, n.Id, id)
+		}
+		if d := n.Metadata["domain"]; d != domain {
+			return fmt.Errorf("domain %s, service %s, version %s: node %s domain metadata is %q", domain, name, version, id, d)
+		}
+	}
+
+	return nil
+}
+
+// validateEndpoints checks the service endpoints are named and have the
+// request and response values listed in their required metadata
+func validateEndpoints(s *register.Service) error {
+	for i, e := range s.Endpoints {
+		if e == nil {
+			return fmt.Errorf("%w: service %s endpoint %d is nil", ErrInvalidEndpoint, s.Name, i)
+		}
+		if len(strings.TrimSpace(e.Name)) == 0 {
+			return fmt.Errorf("%w: service %s endpoint %d has no name", ErrInvalidEndpoint, s.Name, i)
+		}
+		for _, value := range strings.Split(e.Metadata["required"], ",") {
+			switch strings.TrimSpace(value) {
+			case "":
+			case "request":
+				if e.Request == nil {
+					return fmt.Errorf("%w: service %s endpoint %s has no request", ErrInvalidEndpoint, s.Name, e.Name)
+				}
+			case "response":
+				if e.Response == nil {
+					return fmt.Errorf("%w: service %s endpoint %s has no response", ErrInvalidEndpoint, s.Name, e.Name)
+				}
+			default:
+				return fmt.Errorf("%w: service %s endpoint %s requires unknown value %q", ErrInvalidEndpoint, s.Name, e.Name, value)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/unistack-org/micro/v3/register"
+)
+
+func TestValidate(t *testing.T) {
+	testData := []struct {
+		name    string
+		corrupt func(m *memory)
+	}{
+		{"empty versions", func(m *memory) {
+			m.records[register.DefaultDomain]["bar"] = make(map[string]*record)
+		}},
+		{"nil record", func(m *memory) {
+			m.records[register.DefaultDomain]["foo"]["1.0.0"] = nil
+		}},
+		{"domain metadata", func(m *memory) {
+			m.records[register.DefaultDomain]["foo"]["1.0.0"].Metadata["domain"] = "other"
+		}},
+		{"missing domain metadata", func(m *memory) {
+			delete(m.records[register.DefaultDomain]["foo"]["1.0.0"].Metadata, "domain")
+		}},
+		{"empty node id", func(m *memory) {
+			m.records[register.DefaultDomain]["foo"]["1.0.0"].Nodes["foo-1"].Id = ""
+		}},
+		{"node key mismatch", func(m *memory) {
+			nodes := m.records[register.DefaultDomain]["foo"]["1.0.0"].Nodes
+			nodes["foo-2"] = nodes["foo-1"]
+		}},
+		{"node domain metadata", func(m *memory) {
+			delete(m.records[register.DefaultDomain]["foo"]["1.0.0"].Nodes["foo-1"].Metadata, "domain")
+		}},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			// no pruner runs over the corrupted state
+			m := newMemory(register.NewOptions())
+			srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1", Address: "localhost:9999"}}}
+			if err := m.Register(context.TODO(), srv); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Validate(); err != nil {
+				t.Fatalf("Unexpected error before corrupting the state: %v", err)
+			}
+
+			m.Lock()
+			tt.corrupt(m)
+			m.Unlock()
+
+			if err := m.Validate(); err == nil {
+				t.Fatal("Expected the corrupted state to be detected")
+			}
+		})
+	}
+}
+
+func TestValidateAfterOperations(t *testing.T) {
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	for _, version := range []string{"1.0.0", "1.0.1"} {
+		srv := &register.Service{Name: "foo", Version: version, Nodes: []*register.Node{{Id: "foo-1"}, {Id: "foo-2"}}}
+		if err := m.Register(ctx, srv, register.RegisterDomain("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Deregister(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}, {Id: "foo-2"}}}, register.DeregisterDomain("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RenameDomain("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateEndpoints(t *testing.T) {
+	value := &register.Value{Name: "Request", Type: "Request"}
+
+	testData := []struct {
+		name     string
+		endpoint *register.Endpoint
+		valid    bool
+	}{
+		{"complete", &register.Endpoint{Name: "Foo.Call", Request: value, Response: value, Metadata: map[string]string{"required": "request,response"}}, true},
+		{"optional values", &register.Endpoint{Name: "Foo.Stream"}, true},
+		{"missing name", &register.Endpoint{Request: value, Response: value}, false},
+		{"missing request", &register.Endpoint{Name: "Foo.Call", Response: value, Metadata: map[string]string{"required": "request, response"}}, false},
+		{"missing response", &register.Endpoint{Name: "Foo.Call", Request: value, Metadata: map[string]string{"required": "response"}}, false},
+		{"unknown required value", &register.Endpoint{Name: "Foo.Call", Metadata: map[string]string{"required": "body"}}, false},
+	}
+
+	for _, tt := range testData {
+		m := newMemory(register.NewOptions(ValidateEndpoints(true)))
+		srv := &register.Service{
+			Name:      "foo",
+			Version:   "1.0.0",
+			Endpoints: []*register.Endpoint{tt.endpoint},
+			Nodes:     []*register.Node{{Id: "foo-1"}},
+		}
+		err := m.Register(context.TODO(), srv)
+		if tt.valid && err != nil {
+			t.Fatalf("%s: expected the endpoint to be valid, got %v", tt.name, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalidEndpoint) {
+			t.Fatalf("%s: expected ErrInvalidEndpoint, got %v", tt.name, err)
+		}
+	}
+
+	// endpoints aren't validated by default
+	m := newMemory(register.NewOptions())
+	srv := &register.Service{Name: "foo", Endpoints: []*register.Endpoint{{}}, Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(context.TODO(), srv); err != nil {
+		t.Fatal(err)
+	}
+}
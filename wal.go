@@ -0,0 +1,330 @@
+package memory
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/unistack-org/micro/v3/logger"
+	"github.com/unistack-org/micro/v3/register"
+)
+
+// maxWALEntry is the size limit of a WAL entry, larger sizes mean a corrupted log
+const maxWALEntry = 64 << 20
+
+// the expiry and the state of the logged nodes is carried in their metadata,
+// the pinned flag and the schema in the service metadata, and removed again
+// on replay
+const (
+	walTTLKey      = "walTTL"
+	walExpireAtKey = "walExpireAt"
+	walPinnedKey   = "walPinned"
+	walStaticKey   = "walStatic"
+	walDrainedKey  = "walDrained"
+	walErrorKey    = "walError"
+	walErrorAtKey  = "walErrorAt"
+	walSchemaKey   = "walSchema"
+)
+
+// walRegister logs the registration of the nodes of the record with their
+// TTL, deadline and state, a record without nodes logs the empty version.
+// Replaying the entry again for registered nodes restores their state. The
+// caller must hold the lock.
+func (m *memory) walRegister(domain string, r *record, ids []string) {
+	if m.wal == nil {
+		return
+	}
+
+	s := &register.Service{
+		Name:      r.Name,
+		Version:   r.Version,
+		Metadata:  make(map[string]string, len(r.Metadata)+1),
+		Endpoints: r.Endpoints,
+	}
+	for k, v := range r.Metadata {
+		s.Metadata[k] = v
+	}
+	s.Metadata["domain"] = domain
+	if r.Pinned {
+		s.Metadata[walPinnedKey] = "true"
+	}
+
+	for _, id := range ids {
+		n, ok := r.Nodes[id]
+		if !ok {
+			continue
+		}
+		rn := &register.Node{Id: n.Id, Address: n.Address, Metadata: make(map[string]string, len(n.Metadata)+2)}
+		for k, v := range n.Metadata {
+			rn.Metadata[k] = v
+		}
+		if n.TTL > 0 {
+			rn.Metadata[walTTLKey] = n.TTL.String()
+		}
+		if !n.Deadline.IsZero() {
+			rn.Metadata[walExpireAtKey] = n.Deadline.Format(time.RFC3339Nano)
+		}
+		if n.Static {
+			rn.Metadata[walStaticKey] = "true"
+		}
+		if n.Drained {
+			rn.Metadata[walDrainedKey] = "true"
+		}
+		if len(n.LastError) > 0 {
+			rn.Metadata[walErrorKey] = n.LastError
+			rn.Metadata[walErrorAtKey] = n.LastErrorAt.Format(time.RFC3339Nano)
+		}
+		s.Nodes = append(s.Nodes, rn)
+	}
+
+	m.logWAL(&register.Result{Action: "update", Service: s})
+}
+
+// walRemove logs the removal of the nodes, or of the whole version when none
+// are listed, or of the whole service without a version. The caller must
+// hold the lock.
+func (m *memory) walRemove(domain, service, version string, ids []string) {
+	if m.wal == nil {
+		return
+	}
+
+	s := &register.Service{Name: service, Version: version, Metadata: map[string]string{"domain": domain}}
+	for _, id := range ids {
+		s.Nodes = append(s.Nodes, &register.Node{Id: id})
+	}
+
+	m.logWAL(&register.Result{Action: "delete", Service: s})
+}
+
+// walSchema logs the schema of the record, the caller must hold the lock
+func (m *memory) walSchema(domain string, r *record) {
+	if m.wal == nil {
+		return
+	}
+
+	s := &register.Service{Name: r.Name, Version: r.Version, Metadata: map[string]string{
+		"domain":     domain,
+		walSchemaKey: base64.StdEncoding.EncodeToString(r.Schema),
+	}}
+
+	m.logWAL(&register.Result{Action: "schema", Service: s})
+}
+
+// walDomainTTL logs the TTL of the domain, a zero TTL logs its removal. The
+// caller must hold the lock.
+func (m *memory) walDomainTTL(domain string, ttl time.Duration) {
+	if m.wal == nil {
+		return
+	}
+
+	s := &register.Service{Metadata: map[string]string{"domain": domain, walTTLKey: ttl.String()}}
+
+	m.logWAL(&register.Result{Action: "ttl", Service: s})
+}
+
+// logWAL appends the change to the WAL, prefixed by its big endian uint32
+// size. Holding the lock keeps the entries in the order of the changes, the
+// entries of a transaction are kept until it commits.
+func (m *memory) logWAL(r *register.Result) {
+	b, err := EncodeResult(r)
+	if err != nil {
+		m.logf(logger.ErrorLevel, resultFields(r), "Register failed to encode the WAL entry: %v", err)
+		return
+	}
+
+	entry := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(entry, uint32(len(b)))
+	copy(entry[4:], b)
+
+	if m.walBuffered {
+		m.walPending = append(m.walPending, entry)
+		return
+	}
+	m.writeWAL(entry)
+}
+
+// writeWAL writes the entry in a single write so it stays whole, the caller
+// must hold the lock
+func (m *memory) writeWAL(entry []byte) {
+	if _, err := m.wal.Write(entry); err != nil {
+		m.logf(logger.ErrorLevel, nil, "Register failed to write the WAL entry: %v", err)
+	}
+}
+
+// ReplayWAL applies the changes of a WAL written with WALWriter, the nodes
+// are registered again with their TTL, deadline and state and the logged
+// removals, expiries included, remove them. No event is sent for the replayed
+// changes and they are not logged again.
+func (m *memory) ReplayWAL(r io.Reader) error {
+	if m.upstream != nil {
+		return ErrReadOnly
+	}
+
+	var size [4]byte
+	for i := 0; ; i++ {
+		if _, err := io.ReadFull(r, size[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%w: WAL entry %d: %v", ErrInvalidEncoding, i, err)
+		}
+
+		n := binary.BigEndian.Uint32(size[:])
+		if n > maxWALEntry {
+			return fmt.Errorf("%w: WAL entry %d of %d bytes", ErrInvalidEncoding, i, n)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return fmt.Errorf("%w: WAL entry %d: %v", ErrInvalidEncoding, i, err)
+		}
+
+		res, err := DecodeResult(b)
+		if err != nil {
+			return fmt.Errorf("WAL entry %d: %w", i, err)
+		}
+
+		m.Lock()
+		wal := m.wal
+		m.wal = nil
+		events, err := m.replay(res)
+		m.wal = wal
+		// the replayed events are never sent
+		for _, e := range events {
+			delete(m.diffs, e)
+		}
+		m.Unlock()
+		if err != nil {
+			return fmt.Errorf("WAL entry %d: %w", i, err)
+		}
+	}
+}
+
+// replay applies the WAL entry to the records, registrations add the nodes
+// one by one with their own expiry and removals listing nodes keep the
+// version even once it has no nodes left, the schemas and the domain TTLs
+// are set again. The caller must hold the lock.
+func (m *memory) replay(r *register.Result) ([]*register.Result, error) {
+	if r.Service == nil {
+		return nil, nil
+	}
+	s := r.Service
+	domain := mirrorDomain(s)
+
+	switch r.Action {
+	case "create", "update":
+		pinned := s.Metadata[walPinnedKey] == "true"
+		delete(s.Metadata, walPinnedKey)
+
+		if len(s.Nodes) == 0 {
+			events, err := m.register(s, register.NewRegisterOptions(register.RegisterDomain(domain), Pinned(pinned)))
+			if err == nil {
+				m.replayState(domain, s)
+			}
+			return events, err
+		}
+
+		var events []*register.Result
+		for _, n := range s.Nodes {
+			opts := []register.RegisterOption{register.RegisterDomain(domain), Pinned(pinned)}
+			if n.Metadata[walStaticKey] == "true" {
+				opts = append(opts, Static(true))
+			}
+			if ttl, err := time.ParseDuration(n.Metadata[walTTLKey]); err == nil {
+				opts = append(opts, register.RegisterTTL(ttl))
+			}
+			if deadline, err := time.Parse(time.RFC3339Nano, n.Metadata[walExpireAtKey]); err == nil {
+				opts = append(opts, ExpireAt(deadline))
+			}
+
+			// the logged state is restored once the nodes are registered
+			md := copyMetadata(n.Metadata)
+			for _, key := range []string{walTTLKey, walExpireAtKey, walStaticKey, walDrainedKey, walErrorKey, walErrorAtKey} {
+				delete(md, key)
+			}
+
+			srv := *s
+			srv.Nodes = []*register.Node{{Id: n.Id, Address: n.Address, Metadata: md}}
+			evts, err := m.register(&srv, register.NewRegisterOptions(opts...))
+			events = append(events, evts...)
+			if err != nil {
+				return events, err
+			}
+		}
+		m.replayState(domain, s)
+		return events, nil
+	case "schema":
+		rec, ok := m.records[domain][s.Name][s.Version]
+		if !ok {
+			return nil, nil
+		}
+		schema, err := base64.StdEncoding.DecodeString(s.Metadata[walSchemaKey])
+		if err != nil {
+			return nil, fmt.Errorf("%w: schema: %v", ErrInvalidEncoding, err)
+		}
+		rec.Schema = schema
+	case "ttl":
+		ttl, err := time.ParseDuration(s.Metadata[walTTLKey])
+		if err != nil {
+			return nil, fmt.Errorf("%w: domain TTL: %v", ErrInvalidEncoding, err)
+		}
+		m.setDomainTTL(domain, ttl)
+	case "delete":
+		if len(s.Version) == 0 || len(s.Nodes) == 0 {
+			return m.mirror(r)
+		}
+
+		rec, ok := m.records[domain][s.Name][s.Version]
+		if !ok {
+			return nil, nil
+		}
+		for _, n := range s.Nodes {
+			if rn, ok := rec.Nodes[n.Id]; ok {
+				delete(rec.Nodes, n.Id)
+				m.releaseNode(rn)
+				m.touch(rec)
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// replayState restores the primary marker of the logged version and the
+// readiness, drain and error state of its logged nodes, registering them
+// again only refreshes the nodes already registered. The caller must hold
+// the lock.
+func (m *memory) replayState(domain string, s *register.Service) {
+	rec, ok := m.records[domain][s.Name][s.Version]
+	if !ok {
+		return
+	}
+
+	if primary := s.Metadata["primary"] == "true"; (rec.Metadata["primary"] == "true") != primary {
+		m.indexRemove(domain, rec)
+		if primary {
+			rec.Metadata["primary"] = "true"
+		} else {
+			delete(rec.Metadata, "primary")
+		}
+		m.indexAdd(domain, rec)
+	}
+
+	for _, n := range s.Nodes {
+		rn, ok := rec.Nodes[n.Id]
+		if !ok {
+			continue
+		}
+		if ready, ok := n.Metadata["ready"]; ok {
+			rn.Metadata["ready"] = ready
+		} else {
+			delete(rn.Metadata, "ready")
+		}
+		rn.Drained = n.Metadata[walDrainedKey] == "true"
+		rn.LastError = n.Metadata[walErrorKey]
+		rn.LastErrorAt = time.Time{}
+		if at, err := time.Parse(time.RFC3339Nano, n.Metadata[walErrorAtKey]); err == nil {
+			rn.LastErrorAt = at
+		}
+	}
+}
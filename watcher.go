@@ -2,6 +2,9 @@ package memory
 
 import (
 	"errors"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/unistack-org/micro/v3/register"
 )
@@ -11,43 +14,211 @@ type Watcher struct {
 	wo   register.WatchOptions
 	res  chan *register.Result
 	exit chan bool
+	// actions are the delivered actions, all when empty
+	actions map[string]bool
+	// pending results are delivered before the live ones
+	pending []*register.Result
+	// buffered results are delivered newest first when the size is set
+	buffered   []*register.Result
+	bufferSize int
+	notify     chan struct{}
+	// skipAlive makes Next skip the keepalive results
+	skipAlive bool
+	// diff delivers the compact update results
+	diff bool
+	// nodeMetadata delivers only the results with a node having all the
+	// pairs, the other nodes are dropped from the results when filterNodes
+	nodeMetadata map[string]string
+	filterNodes  bool
+	// drops counts the consecutive dropped events since firstDrop
+	drops     int
+	firstDrop time.Time
+	warned    bool
+	sync.Mutex
 }
 
 func (m *Watcher) Next() (*register.Result, error) {
+	select {
+	case <-m.exit:
+		return nil, errors.New("watcher stopped")
+	default:
+	}
+
 	for {
+		m.Lock()
+		if len(m.pending) > 0 {
+			r := m.pending[0]
+			m.pending = m.pending[1:]
+			m.Unlock()
+			return r, nil
+		}
+		if n := len(m.buffered); n > 0 {
+			r := m.buffered[n-1]
+			m.buffered[n-1] = nil
+			m.buffered = m.buffered[:n-1]
+			m.Unlock()
+			return r, nil
+		}
+		m.Unlock()
+
 		select {
 		case r := <-m.res:
-			if r.Service == nil {
+			if m.skipAlive && r.Action == "keepalive" {
 				continue
 			}
-
-			if len(m.wo.Service) > 0 && m.wo.Service != r.Service.Name {
-				continue
-			}
-
-			// extract domain from service metadata
-			var domain string
-			if r.Service.Metadata != nil && len(r.Service.Metadata["domain"]) > 0 {
-				domain = r.Service.Metadata["domain"]
-			} else {
-				domain = register.DefaultDomain
-			}
-
-			// only send the event if watching the wildcard or this specific domain
-			if m.wo.Domain == register.WildcardDomain || m.wo.Domain == domain {
-				return r, nil
-			}
+			return r, nil
+		case <-m.notify:
 		case <-m.exit:
 			return nil, errors.New("watcher stopped")
 		}
 	}
 }
 
+// buffer queues the result for newest first delivery, the oldest result
+// is dropped when the buffer is full
+func (m *Watcher) buffer(r *register.Result) {
+	m.Lock()
+	if len(m.buffered) >= m.bufferSize {
+		copy(m.buffered, m.buffered[1:])
+		m.buffered = m.buffered[:len(m.buffered)-1]
+	}
+	m.buffered = append(m.buffered, r)
+	m.Unlock()
+
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Stop stops the watcher, it can be called concurrently and more than once
 func (m *Watcher) Stop() {
+	m.Lock()
+	defer m.Unlock()
+
 	select {
 	case <-m.exit:
-		return
 	default:
 		close(m.exit)
 	}
 }
+
+// delivered resets the consecutive dropped events
+func (m *Watcher) delivered() {
+	m.Lock()
+	m.drops = 0
+	m.warned = false
+	m.Unlock()
+}
+
+// dropped counts a dropped event, it returns true once when the drops
+// exceed the watchdog threshold within the window
+func (m *Watcher) dropped(wd watchdog) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	if m.drops == 0 || (wd.window > 0 && now.Sub(m.firstDrop) > wd.window) {
+		m.drops = 0
+		m.firstDrop = now
+	}
+	m.drops++
+
+	if m.drops > wd.threshold && !m.warned {
+		m.warned = true
+		return true
+	}
+	return false
+}
+
+// matches reports whether the result passes the watcher filters
+func (m *Watcher) matches(r *register.Result) bool {
+	if r.Service == nil {
+		return false
+	}
+
+	if len(m.actions) > 0 && !m.actions[r.Action] {
+		return false
+	}
+
+	if len(m.wo.Service) > 0 && m.wo.Service != r.Service.Name {
+		return false
+	}
+
+	// domain events are only delivered to the wildcard domain watchers
+	if r.Service.Metadata["event"] == "domain" && m.wo.Domain != register.WildcardDomain {
+		return false
+	}
+
+	if len(m.nodeMetadata) > 0 && !anyNodeMatches(r.Service.Nodes, m.nodeMetadata) {
+		return false
+	}
+
+	// extract domain from service metadata
+	var domain string
+	if r.Service.Metadata != nil && len(r.Service.Metadata["domain"]) > 0 {
+		domain = r.Service.Metadata["domain"]
+	} else {
+		domain = register.DefaultDomain
+	}
+
+	// only send the event if watching the wildcard or this specific domain
+	return m.wo.Domain == register.WildcardDomain || m.wo.Domain == domain
+}
+
+// filter drops the nodes not matching the node metadata filter from the
+// result when filterNodes is set, the result is copied if changed
+func (m *Watcher) filter(r *register.Result) *register.Result {
+	if !m.filterNodes || len(m.nodeMetadata) == 0 || r.Service == nil {
+		return r
+	}
+
+	srv := *r.Service
+	srv.Nodes = make([]*register.Node, 0, len(r.Service.Nodes))
+	for _, n := range r.Service.Nodes {
+		if nodeMatches(n, m.nodeMetadata) {
+			srv.Nodes = append(srv.Nodes, n)
+		}
+	}
+
+	return &register.Result{Action: r.Action, Service: &srv}
+}
+
+// WatcherInfo describes an active watcher and its filters
+type WatcherInfo struct {
+	Id      string
+	Domain  string
+	Service string
+	// Actions are the delivered actions, all when empty
+	Actions []string
+}
+
+// Watchers returns the active watchers sorted by id
+func (m *memory) Watchers() []WatcherInfo {
+	m.RLock()
+	defer m.RUnlock()
+
+	infos := make([]WatcherInfo, 0, len(m.watchers))
+	for _, w := range m.watchers {
+		select {
+		case <-w.exit:
+			continue
+		default:
+		}
+
+		info := WatcherInfo{
+			Id:      w.id,
+			Domain:  w.wo.Domain,
+			Service: w.wo.Service,
+		}
+		for action := range w.actions {
+			info.Actions = append(info.Actions, action)
+		}
+		sort.Strings(info.Actions)
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Id < infos[j].Id })
+
+	return infos
+}
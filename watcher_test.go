@@ -1,7 +1,15 @@
 package memory
 
 import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/unistack-org/micro/v3/register"
 )
@@ -33,3 +41,1103 @@ func TestWatcher(t *testing.T) {
 		t.Fatal("expected error on Next()")
 	}
 }
+
+func TestWatcherFilterAtDispatch(t *testing.T) {
+	m := NewRegister(EventTimeout(time.Second)).(*memory)
+
+	w, err := m.Watch(context.TODO(), register.WatchService("foo"), register.WatchDomain(register.WildcardDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	// unrelated events must be skipped without waiting for the event timeout
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		m.sendEvent(&register.Result{Action: "create", Service: &register.Service{Name: "bar"}})
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("unrelated events were queued to the watcher, took %v", elapsed)
+	}
+
+	go m.sendEvent(&register.Result{Action: "create", Service: &register.Service{Name: "foo"}})
+
+	r, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Service.Name != "foo" {
+		t.Fatalf("Expected foo event, got %s", r.Service.Name)
+	}
+}
+
+func TestWatcherResync(t *testing.T) {
+	m := NewRegister()
+	ctx := context.TODO()
+
+	for _, srv := range []*register.Service{
+		{Name: "foo", Version: "1.0.0"},
+		{Name: "foo", Version: "1.0.1"},
+		{Name: "bar", Version: "1.0.0"},
+	} {
+		if err := m.Register(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// let the registration events settle before watching
+	time.Sleep(50 * time.Millisecond)
+
+	w, err := m.Watch(ctx, register.WatchService("foo"), ResyncInterval(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	for tick := 0; tick < 2; tick++ {
+		versions := make(map[string]bool)
+		for i := 0; i < 2; i++ {
+			r, err := w.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Action != "create" || r.Service.Name != "foo" {
+				t.Fatalf("unexpected resync event %s for %s", r.Action, r.Service.Name)
+			}
+			versions[r.Service.Version] = true
+		}
+		if len(versions) != 2 {
+			t.Fatalf("Expected full state on tick %d, got %v", tick, versions)
+		}
+	}
+}
+
+func TestWatcherResumeFrom(t *testing.T) {
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	for _, name := range []string{"foo", "bar"} {
+		srv := &register.Service{Name: name, Version: "1.0.0", Nodes: []*register.Node{{Id: name + "-1"}}}
+		if err := m.Register(ctx, srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rev := m.Revision()
+
+	// change bar and add baz after the revision
+	if err := m.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-2"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(ctx, &register.Service{Name: "baz", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// let the registration events settle before watching
+	time.Sleep(50 * time.Millisecond)
+
+	w, err := m.Watch(ctx, ResumeFrom(rev))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	replayed := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		r, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayed[r.Service.Name] = true
+	}
+
+	if !replayed["bar"] || !replayed["baz"] {
+		t.Fatalf("Expected bar and baz to be replayed, got %v", replayed)
+	}
+
+	// live events follow the replay
+	go m.Register(ctx, &register.Service{Name: "qux", Version: "1.0.0"})
+
+	r, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Service.Name != "qux" {
+		t.Fatalf("Expected live event for qux, got %s", r.Service.Name)
+	}
+}
+
+func TestWatcherActions(t *testing.T) {
+	m := NewRegister()
+	ctx := context.TODO()
+
+	w, err := m.Watch(ctx, WatchActions("delete"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+	srv.Nodes = append(srv.Nodes, &register.Node{Id: "foo-2"})
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	// let the create and update events be dispatched first
+	time.Sleep(50 * time.Millisecond)
+
+	if err := m.Deregister(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Action != "delete" {
+		t.Fatalf("Expected delete event, got %s", r.Action)
+	}
+}
+
+func TestWatcherHashResync(t *testing.T) {
+	m := NewRegister()
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	// let the registration events settle before watching
+	time.Sleep(50 * time.Millisecond)
+
+	w, err := m.Watch(ctx, HashResyncInterval(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	nextHash := func() string {
+		for {
+			r, err := w.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Action != "resync" {
+				continue
+			}
+			if len(r.Service.Nodes) != 0 || r.Service.Name != "foo" {
+				t.Fatalf("Expected lightweight resync result, got %v", r.Service)
+			}
+			return r.Service.Metadata["hash"]
+		}
+	}
+
+	first := nextHash()
+	if second := nextHash(); first != second {
+		t.Fatalf("hash of an unchanged service changed: %s != %s", first, second)
+	}
+
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-2"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// skip a tick which may have been computed before the change
+	nextHash()
+	if changed := nextHash(); changed == first {
+		t.Fatal("hash of a changed service didn't change")
+	}
+}
+
+func TestWatcherWatchdog(t *testing.T) {
+	m := NewRegister(EventTimeout(time.Millisecond), WatcherWatchdog(2, time.Second, true)).(*memory)
+	ctx := context.TODO()
+
+	w, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stuck := w.(*Watcher)
+
+	// nobody calls Next so every event is dropped
+	for i := 0; i < 3; i++ {
+		m.sendEvent(&register.Result{Action: "create", Service: &register.Service{Name: "foo", Metadata: map[string]string{"domain": register.DefaultDomain}}})
+	}
+
+	select {
+	case <-stuck.exit:
+	default:
+		t.Fatal("Expected the stuck watcher to be stopped")
+	}
+
+	m.RLock()
+	_, ok := m.watchers[stuck.id]
+	m.RUnlock()
+	if ok {
+		t.Fatal("Expected the stuck watcher to be removed")
+	}
+}
+
+func TestWatcherWatchdogWarnOnly(t *testing.T) {
+	m := NewRegister(EventTimeout(time.Millisecond), WatcherWatchdog(1, time.Second, false)).(*memory)
+	ctx := context.TODO()
+
+	w, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	stuck := w.(*Watcher)
+
+	r := &register.Result{Action: "create", Service: &register.Service{Name: "foo", Metadata: map[string]string{"domain": register.DefaultDomain}}}
+	m.sendEvent(r)
+	m.sendEvent(r)
+
+	stuck.Lock()
+	drops, warned := stuck.drops, stuck.warned
+	stuck.Unlock()
+	if drops != 2 || !warned {
+		t.Fatalf("Expected 2 drops with a warning, got %d drops, warned %v", drops, warned)
+	}
+
+	select {
+	case <-stuck.exit:
+		t.Fatal("Expected the watcher to keep running")
+	default:
+	}
+
+	go m.sendEvent(r)
+	if _, err := w.Next(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	stuck.Lock()
+	drops = stuck.drops
+	stuck.Unlock()
+	if drops != 0 {
+		t.Fatalf("Expected drops to reset after a delivery, got %d", drops)
+	}
+}
+
+func TestWatcherNewestFirst(t *testing.T) {
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	w, err := m.Watch(ctx, WatchNewestFirst(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	// burst of events while the consumer isn't reading
+	for _, version := range []string{"1.0.0", "1.0.1", "1.0.2", "1.0.3"} {
+		m.sendEvent(&register.Result{Action: "update", Service: &register.Service{Name: "foo", Version: version, Metadata: map[string]string{"domain": register.DefaultDomain}}})
+	}
+
+	// the oldest event is dropped from the full buffer
+	for _, version := range []string{"1.0.3", "1.0.2", "1.0.1"} {
+		r, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Service.Version != version {
+			t.Fatalf("Expected version %s, got %s", version, r.Service.Version)
+		}
+	}
+
+	// a waiting consumer is woken up by a new event
+	go m.sendEvent(&register.Result{Action: "update", Service: &register.Service{Name: "foo", Version: "1.0.4", Metadata: map[string]string{"domain": register.DefaultDomain}}})
+	r, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Service.Version != "1.0.4" {
+		t.Fatalf("Expected version 1.0.4, got %s", r.Service.Version)
+	}
+}
+
+func TestWatcherDiff(t *testing.T) {
+	m := NewRegister(EventTimeout(time.Second)).(*memory)
+	ctx := context.TODO()
+
+	srv := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}, {Id: "foo-2"}}}
+	if err := m.Register(ctx, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	// let the register events be dispatched before watching
+	time.Sleep(20 * time.Millisecond)
+
+	diffWatcher, err := m.Watch(ctx, WatchDiff())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer diffWatcher.Stop()
+	// buffered so the dispatch never waits on it while reading the other watcher
+	fullWatcher, err := m.Watch(ctx, WatchNewestFirst(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fullWatcher.Stop()
+
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-3"}}}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := diffWatcher.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Action != "update" || r.Service.Metadata["added"] != "foo-3" || len(r.Service.Metadata["removed"]) > 0 || len(r.Service.Nodes) > 0 {
+		t.Fatalf("Expected the foo-3 node added, got %+v", r.Service)
+	}
+	if r, err = fullWatcher.Next(); err != nil {
+		t.Fatal(err)
+	} else if len(r.Service.Nodes) != 1 || len(r.Service.Metadata["added"]) > 0 {
+		t.Fatalf("Expected the full service for the other watcher, got %+v", r.Service)
+	}
+
+	if err := m.Deregister(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = diffWatcher.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Action != "update" || r.Service.Metadata["removed"] != "foo-1" || len(r.Service.Metadata["added"]) > 0 {
+		t.Fatalf("Expected the foo-1 node removed, got %+v", r.Service)
+	}
+	if _, err = fullWatcher.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	m.RLock()
+	pending := len(m.diffs)
+	m.RUnlock()
+	if pending != 0 {
+		t.Fatalf("Expected no pending diffs, got %d", pending)
+	}
+}
+
+func TestWatcherMaxWatchers(t *testing.T) {
+	m := NewRegister(MaxWatchers(2))
+	ctx := context.TODO()
+
+	w1, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Stop()
+
+	if _, err := m.Watch(ctx); err != ErrLimitExceeded {
+		t.Fatalf("Expected ErrLimitExceeded, got %v", err)
+	}
+
+	// stopping a watcher releases its slot
+	w1.Stop()
+	w3, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Expected a watcher after releasing one, got %v", err)
+	}
+	defer w3.Stop()
+
+	if _, err := m.Watch(ctx); err != ErrLimitExceeded {
+		t.Fatalf("Expected ErrLimitExceeded, got %v", err)
+	}
+}
+
+func TestWatcherKeepalive(t *testing.T) {
+	m := NewRegister()
+	ctx := context.TODO()
+
+	w, err := m.Watch(ctx, Keepalive(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		r, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Action != "keepalive" || r.Service != nil {
+			t.Fatalf("Expected a keepalive result, got %+v", r)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Expected 3 keepalives about every 20ms, got them in %v", elapsed)
+	}
+}
+
+func TestWatcherSkipKeepalive(t *testing.T) {
+	// the event must not be dropped while a keepalive is skipped
+	m := NewRegister(EventTimeout(time.Second))
+	ctx := context.TODO()
+
+	w, err := m.Watch(ctx, Keepalive(5*time.Millisecond), SkipKeepalive(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0"})
+	}()
+
+	r, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Action != "create" || r.Service.Name != "foo" {
+		t.Fatalf("Expected the keepalives to be skipped, got %+v", r)
+	}
+}
+
+func TestWatchers(t *testing.T) {
+	m := NewRegister().(*memory)
+	ctx := context.TODO()
+
+	all, err := m.Watch(ctx, register.WatchDomain(register.WildcardDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Stop()
+	foo, err := m.Watch(ctx, register.WatchService("foo"), register.WatchDomain("a"), WatchActions("delete", "create"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer foo.Stop()
+	stopped, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped.Stop()
+
+	infos := m.Watchers()
+	if len(infos) != 2 {
+		t.Fatalf("Expected 2 active watchers, got %+v", infos)
+	}
+
+	byID := make(map[string]WatcherInfo)
+	for _, info := range infos {
+		byID[info.Id] = info
+	}
+
+	if info := byID[all.(*Watcher).id]; info.Domain != register.WildcardDomain || info.Service != "" || len(info.Actions) != 0 {
+		t.Fatalf("Unexpected wildcard watcher info %+v", info)
+	}
+	info := byID[foo.(*Watcher).id]
+	if info.Domain != "a" || info.Service != "foo" || !reflect.DeepEqual(info.Actions, []string{"create", "delete"}) {
+		t.Fatalf("Unexpected foo watcher info %+v", info)
+	}
+
+	// the info is a copy
+	info.Actions[0] = "update"
+	if !foo.(*Watcher).actions["create"] {
+		t.Fatal("Expected the watcher filters not to be shared")
+	}
+}
+
+func TestWatcherIDGenerator(t *testing.T) {
+	var next int
+	m := newMemory(register.NewOptions(IDGenerator(func() string {
+		next++
+		return fmt.Sprintf("watcher-%d", next)
+	})))
+	ctx := context.TODO()
+
+	for i := 0; i < 2; i++ {
+		w, err := m.Watch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Stop()
+	}
+
+	var ids []string
+	for _, info := range m.Watchers() {
+		ids = append(ids, info.Id)
+	}
+	if expect := []string{"watcher-1", "watcher-2"}; !reflect.DeepEqual(ids, expect) {
+		t.Fatalf("Expected watcher ids %v, got %v", expect, ids)
+	}
+}
+
+func TestWatcherDeliveryLatency(t *testing.T) {
+	m := newMemory(register.NewOptions(EventTimeout(time.Second)))
+
+	w, err := m.Watch(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	go m.sendEvent(&register.Result{Action: "create", Service: &register.Service{Name: "foo"}})
+
+	// slow consumer
+	time.Sleep(50 * time.Millisecond)
+	if _, err := w.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the latency is recorded right after the receipt
+	time.Sleep(10 * time.Millisecond)
+	stats := m.Stats()
+	if stats.DeliveredEvents != 1 {
+		t.Fatalf("Expected 1 delivered event, got %d", stats.DeliveredEvents)
+	}
+	if stats.DeliveryLatencyMax < 50*time.Millisecond || stats.DeliveryLatencyP50 < 50*time.Millisecond || stats.DeliveryLatencyP99 != stats.DeliveryLatencyMax {
+		t.Fatalf("Expected the latency to reflect the slow consumer, got %+v", stats)
+	}
+}
+
+func TestWaitForService(t *testing.T) {
+	m := newMemory(register.NewOptions(EventTimeout(time.Second)))
+	ctx := context.TODO()
+
+	foo := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	if err := m.Register(ctx, foo); err != nil {
+		t.Fatal(err)
+	}
+
+	// already present
+	srv, err := m.WaitForService(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Name != "foo" || len(srv.Nodes) != 1 {
+		t.Fatalf("Expected the registered foo service, got %+v", srv)
+	}
+
+	// appears later
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		bar := &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}}
+		if err := m.Register(ctx, bar); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	srv, err = m.WaitForService(waitCtx, "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Name != "bar" {
+		t.Fatalf("Expected the bar service, got %+v", srv)
+	}
+
+	// times out
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := m.WaitForService(timeoutCtx, "baz"); err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// the internal watchers are stopped
+	time.Sleep(10 * time.Millisecond)
+	if infos := m.Watchers(); len(infos) != 0 {
+		t.Fatalf("Expected no active watchers, got %+v", infos)
+	}
+	if stats := m.Stats(); stats.Watchers != 0 {
+		t.Fatalf("Expected the stats to count no watchers, got %d", stats.Watchers)
+	}
+}
+
+func TestWatcherNodeMetadata(t *testing.T) {
+	m := newMemory(register.NewOptions(EventTimeout(time.Second)))
+	ctx := context.TODO()
+
+	zone := map[string]string{"zone": "a"}
+	// buffered so neither watcher waits on the other
+	matching, err := m.Watch(ctx, WatchNodeMetadata(zone), WatchNewestFirst(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer matching.Stop()
+	filtered, err := m.Watch(ctx, WatchNodeMetadata(zone), WatchFilterNodes(true), WatchNewestFirst(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filtered.Stop()
+
+	nodes := func(r *register.Result) []string {
+		var ids []string
+		for _, n := range r.Service.Nodes {
+			ids = append(ids, n.Id)
+		}
+		return ids
+	}
+
+	foo := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{
+		{Id: "foo-1", Metadata: map[string]string{"zone": "a"}},
+		{Id: "foo-2", Metadata: map[string]string{"zone": "b"}},
+	}}
+	if err := m.Register(ctx, foo); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	res, err := matching.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := nodes(res); res.Service.Name != "foo" || len(ids) != 2 {
+		t.Fatalf("Expected foo with all its nodes, got %s %v", res.Service.Name, ids)
+	}
+	res, err = filtered.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := nodes(res); res.Service.Name != "foo" || !reflect.DeepEqual(ids, []string{"foo-1"}) {
+		t.Fatalf("Expected foo with only foo-1, got %s %v", res.Service.Name, ids)
+	}
+
+	// events of other zones aren't delivered
+	bar := &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1", Metadata: map[string]string{"zone": "b"}}}}
+	if err := m.Register(ctx, bar); err != nil {
+		t.Fatal(err)
+	}
+	baz := &register.Service{Name: "baz", Version: "1.0.0", Nodes: []*register.Node{{Id: "baz-1", Metadata: map[string]string{"zone": "a"}}}}
+	if err := m.Register(ctx, baz); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	for _, w := range []register.Watcher{matching, filtered} {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Service.Name != "baz" {
+			t.Fatalf("Expected only the baz event, got %s", res.Service.Name)
+		}
+	}
+}
+
+func TestWatcherIdenticalRegister(t *testing.T) {
+	var validated int32
+	validator := func(*register.Service, []*register.Service) error {
+		atomic.AddInt32(&validated, 1)
+		return nil
+	}
+	m := newMemory(register.NewOptions(EventTimeout(time.Second), RegisterValidator(validator)))
+	ctx := context.TODO()
+
+	w, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	service := func(nodes ...string) *register.Service {
+		srv := &register.Service{
+			Name:      "foo",
+			Version:   "1.0.0",
+			Metadata:  map[string]string{"tier": "critical"},
+			Endpoints: []*register.Endpoint{{Name: "Foo.Call", Request: &register.Value{Name: "Request"}}},
+		}
+		for _, id := range nodes {
+			srv.Nodes = append(srv.Nodes, &register.Node{Id: id, Address: id + ":8080", Metadata: map[string]string{"protocol": "GRPC"}})
+		}
+		return srv
+	}
+
+	if err := m.Register(ctx, service("foo-1"), register.RegisterTTL(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := w.Next(); err != nil || res.Action != "create" {
+		t.Fatalf("Expected the create event, got %+v, %v", res, err)
+	}
+
+	// heartbeats resending the same service
+	rev := m.Revision()
+	for i := 0; i < 3; i++ {
+		if err := m.Register(ctx, service("foo-1"), register.RegisterTTL(2*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.Revision() != rev {
+		t.Fatalf("Expected the revision %d to be unchanged by the heartbeats, got %d", rev, m.Revision())
+	}
+	if n := atomic.LoadInt32(&validated); n != 1 {
+		t.Fatalf("Expected the heartbeats to skip the validator, got %d calls", n)
+	}
+	m.RLock()
+	ttl := m.records[register.DefaultDomain]["foo"]["1.0.0"].Nodes["foo-1"].TTL
+	m.RUnlock()
+	if ttl != 2*time.Minute {
+		t.Fatalf("Expected the TTL to be refreshed, got %v", ttl)
+	}
+
+	if err := m.Register(ctx, service("foo-1", "foo-2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first event after the heartbeats is the new node
+	res, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != "update" || len(res.Service.Nodes) != 2 {
+		t.Fatalf("Expected the update adding foo-2, got %s with %d nodes", res.Action, len(res.Service.Nodes))
+	}
+}
+
+func TestWatcherDomainEvents(t *testing.T) {
+	m := newMemory(register.NewOptions(DomainEvents(true), EventTimeout(time.Second)))
+	ctx := context.TODO()
+
+	all, err := m.Watch(ctx, register.WatchDomain(register.WildcardDomain), WatchNewestFirst(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Stop()
+	domain, err := m.Watch(ctx, register.WatchDomain("a"), WatchNewestFirst(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer domain.Stop()
+
+	foo := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	bar := &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}}
+	for _, srv := range []*register.Service{foo, bar} {
+		if err := m.Register(ctx, srv, register.RegisterDomain("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, srv := range []*register.Service{foo, bar} {
+		if err := m.Deregister(ctx, srv, register.DeregisterDomain("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	drain := func(w register.Watcher, n int) []string {
+		var events []string
+		for i := 0; i < n; i++ {
+			res, err := w.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Service.Metadata["event"] == "domain" {
+				events = append(events, res.Action+" "+res.Service.Metadata["domain"])
+			}
+		}
+		sort.Strings(events)
+		return events
+	}
+
+	// the domain events come on top of the 4 service events
+	if events := drain(all, 6); !reflect.DeepEqual(events, []string{"create a", "delete a"}) {
+		t.Fatalf("Expected the domain create and delete events, got %v", events)
+	}
+	if events := drain(domain, 4); len(events) != 0 {
+		t.Fatalf("Expected no domain events for the domain watcher, got %v", events)
+	}
+}
+
+func TestWatcherDomainEventsRename(t *testing.T) {
+	m := newMemory(register.NewOptions(DomainEvents(true), EventTimeout(time.Second)))
+	ctx := context.TODO()
+
+	if err := m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}, register.RegisterDomain("a")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	w, err := m.Watch(ctx, register.WatchDomain(register.WildcardDomain), WatchNewestFirst(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	if err := m.RenameDomain("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	var events []string
+	for i := 0; i < 4; i++ {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Service.Metadata["event"] == "domain" {
+			events = append(events, res.Action+" "+res.Service.Metadata["domain"])
+		}
+	}
+	sort.Strings(events)
+
+	// the domain events come on top of the service delete and create events
+	if expect := []string{"create b", "delete a"}; !reflect.DeepEqual(events, expect) {
+		t.Fatalf("Expected the domain events %v, got %v", expect, events)
+	}
+}
+
+func TestWatcherPauseEvents(t *testing.T) {
+	m := newMemory(register.NewOptions(EventTimeout(time.Second)))
+	ctx := context.TODO()
+
+	qux := &register.Service{Name: "qux", Version: "1.0.0", Nodes: []*register.Node{{Id: "qux-1"}, {Id: "qux-2"}}}
+	if err := m.Register(ctx, qux); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	w, err := m.Watch(ctx, WatchNewestFirst(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	m.PauseEvents()
+
+	changes := []func() error{
+		func() error {
+			return m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}})
+		},
+		func() error {
+			return m.Register(ctx, &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-2"}}})
+		},
+		func() error {
+			return m.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}})
+		},
+		func() error {
+			return m.Deregister(ctx, &register.Service{Name: "bar", Version: "1.0.0", Nodes: []*register.Node{{Id: "bar-1"}}})
+		},
+		func() error {
+			return m.Deregister(ctx, &register.Service{Name: "qux", Version: "1.0.0", Nodes: []*register.Node{{Id: "qux-1"}}})
+		},
+	}
+	for _, change := range changes {
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nothing is delivered while paused
+	time.Sleep(20 * time.Millisecond)
+	w.(*Watcher).Lock()
+	buffered := len(w.(*Watcher).buffered)
+	w.(*Watcher).Unlock()
+	if buffered != 0 {
+		t.Fatalf("Expected no events while paused, got %d", buffered)
+	}
+
+	m.ResumeEvents()
+	time.Sleep(20 * time.Millisecond)
+
+	var events []string
+	for i := 0; i < 2; i++ {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, fmt.Sprintf("%s %s %d", res.Action, res.Service.Name, len(res.Service.Nodes)))
+	}
+	sort.Strings(events)
+	if expect := []string{"create foo 2", "update qux 1"}; !reflect.DeepEqual(events, expect) {
+		t.Fatalf("Expected the coalesced events %v, got %v", expect, events)
+	}
+
+	w.(*Watcher).Lock()
+	buffered = len(w.(*Watcher).buffered)
+	w.(*Watcher).Unlock()
+	if buffered != 0 {
+		t.Fatalf("Expected a single event per service, got %d more", buffered)
+	}
+}
+
+func TestWatcherEventSequence(t *testing.T) {
+	m := NewRegister(EventSequence(true), EventQueue(16, QueueBlock), EventTimeout(time.Second)).(*memory)
+	defer m.Disconnect(context.TODO())
+	ctx := context.TODO()
+
+	w, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	foo := &register.Service{Name: "foo", Version: "1.0.0", Nodes: []*register.Node{{Id: "foo-1"}}}
+	for _, id := range []string{"foo-1", "foo-2", "foo-3"} {
+		foo.Nodes = []*register.Node{{Id: id}}
+		if err := m.Register(ctx, foo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Deregister(ctx, foo); err != nil {
+		t.Fatal(err)
+	}
+
+	var last uint64
+	for i := 0; i < 4; i++ {
+		r, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq, err := strconv.ParseUint(r.Service.Metadata["sequence"], 10, 64)
+		if err != nil {
+			t.Fatalf("Expected a sequence number on the %s event, got %v", r.Action, err)
+		}
+		if seq != last+1 {
+			t.Fatalf("Expected sequence %d, got %d", last+1, seq)
+		}
+		last = seq
+	}
+
+	// the sent services are left untouched
+	if _, ok := foo.Metadata["sequence"]; ok {
+		t.Fatal("Expected the registered service not to carry the sequence")
+	}
+}
+
+func TestWatcherDisconnectRace(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		m := newMemory(register.NewOptions())
+
+		watchers := make(chan register.Watcher, 8)
+		var wg sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if w, err := m.Watch(context.TODO()); err == nil {
+					watchers <- w
+				} else if err != ErrClosed {
+					t.Error(err)
+				}
+			}()
+		}
+		m.Disconnect(context.TODO())
+		wg.Wait()
+		close(watchers)
+
+		// every watcher added before the disconnect is stopped by it
+		for w := range watchers {
+			select {
+			case <-w.(*Watcher).exit:
+			default:
+				t.Fatal("Expected the watcher to be stopped by Disconnect")
+			}
+		}
+	}
+}
+
+func TestWatcherStopConcurrent(t *testing.T) {
+	m := newMemory(register.NewOptions())
+
+	w, err := m.Watch(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the user, Disconnect and the watchdog may all stop the watcher at once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.Stop()
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.Disconnect(context.TODO())
+	}()
+	wg.Wait()
+
+	if _, err := w.Next(); err == nil {
+		t.Fatal("Expected the watcher to be stopped")
+	}
+}
+
+func TestWatcherEnabledFlags(t *testing.T) {
+	m := NewRegister(EnabledFlags(map[string]bool{"beta": false}))
+	ctx := context.TODO()
+
+	flagged := &register.Service{Name: "foo", Version: "1.0.0", Metadata: map[string]string{"flag": "beta"}}
+	if err := m.Register(ctx, flagged); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(ctx, &register.Service{Name: "bar", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// let the registration events settle before watching
+	time.Sleep(50 * time.Millisecond)
+
+	// the replay skips the flagged service
+	rw, err := m.Watch(ctx, ResumeFrom(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Stop()
+
+	r, err := rw.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Service.Name != "bar" {
+		t.Fatalf("Expected replay of bar only, got %s", r.Service.Name)
+	}
+
+	// the resync snapshots skip it too
+	sw, err := m.Watch(ctx, ResyncInterval(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sw.Stop()
+
+	for tick := 0; tick < 2; tick++ {
+		r, err := sw.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Service.Name != "bar" {
+			t.Fatalf("Expected resync of bar only on tick %d, got %s", tick, r.Service.Name)
+		}
+	}
+
+	// and the live events of the flagged service are not delivered
+	w, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	go func() {
+		flagged.Nodes = []*register.Node{{Id: "foo-1"}}
+		m.Register(ctx, flagged)
+		m.Register(ctx, &register.Service{Name: "baz", Version: "1.0.0"})
+		m.Deregister(ctx, flagged)
+		m.Deregister(ctx, &register.Service{Name: "baz", Version: "1.0.0"})
+	}()
+
+	actions := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		r, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Service.Name != "baz" {
+			t.Fatalf("Expected events for baz only, got %s for %s", r.Action, r.Service.Name)
+		}
+		actions[r.Action] = true
+	}
+	if !actions["create"] || !actions["delete"] {
+		t.Fatalf("Expected create and delete for baz, got %v", actions)
+	}
+}